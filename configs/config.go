@@ -3,11 +3,44 @@ package configs
 import "os"
 
 type GlobalConf struct {
-	AppHost    string
-	AppPort    string
-	Url        string
-	RtspUrl    string
-	HlsRtspUrl string
+	AppHost                   string
+	AppPort                   string
+	Url                       string
+	RtspUrl                   string
+	HlsRtspUrl                string
+	HlsSessionTimeout         int
+	HlsPartDuration           int
+	HlsWindowSize             int
+	HlsTargetDuration         int
+	HlsSplitLongGop           bool
+	DvrDir                    string
+	DvrWindow                 int
+	DvrMemoryBudget           int
+	RecordDir                 string
+	RecordFormat              string
+	RecordSegmentSeconds      int
+	RecordRetentionHours      int
+	RecordMaxDiskMB           int
+	ClipDir                   string
+	ClipMaxSeconds            int
+	ClipRetentionHours        int
+	WebrtcIceServers          string
+	WebrtcIceUsername         string
+	WebrtcIceCredential       string
+	WebrtcPublicIPs           string
+	WebrtcUdpPortMin          int
+	WebrtcUdpPortMax          int
+	RtspServerPort            string
+	RtspServerUdpPort         int
+	RtmpServerPort            string
+	RtmpPublishKey            string
+	SourceFailoverAttempts    int
+	SourcePrimaryRetrySeconds int
+	ReconnectInitialSeconds   int
+	ReconnectMaxSeconds       int
+	ReconnectMultiplier       float64
+	ReconnectJitter           float64
+	ReconnectMaxAttempts      int
 }
 
 var GlobalConfig GlobalConf
@@ -18,4 +51,37 @@ func SetGlobalConfig() {
 	GlobalConfig.Url = os.Getenv("RTSP_URL")
 	GlobalConfig.RtspUrl = os.Getenv("RTSP_PARSE_URL")
 	GlobalConfig.HlsRtspUrl = os.Getenv("HLS_RTSP_URL")
+	GlobalConfig.HlsSessionTimeout = GetEnvAsInt("HLS_SESSION_TIMEOUT", 30)
+	GlobalConfig.HlsPartDuration = GetEnvAsInt("HLS_PART_DURATION_MS", 0)
+	GlobalConfig.HlsWindowSize = GetEnvAsInt("HLS_WINDOW_SIZE", 6)
+	GlobalConfig.HlsTargetDuration = GetEnvAsInt("HLS_TARGET_DURATION", 4)
+	GlobalConfig.HlsSplitLongGop = GetEnvAsBool("HLS_SPLIT_LONG_GOP", false)
+	GlobalConfig.DvrDir = GetEnvOrDefault("DVR_DIR", "./dvr")
+	GlobalConfig.DvrWindow = GetEnvAsInt("DVR_WINDOW_SECONDS", 0)
+	GlobalConfig.DvrMemoryBudget = GetEnvAsInt("DVR_MEMORY_BUDGET_MB", 256)
+	GlobalConfig.RecordDir = GetEnvOrDefault("RECORD_DIR", "./recordings")
+	GlobalConfig.RecordFormat = GetEnvOrDefault("RECORD_FORMAT", "ts")
+	GlobalConfig.RecordSegmentSeconds = GetEnvAsInt("RECORD_SEGMENT_SECONDS", 60)
+	GlobalConfig.RecordRetentionHours = GetEnvAsInt("RECORD_RETENTION_HOURS", 168)
+	GlobalConfig.RecordMaxDiskMB = GetEnvAsInt("RECORD_MAX_DISK_MB", 0)
+	GlobalConfig.ClipDir = GetEnvOrDefault("CLIP_DIR", "./clips")
+	GlobalConfig.ClipMaxSeconds = GetEnvAsInt("CLIP_MAX_SECONDS", 3600)
+	GlobalConfig.ClipRetentionHours = GetEnvAsInt("CLIP_RETENTION_HOURS", 24)
+	GlobalConfig.WebrtcIceServers = os.Getenv("WEBRTC_ICE_SERVERS")
+	GlobalConfig.WebrtcIceUsername = os.Getenv("WEBRTC_ICE_USERNAME")
+	GlobalConfig.WebrtcIceCredential = os.Getenv("WEBRTC_ICE_CREDENTIAL")
+	GlobalConfig.WebrtcPublicIPs = os.Getenv("WEBRTC_PUBLIC_IPS")
+	GlobalConfig.WebrtcUdpPortMin = GetEnvAsInt("WEBRTC_UDP_PORT_MIN", 0)
+	GlobalConfig.WebrtcUdpPortMax = GetEnvAsInt("WEBRTC_UDP_PORT_MAX", 0)
+	GlobalConfig.RtspServerPort = os.Getenv("RTSP_SERVER_PORT")
+	GlobalConfig.RtspServerUdpPort = GetEnvAsInt("RTSP_SERVER_UDP_PORT", 0)
+	GlobalConfig.RtmpServerPort = os.Getenv("RTMP_SERVER_PORT")
+	GlobalConfig.RtmpPublishKey = os.Getenv("RTMP_PUBLISH_KEY")
+	GlobalConfig.SourceFailoverAttempts = GetEnvAsInt("SOURCE_FAILOVER_ATTEMPTS", 3)
+	GlobalConfig.SourcePrimaryRetrySeconds = GetEnvAsInt("SOURCE_PRIMARY_RETRY_SECONDS", 60)
+	GlobalConfig.ReconnectInitialSeconds = GetEnvAsInt("RECONNECT_INITIAL_SECONDS", 2)
+	GlobalConfig.ReconnectMaxSeconds = GetEnvAsInt("RECONNECT_MAX_SECONDS", 60)
+	GlobalConfig.ReconnectMultiplier = GetEnvAsFloat("RECONNECT_MULTIPLIER", 2)
+	GlobalConfig.ReconnectJitter = GetEnvAsFloat("RECONNECT_JITTER", 0.2)
+	GlobalConfig.ReconnectMaxAttempts = GetEnvAsInt("RECONNECT_MAX_ATTEMPTS", 0)
 }
@@ -19,4 +19,20 @@ var (
 	ErrStreamExitNoVideoOnStream  = errors.New("stream exit no video on stream")
 	ErrStreamExitRtspDisconnect   = errors.New("stream exit rtsp disconnect")
 	ErrStreamExitNoViewer         = errors.New("stream exit on demand no viewer")
+	ErrStreamDVRDisabled          = errors.New("stream dvr not enabled")
+	ErrStreamFMP4Unsupported      = errors.New("stream codecs not supported by fmp4 output")
+	ErrRecordingNotFound          = errors.New("recording not found")
+	ErrInvalidTimeRange           = errors.New("invalid time range")
+	ErrClipNotFound               = errors.New("clip not found")
+	ErrClipCodecChanged           = errors.New("clip range spans a codec change")
+	ErrWebRTCNoTracks             = errors.New("webrtc no compatible tracks")
+	ErrWebRTCSessionNotFound      = errors.New("webrtc session not found")
+	ErrStreamPushSource           = errors.New("stream is fed by a publisher")
+	ErrStreamAlreadyPublishing    = errors.New("stream already has a publisher")
+	ErrPublishKeyInvalid          = errors.New("publish key invalid")
+	ErrSourceUnsupported          = errors.New("stream source not supported")
+	ErrStreamExitSourceEnded      = errors.New("stream exit source ended")
+	ErrStreamExitPrimaryRestored  = errors.New("stream exit primary source restored")
+	ErrRTSPNoTracks               = errors.New("rtsp no supported tracks")
+	ErrRTSPReadTimeout            = errors.New("rtsp read timeout")
 )
@@ -29,6 +29,16 @@ func GetEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// GetEnvAsFloat retrieves an environment variable as a floating point number
+func GetEnvAsFloat(key string, defaultValue float64) float64 {
+	if val, exists := GetEnv(key); exists && val != "" {
+		if floatVal, err := strconv.ParseFloat(val, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
 // GetEnvAsBool retrieves an environment variable as a boolean
 func GetEnvAsBool(key string, defaultValue bool) bool {
 	if val, exists := GetEnv(key); exists && val != "" {
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// BackoffPolicy spaces out reconnect attempts to an unreachable source
+type BackoffPolicy struct {
+	Initial     time.Duration
+	Max         time.Duration
+	Multiplier  float64
+	Jitter      float64
+	MaxAttempts int
+}
+
+// RetryState is a worker's progress through its reconnect attempts
+type RetryState struct {
+	Attempt     int       `json:"attempt"`
+	MaxAttempts int       `json:"max_attempts,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitzero"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// reconnectPolicy returns the configured backoff policy with defaults filled in
+func reconnectPolicy() BackoffPolicy {
+	policy := BackoffPolicy{
+		Initial:     time.Duration(configs.GlobalConfig.ReconnectInitialSeconds) * time.Second,
+		Max:         time.Duration(configs.GlobalConfig.ReconnectMaxSeconds) * time.Second,
+		Multiplier:  configs.GlobalConfig.ReconnectMultiplier,
+		Jitter:      configs.GlobalConfig.ReconnectJitter,
+		MaxAttempts: configs.GlobalConfig.ReconnectMaxAttempts,
+	}
+
+	if policy.Initial <= 0 {
+		policy.Initial = 2 * time.Second
+	}
+	if policy.Max < policy.Initial {
+		policy.Max = max(60*time.Second, policy.Initial)
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 2
+	}
+	policy.Jitter = min(max(policy.Jitter, 0), 1)
+
+	return policy
+}
+
+// delay returns how long to wait before an attempt, counting from 1, capped at the maximum and then spread by the jitter fraction
+func (p BackoffPolicy) delay(attempt int) time.Duration {
+	delay := float64(p.Initial) * math.Pow(p.Multiplier, float64(attempt-1))
+
+	// Large attempts overflow to +Inf, which has no duration, so cap before anything else
+	if !(delay < float64(p.Max)) {
+		delay = float64(p.Max)
+	}
+
+	// Jitter after the cap so capped retries still spread out instead of all landing on the maximum
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+
+	return time.Duration(min(delay, float64(p.Max)))
+}
+
+// exhausted reports whether a worker has used up its attempts; zero max attempts retries forever
+func (p BackoffPolicy) exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
+
+// setRetryState records a stream's reconnect progress for the API
+func (sm *StreamManager) setRetryState(id string, state RetryState) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if stream, exists := sm.Streams[id]; exists {
+		stream.Retry = state
+	}
+}
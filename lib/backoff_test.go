@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffPolicyDelay(t *testing.T) {
+	policy := BackoffPolicy{Initial: 2 * time.Second, Max: time.Minute, Multiplier: 2}
+
+	tests := []struct {
+		name    string
+		policy  BackoffPolicy
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"first attempt waits the initial delay", policy, 1, 2 * time.Second, 2 * time.Second},
+		{"second attempt doubles", policy, 2, 4 * time.Second, 4 * time.Second},
+		{"fifth attempt", policy, 5, 32 * time.Second, 32 * time.Second},
+		{"capped at the maximum", policy, 6, time.Minute, time.Minute},
+		{"stays capped for large attempts", policy, 1000, time.Minute, time.Minute},
+		{
+			name:    "constant with a multiplier of one",
+			policy:  BackoffPolicy{Initial: 5 * time.Second, Max: time.Minute, Multiplier: 1},
+			attempt: 10,
+			min:     5 * time.Second,
+			max:     5 * time.Second,
+		},
+		{
+			name:    "jitter spreads around the delay",
+			policy:  BackoffPolicy{Initial: 10 * time.Second, Max: time.Minute, Multiplier: 2, Jitter: 0.2},
+			attempt: 1,
+			min:     8 * time.Second,
+			max:     12 * time.Second,
+		},
+		{
+			name:    "jitter never exceeds the maximum",
+			policy:  BackoffPolicy{Initial: 10 * time.Second, Max: 20 * time.Second, Multiplier: 2, Jitter: 0.5},
+			attempt: 2,
+			min:     10 * time.Second,
+			max:     20 * time.Second,
+		},
+		{
+			name:    "jitter spreads capped attempts below the maximum",
+			policy:  BackoffPolicy{Initial: 2 * time.Second, Max: time.Minute, Multiplier: 2, Jitter: 0.2},
+			attempt: 1000,
+			min:     48 * time.Second,
+			max:     time.Minute,
+		},
+		{
+			name:    "overflowing attempt with jitter",
+			policy:  BackoffPolicy{Initial: 2 * time.Second, Max: time.Minute, Multiplier: 10, Jitter: 0.5},
+			attempt: 1_000_000,
+			min:     30 * time.Second,
+			max:     time.Minute,
+		},
+		{
+			name:    "overflowing attempt without jitter",
+			policy:  BackoffPolicy{Initial: 2 * time.Second, Max: time.Minute, Multiplier: 10},
+			attempt: 1_000_000,
+			min:     time.Minute,
+			max:     time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Jitter is random, so every draw must stay in range
+			spread := false
+			for i := 0; i < 100; i++ {
+				got := tt.policy.delay(tt.attempt)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("delay(%d) = %v, want between %v and %v", tt.attempt, got, tt.min, tt.max)
+				}
+				spread = spread || got < tt.max
+			}
+
+			// With jitter some draws must fall below the top of the range
+			if tt.policy.Jitter > 0 && !spread {
+				t.Fatalf("delay(%d) always returned %v, want jittered values", tt.attempt, tt.max)
+			}
+		})
+	}
+}
+
+func TestBackoffPolicyExhausted(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		attempt     int
+		want        bool
+	}{
+		{"unlimited", 0, 1000, false},
+		{"below the limit", 3, 2, false},
+		{"at the limit", 3, 3, true},
+		{"past the limit", 3, 4, true},
+		{"single attempt", 1, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := BackoffPolicy{MaxAttempts: tt.maxAttempts}
+			if got := policy.exhausted(tt.attempt); got != tt.want {
+				t.Fatalf("exhausted(%d) with %d max attempts = %v, want %v", tt.attempt, tt.maxAttempts, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package lib
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/deepch/vdk/format/ts"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// Clip export job states
+const (
+	ClipStatusPending = "pending"
+	ClipStatusRunning = "running"
+	ClipStatusDone    = "done"
+	ClipStatusFailed  = "failed"
+)
+
+// ClipJob tracks the export of a time range into a standalone MP4
+type ClipJob struct {
+	ID         string    `json:"id"`
+	StreamID   string    `json:"stream_id"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+	Path       string    `json:"-"`
+}
+
+// clipSource is a chunk of recorded or DVR-buffered media with its wall-clock start
+type clipSource struct {
+	start time.Time
+	read  func() ([]av.CodecData, []*av.Packet, error)
+}
+
+// clipJobs holds export jobs for all streams
+type clipJobs struct {
+	mutex sync.RWMutex
+	jobs  map[string]*ClipJob
+}
+
+// ExportClip starts a background job remuxing [from, to] of a stream into an MP4 file
+func (sm *StreamManager) ExportClip(id string, from, to time.Time) (ClipJob, error) {
+	if !to.After(from) {
+		return ClipJob{}, configs.ErrInvalidTimeRange
+	}
+
+	maxLength := time.Duration(configs.GlobalConfig.ClipMaxSeconds) * time.Second
+	if maxLength > 0 && to.Sub(from) > maxLength {
+		return ClipJob{}, configs.ErrInvalidTimeRange
+	}
+
+	sm.mutex.RLock()
+	var dvr *dvrStore
+	stream, exists := sm.Streams[id]
+	if exists {
+		dvr = stream.DVR
+	}
+	sm.mutex.RUnlock()
+
+	sources := clipSources(id, dvr, from, to)
+	if len(sources) == 0 {
+		return ClipJob{}, configs.ErrRecordingNotFound
+	}
+
+	sm.pruneClipJobs()
+
+	job := &ClipJob{
+		ID:        generateUUID(),
+		StreamID:  id,
+		From:      from,
+		To:        to,
+		Status:    ClipStatusPending,
+		CreatedAt: time.Now(),
+	}
+
+	sm.clips.mutex.Lock()
+	sm.clips.jobs[job.ID] = job
+	sm.clips.mutex.Unlock()
+
+	go sm.runClipJob(job, sources)
+
+	return *job, nil
+}
+
+// GetClipJob returns a snapshot of an export job
+func (sm *StreamManager) GetClipJob(jobID string) (ClipJob, error) {
+	sm.clips.mutex.RLock()
+	defer sm.clips.mutex.RUnlock()
+
+	job, exists := sm.clips.jobs[jobID]
+	if !exists {
+		return ClipJob{}, configs.ErrClipNotFound
+	}
+
+	return *job, nil
+}
+
+// setClipStatus updates a job under the jobs lock
+func (sm *StreamManager) setClipStatus(job *ClipJob, status string, err error) {
+	sm.clips.mutex.Lock()
+	defer sm.clips.mutex.Unlock()
+
+	job.Status = status
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if status == ClipStatusDone || status == ClipStatusFailed {
+		job.FinishedAt = time.Now()
+	}
+}
+
+// runClipJob performs the remux and records the outcome on the job
+func (sm *StreamManager) runClipJob(job *ClipJob, sources []clipSource) {
+	sm.setClipStatus(job, ClipStatusRunning, nil)
+
+	if err := os.MkdirAll(configs.GlobalConfig.ClipDir, 0755); err != nil {
+		sm.setClipStatus(job, ClipStatusFailed, err)
+		return
+	}
+
+	path := filepath.Join(configs.GlobalConfig.ClipDir, job.ID+".mp4")
+	if err := writeClip(path, sources, job.From, job.To); err != nil {
+		log.Printf("[%s] Clip export %s failed: %v", job.StreamID, job.ID, err)
+		os.Remove(path)
+		sm.setClipStatus(job, ClipStatusFailed, err)
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		sm.setClipStatus(job, ClipStatusFailed, err)
+		return
+	}
+
+	sm.clips.mutex.Lock()
+	job.Path = path
+	job.Size = info.Size()
+	sm.clips.mutex.Unlock()
+
+	sm.setClipStatus(job, ClipStatusDone, nil)
+}
+
+// pruneClipJobs forgets finished jobs past the retention period and deletes their files
+func (sm *StreamManager) pruneClipJobs() {
+	retention := time.Duration(configs.GlobalConfig.ClipRetentionHours) * time.Hour
+
+	sm.clips.mutex.Lock()
+	defer sm.clips.mutex.Unlock()
+
+	for id, job := range sm.clips.jobs {
+		if job.FinishedAt.IsZero() || time.Since(job.FinishedAt) < retention {
+			continue
+		}
+		if job.Path != "" {
+			os.Remove(job.Path)
+		}
+		delete(sm.clips.jobs, id)
+	}
+}
+
+// ClipRetention periodically deletes expired clip jobs, and clip files left behind by an earlier run
+type ClipRetention struct {
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// StartClipRetention launches the retention janitor for the clip directory
+func (sm *StreamManager) StartClipRetention() *ClipRetention {
+	retention := &ClipRetention{
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+
+	go retention.loop(sm)
+	return retention
+}
+
+// Stop ends the retention janitor
+func (r *ClipRetention) Stop() {
+	close(r.stopChan)
+	<-r.doneChan
+}
+
+// loop prunes once a minute until stopped
+func (r *ClipRetention) loop(sm *StreamManager) {
+	defer close(r.doneChan)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		sm.pruneClipJobs()
+		sm.pruneClipFiles()
+
+		select {
+		case <-r.stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneClipFiles deletes clip files past the retention period that no job knows about, such as those from before a restart
+func (sm *StreamManager) pruneClipFiles() {
+	retention := time.Duration(configs.GlobalConfig.ClipRetentionHours) * time.Hour
+
+	sm.clips.mutex.RLock()
+	known := make(map[string]bool, len(sm.clips.jobs))
+	for id := range sm.clips.jobs {
+		known[id+".mp4"] = true
+	}
+	sm.clips.mutex.RUnlock()
+
+	pruneClipDir(configs.GlobalConfig.ClipDir, retention, known)
+}
+
+// pruneClipDir deletes MP4 files in dir last written longer than retention ago, except the known ones
+func pruneClipDir(dir string, retention time.Duration, known map[string]bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".mp4") || known[entry.Name()] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) < retention {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if err := os.Remove(path); err != nil {
+			log.Printf("Error removing clip %s: %v", path, err)
+		}
+	}
+}
+
+// clipSources collects recordings overlapping the range, then DVR segments covering what recordings do not
+func clipSources(streamID string, dvr *dvrStore, from, to time.Time) []clipSource {
+	var sources []clipSource
+	var covered time.Time
+
+	for _, recording := range ListRecordings(streamID, from, to) {
+		recording := recording
+		sources = append(sources, clipSource{
+			start: recording.Start,
+			read: func() ([]av.CodecData, []*av.Packet, error) {
+				return readRecordingPackets(recording)
+			},
+		})
+		covered = recording.Start.Add(recording.Duration)
+	}
+
+	if dvr == nil {
+		return sources
+	}
+
+	for _, entry := range dvr.list() {
+		end := entry.Start.Add(entry.Duration)
+		if !end.After(from) || entry.Start.After(to) || !entry.Start.After(covered) {
+			continue
+		}
+
+		seq := entry.Seq
+		sources = append(sources, clipSource{
+			start: entry.Start,
+			read: func() ([]av.CodecData, []*av.Packet, error) {
+				data, err := dvr.get(seq)
+				if err != nil {
+					return nil, nil, err
+				}
+				return demuxTS(data)
+			},
+		})
+	}
+
+	return sources
+}
+
+// sameCodecs reports whether two track lists carry the same codecs with the same configuration
+func sameCodecs(a, b []av.CodecData) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Type() != b[i].Type() {
+			return false
+		}
+
+		switch codec := a[i].(type) {
+		case interface{ AVCDecoderConfRecordBytes() []byte }:
+			other, ok := b[i].(interface{ AVCDecoderConfRecordBytes() []byte })
+			if !ok || !bytes.Equal(codec.AVCDecoderConfRecordBytes(), other.AVCDecoderConfRecordBytes()) {
+				return false
+			}
+		case interface{ MPEG4AudioConfigBytes() []byte }:
+			other, ok := b[i].(interface{ MPEG4AudioConfigBytes() []byte })
+			if !ok || !bytes.Equal(codec.MPEG4AudioConfigBytes(), other.MPEG4AudioConfigBytes()) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// demuxTS reads all packets from in-memory MPEG-TS bytes
+func demuxTS(data []byte) ([]av.CodecData, []*av.Packet, error) {
+	return readAllPackets(ts.NewDemuxer(bytes.NewReader(data)))
+}
+
+// writeClip remuxes the sources into an MP4 file, starting at the first keyframe inside the range
+func writeClip(path string, sources []clipSource, from, to time.Time) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	muxer := mp4.NewMuxer(file)
+	muxer.NegativeTsMakeZero = true
+
+	var tracks []av.CodecData
+	var indexes map[int8]int8
+	var clipStart time.Time
+	var written int
+
+	for _, source := range sources {
+		codecs, packets, err := source.read()
+		if err != nil {
+			log.Printf("Skipping clip source at %s: %v", source.start.Format(time.RFC3339), err)
+			continue
+		}
+		if len(packets) == 0 {
+			continue
+		}
+
+		// The first usable source fixes the clip's track layout
+		if tracks == nil {
+			tracks, indexes = mp4Tracks(codecs)
+			if len(tracks) == 0 {
+				return configs.ErrStreamNoVideo
+			}
+			if err := muxer.WriteHeader(tracks); err != nil {
+				return err
+			}
+		} else if sourceTracks, _ := mp4Tracks(codecs); !sameCodecs(sourceTracks, tracks) {
+			// One MP4 has one set of sample descriptions, so new parameter sets mid-range would not decode
+			return configs.ErrClipCodecChanged
+		}
+
+		hasVideo := false
+		for _, codec := range tracks {
+			hasVideo = hasVideo || codec.Type().IsVideo()
+		}
+
+		firstTS := packets[0].Time
+		for _, packet := range packets {
+			at := source.start.Add(packet.Time - firstTS)
+			if at.Before(from) || at.After(to) {
+				continue
+			}
+
+			idx, ok := indexes[packet.Idx]
+			if !ok {
+				continue
+			}
+
+			// The clip must begin on a keyframe to be decodable
+			if clipStart.IsZero() {
+				if hasVideo && !packet.IsKeyFrame {
+					continue
+				}
+				clipStart = at
+			}
+
+			pkt := *packet
+			pkt.Idx = idx
+			pkt.Time = at.Sub(clipStart)
+			if err := muxer.WritePacket(pkt); err != nil {
+				return err
+			}
+			written++
+		}
+	}
+
+	if written == 0 {
+		return configs.ErrRecordingNotFound
+	}
+
+	return muxer.WriteTrailer()
+}
@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+func TestPruneClipDir(t *testing.T) {
+	// age is how long ago each file was last written
+	files := []struct {
+		name string
+		age  time.Duration
+	}{
+		{"old.mp4", 48 * time.Hour},
+		{"known.mp4", 48 * time.Hour},
+		{"fresh.mp4", time.Hour},
+		{"notes.txt", 48 * time.Hour},
+	}
+
+	tests := []struct {
+		name      string
+		retention time.Duration
+		known     map[string]bool
+		want      []string
+	}{
+		{
+			name:      "expired files no job knows are removed",
+			retention: 24 * time.Hour,
+			known:     map[string]bool{"known.mp4": true},
+			want:      []string{"fresh.mp4", "known.mp4", "notes.txt"},
+		},
+		{
+			name:      "after a restart no job is known",
+			retention: 24 * time.Hour,
+			want:      []string{"fresh.mp4", "notes.txt"},
+		},
+		{
+			name:      "nothing has expired yet",
+			retention: 72 * time.Hour,
+			want:      []string{"fresh.mp4", "known.mp4", "notes.txt", "old.mp4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			now := time.Now()
+			for _, f := range files {
+				path := filepath.Join(dir, f.name)
+				if err := os.WriteFile(path, []byte("clip"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				modTime := now.Add(-f.age)
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pruneClipDir(dir, tt.retention, tt.known)
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.Name())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("remaining = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A missing clip directory is not an error
+	pruneClipDir(filepath.Join(t.TempDir(), "missing"), time.Hour, nil)
+}
+
+func TestWriteClipCodecChange(t *testing.T) {
+	h264 := testH264(t)
+	aac := testAAC(t)
+
+	// Same SPS as testH264 with a different PPS, as after a camera reconfiguration
+	sps, _ := hex.DecodeString("6742c00dd90141fb0110000003001000000303c0f1429960")
+	pps, _ := hex.DecodeString("68ce3880")
+	reconfigured, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatalf("h264 codec: %v", err)
+	}
+
+	start := time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC)
+
+	// source returns a one second recording starting offset into the clip with a keyframe every packet
+	source := func(offset time.Duration, codecs ...av.CodecData) clipSource {
+		return clipSource{
+			start: start.Add(offset),
+			read: func() ([]av.CodecData, []*av.Packet, error) {
+				var packets []*av.Packet
+				for i := 0; i < 10; i++ {
+					packets = append(packets, &av.Packet{IsKeyFrame: true, Time: time.Duration(i) * 100 * time.Millisecond, Data: []byte{0, 0, 0, 1, 0x65}})
+				}
+				return codecs, packets, nil
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		sources []clipSource
+		want    error
+	}{
+		{"same codecs", []clipSource{source(0, h264), source(time.Second, h264)}, nil},
+		{"parameter sets change", []clipSource{source(0, h264), source(time.Second, reconfigured)}, configs.ErrClipCodecChanged},
+		{"track added", []clipSource{source(0, h264), source(time.Second, h264, aac)}, configs.ErrClipCodecChanged},
+		{"track dropped", []clipSource{source(0, h264, aac), source(time.Second, h264)}, configs.ErrClipCodecChanged},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "clip.mp4")
+			if err := writeClip(path, tt.sources, start, start.Add(2*time.Second)); !errors.Is(err, tt.want) {
+				t.Fatalf("writeClip() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
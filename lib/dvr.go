@@ -0,0 +1,305 @@
+package lib
+
+import (
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// dvrEntry is a segment retained for time-shifted playback
+type dvrEntry struct {
+	Seq           int
+	Duration      time.Duration
+	Start         time.Time
+	Size          int
+	Discontinuity bool
+	data          []byte
+	path          string
+}
+
+// dvrStore keeps a stream's recent segments, spilling the oldest ones to disk beyond the memory budget
+type dvrStore struct {
+	mutex            sync.RWMutex
+	dir              string
+	window           time.Duration
+	budget           int
+	memBytes         int
+	entries          []*dvrEntry
+	closed           bool
+	discontinuitySeq int
+
+	// gap makes the next added segment a discontinuity after the newest one was lost
+	gap bool
+}
+
+// newDVRStore creates a DVR store for a stream with the given retention window
+func newDVRStore(streamID string, window time.Duration) *dvrStore {
+	return &dvrStore{
+		dir:     filepath.Join(configs.GlobalConfig.DvrDir, safePathComponent(streamID)),
+		window:  window,
+		budget:  configs.GlobalConfig.DvrMemoryBudget * 1024 * 1024,
+		entries: []*dvrEntry{},
+	}
+}
+
+// add appends a segment, spilling old segments to disk and expiring those outside the window
+func (d *dvrStore) add(seq int, duration time.Duration, start time.Time, data []byte, discontinuity bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// The stream may have been removed while this segment was in flight
+	if d.closed {
+		return
+	}
+
+	d.entries = append(d.entries, &dvrEntry{
+		Seq:           seq,
+		Duration:      duration,
+		Start:         start,
+		Size:          len(data),
+		data:          data,
+		Discontinuity: discontinuity || d.gap,
+	})
+	d.memBytes += len(data)
+	d.gap = false
+
+	// Expire segments that ended before the window
+	cutoff := start.Add(duration).Add(-d.window)
+	expired := 0
+	for expired < len(d.entries)-1 && d.entries[expired].Start.Add(d.entries[expired].Duration).Before(cutoff) {
+		if d.entries[expired].Discontinuity {
+			d.discontinuitySeq++
+		}
+		d.drop(d.entries[expired])
+		expired++
+	}
+	d.entries = d.entries[expired:]
+
+	// Spill the oldest in-memory segments once over budget
+	for i := 0; i < len(d.entries) && d.memBytes > d.budget; {
+		entry := d.entries[i]
+		if entry.data == nil {
+			i++
+			continue
+		}
+		if err := d.spill(entry); err != nil {
+			log.Printf("DVR spill of segment %d to %s failed, dropping it: %v", entry.Seq, d.dir, err)
+			d.remove(i)
+			continue
+		}
+		d.memBytes -= len(entry.data)
+		entry.data = nil
+		i++
+	}
+}
+
+// remove drops the entry at index i, marking the gap it leaves as a discontinuity; caller must hold the write lock
+func (d *dvrStore) remove(i int) {
+	entry := d.entries[i]
+	d.drop(entry)
+
+	switch {
+	case i == 0:
+		// Losing the oldest segment is an early expiry
+		if entry.Discontinuity {
+			d.discontinuitySeq++
+		}
+	case i == len(d.entries)-1:
+		d.gap = true
+	default:
+		d.entries[i+1].Discontinuity = true
+	}
+
+	d.entries = append(d.entries[:i], d.entries[i+1:]...)
+}
+
+// spill writes an entry's bytes to disk; caller must hold the write lock
+func (d *dvrStore) spill(entry *dvrEntry) error {
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(d.dir, strconv.Itoa(entry.Seq)+".ts")
+	if err := os.WriteFile(path, entry.data, 0644); err != nil {
+		return err
+	}
+
+	entry.path = path
+	return nil
+}
+
+// drop releases an entry's memory or disk space; caller must hold the write lock
+func (d *dvrStore) drop(entry *dvrEntry) {
+	if entry.data != nil {
+		d.memBytes -= len(entry.data)
+		entry.data = nil
+	}
+	if entry.path != "" {
+		os.Remove(entry.path)
+		entry.path = ""
+	}
+}
+
+// get returns the MPEG-TS bytes of a retained segment
+func (d *dvrStore) get(seq int) ([]byte, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	for _, entry := range d.entries {
+		if entry.Seq != seq {
+			continue
+		}
+		if entry.data != nil {
+			return entry.data, nil
+		}
+		if entry.path != "" {
+			return os.ReadFile(entry.path)
+		}
+		break
+	}
+
+	return nil, configs.ErrStreamNotHLSSegments
+}
+
+// list returns the retained segments without their payloads
+func (d *dvrStore) list() []dvrEntry {
+	entries, _ := d.listWithDiscontinuities()
+	return entries
+}
+
+// listWithDiscontinuities returns the retained segments and the discontinuity sequence of the first one
+func (d *dvrStore) listWithDiscontinuities() ([]dvrEntry, int) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	result := make([]dvrEntry, 0, len(d.entries))
+	for _, entry := range d.entries {
+		result = append(result, dvrEntry{
+			Seq:           entry.Seq,
+			Duration:      entry.Duration,
+			Start:         entry.Start,
+			Size:          entry.Size,
+			Discontinuity: entry.Discontinuity,
+		})
+	}
+	return result, d.discontinuitySeq
+}
+
+// close releases all retained segments and removes the spill directory
+func (d *dvrStore) close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, entry := range d.entries {
+		d.drop(entry)
+	}
+	d.entries = nil
+	d.closed = true
+	os.RemoveAll(d.dir)
+}
+
+// dvrWindow returns the stream's DVR retention window, zero when DVR is disabled; caller must hold the mutex
+func dvrWindow(stream *StreamConfig) time.Duration {
+	seconds := stream.DVRWindow
+	if seconds <= 0 {
+		seconds = configs.GlobalConfig.DvrWindow
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// SetDVRWindow sets a stream's time-shift window in seconds, zero keeps the global setting
+func (sm *StreamManager) SetDVRWindow(id string, seconds int) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return configs.ErrStreamNotFound
+	}
+
+	stream.DVRWindow = seconds
+	if stream.DVR != nil {
+		stream.DVR.mutex.Lock()
+		stream.DVR.window = dvrWindow(stream)
+		stream.DVR.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// GetDVRPlaylist generates a long sliding playlist over the DVR window, optionally starting playback at a wall-clock time
+func (sm *StreamManager) GetDVRPlaylist(id string, session string, start time.Time) (string, int, error) {
+	sm.mutex.RLock()
+	stream, exists := sm.Streams[id]
+	if !exists {
+		sm.mutex.RUnlock()
+		return "", 0, configs.ErrStreamNotFound
+	}
+	dvr := stream.DVR
+	targetDuration := hlsPlaylistTargetDuration(stream)
+	sm.mutex.RUnlock()
+
+	if dvr == nil {
+		return "", 0, configs.ErrStreamDVRDisabled
+	}
+
+	entries, discontinuitySeq := dvr.listWithDiscontinuities()
+	for _, entry := range entries {
+		if seconds := int(math.Ceil(entry.Duration.Seconds())); seconds > targetDuration {
+			targetDuration = seconds
+		}
+	}
+
+	var playlist string
+	playlist += "#EXTM3U\r\n"
+	playlist += "#EXT-X-TARGETDURATION:" + strconv.Itoa(targetDuration) + "\r\n"
+	playlist += "#EXT-X-VERSION:4\r\n"
+	if len(entries) > 0 {
+		playlist += "#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(entries[0].Seq) + "\r\n"
+	}
+	if discontinuitySeq > 0 {
+		playlist += "#EXT-X-DISCONTINUITY-SEQUENCE:" + strconv.Itoa(discontinuitySeq) + "\r\n"
+	}
+
+	// Tell the player where to begin when a start time inside the window was requested
+	if !start.IsZero() && len(entries) > 0 {
+		var offset time.Duration
+		for _, entry := range entries {
+			if !entry.Start.Add(entry.Duration).After(start) {
+				offset += entry.Duration
+				continue
+			}
+			if start.After(entry.Start) {
+				offset += start.Sub(entry.Start)
+			}
+			break
+		}
+		playlist += "#EXT-X-START:TIME-OFFSET=" + strconv.FormatFloat(offset.Seconds(), 'f', 3, 64) + ",PRECISE=YES\r\n"
+	}
+
+	for _, entry := range entries {
+		duration := strconv.FormatFloat(entry.Duration.Seconds(), 'f', 1, 64)
+		if entry.Discontinuity {
+			playlist += "#EXT-X-DISCONTINUITY\r\n"
+		}
+		playlist += "#EXT-X-PROGRAM-DATE-TIME:" + entry.Start.UTC().Format("2006-01-02T15:04:05.000Z") + "\r\n"
+		playlist += "#EXTINF:" + duration + ",\r\n"
+		playlist += "segment/" + strconv.Itoa(entry.Seq) + "/file.ts" + sessionQuery(session) + "\r\n"
+	}
+
+	return playlist, len(entries), nil
+}
+
+// ParseTimestamp accepts RFC 3339 timestamps or Unix seconds
+func ParseTimestamp(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDVRStoreSpillFailure(t *testing.T) {
+	tests := []struct {
+		name          string
+		budget        int
+		spilled       []int
+		sizes         []int
+		wantSeqs      []int
+		wantDisc      []bool
+		wantDiscSeq   int
+		wantMemBytes  int
+		wantNextIsGap bool
+	}{
+		{
+			name:         "oldest segment expires early",
+			budget:       20,
+			sizes:        []int{8, 8, 8},
+			wantSeqs:     []int{2, 3},
+			wantDisc:     []bool{false, false},
+			wantMemBytes: 16,
+		},
+		{
+			name:         "middle segment marks the next one",
+			budget:       20,
+			spilled:      []int{1},
+			sizes:        []int{8, 8, 8},
+			wantSeqs:     []int{1, 3, 4},
+			wantDisc:     []bool{false, true, false},
+			wantMemBytes: 16,
+		},
+		{
+			name:          "newest segment marks the next add",
+			budget:        8,
+			spilled:       []int{1},
+			sizes:         []int{16},
+			wantSeqs:      []int{1},
+			wantDisc:      []bool{false},
+			wantNextIsGap: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A regular file where the spill directory should be makes every spill fail
+			blocker := filepath.Join(t.TempDir(), "blocker")
+			if err := os.WriteFile(blocker, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			d := &dvrStore{
+				dir:    filepath.Join(blocker, "dvr"),
+				window: time.Hour,
+				budget: tt.budget,
+			}
+			start := time.Now()
+			for _, seq := range tt.spilled {
+				d.entries = append(d.entries, &dvrEntry{Seq: seq, Duration: time.Second, Start: start.Add(time.Duration(seq) * time.Second)})
+			}
+
+			seq := len(tt.spilled) + 1
+			for _, size := range tt.sizes {
+				d.add(seq, time.Second, start.Add(time.Duration(seq)*time.Second), make([]byte, size), false)
+				seq++
+			}
+
+			var seqs []int
+			var disc []bool
+			for _, entry := range d.list() {
+				seqs = append(seqs, entry.Seq)
+				disc = append(disc, entry.Discontinuity)
+			}
+			if !slices.Equal(seqs, tt.wantSeqs) {
+				t.Fatalf("segments = %v, want %v", seqs, tt.wantSeqs)
+			}
+			if !slices.Equal(disc, tt.wantDisc) {
+				t.Fatalf("discontinuities = %v, want %v", disc, tt.wantDisc)
+			}
+			if d.discontinuitySeq != tt.wantDiscSeq {
+				t.Fatalf("discontinuity sequence = %d, want %d", d.discontinuitySeq, tt.wantDiscSeq)
+			}
+			if d.memBytes != tt.wantMemBytes {
+				t.Fatalf("memory = %d bytes, want %d", d.memBytes, tt.wantMemBytes)
+			}
+
+			d.add(seq, time.Second, start.Add(time.Duration(seq)*time.Second), nil, false)
+			entries := d.list()
+			if got := entries[len(entries)-1].Discontinuity; got != tt.wantNextIsGap {
+				t.Fatalf("next segment discontinuity = %v, want %v", got, tt.wantNextIsGap)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// Stream lifecycle event types
+const (
+	EventStreamAdded        = "stream_added"
+	EventStreamRemoved      = "stream_removed"
+	EventStreamConnected    = "stream_connected"
+	EventStreamDisconnected = "stream_disconnected"
+	EventCodecUpdate        = "codec_update"
+	EventViewerJoined       = "viewer_joined"
+	EventViewerLeft         = "viewer_left"
+	EventRecordingStarted   = "recording_started"
+	EventRecordingStopped   = "recording_stopped"
+)
+
+// Event feed limits
+const (
+	eventBufferSize    = 64
+	eventKeepaliveTime = 15 * time.Second
+)
+
+// Event is one stream lifecycle change published on the event bus
+type Event struct {
+	Type     string    `json:"type"`
+	StreamID string    `json:"stream_id"`
+	Time     time.Time `json:"time"`
+	URL      string    `json:"url,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Codecs   []string  `json:"codecs,omitempty"`
+	Viewer   string    `json:"viewer,omitempty"`
+	ViewerID string    `json:"viewer_id,omitempty"`
+}
+
+// eventBus fans events out to subscribers; a subscriber that falls behind loses events rather than stalling publishers
+type eventBus struct {
+	mutex       sync.Mutex
+	subscribers map[chan Event]struct{}
+	closed      bool
+}
+
+// subscribe registers a new subscriber whose channel is closed when the bus shuts down; the returned function unregisters it
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		if _, subscribed := b.subscribers[ch]; subscribed {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// CloseEvents ends every event feed so long-lived event requests let the HTTP server shut down
+func (sm *StreamManager) CloseEvents() {
+	sm.events.mutex.Lock()
+	defer sm.events.mutex.Unlock()
+
+	sm.events.closed = true
+	for ch := range sm.events.subscribers {
+		delete(sm.events.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish hands an event to every subscriber without blocking; safe to call with the manager lock held
+func (b *eventBus) publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("[%s] Dropping %s event for a slow subscriber", event.StreamID, event.Type)
+		}
+	}
+}
+
+// codecNames lists codec types for a codec update event
+func codecNames(codecs []av.CodecData) []string {
+	names := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		names = append(names, codec.Type().String())
+	}
+	return names
+}
+
+// errorString returns an error's message, or empty for nil
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// StreamEvents streams lifecycle events as Server-Sent Events; ?stream= limits the feed to one stream
+func StreamEvents(c *gin.Context, streamManager *StreamManager) {
+	filter := c.Query("stream")
+
+	events, unsubscribe := streamManager.events.subscribe()
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveTime)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if filter != "" && event.StreamID != filter {
+				continue
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// StreamEventsWS streams lifecycle events as JSON WebSocket messages; ?stream= limits the feed to one stream
+func StreamEventsWS(c *gin.Context, streamManager *StreamManager) {
+	filter := c.Query("stream")
+
+	// websocket.Server skips the Origin check; CORS is handled by the router
+	server := websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			serveEventsWS(ws, streamManager, filter)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// serveEventsWS writes events until the client disconnects; incoming messages are ignored
+func serveEventsWS(ws *websocket.Conn, streamManager *StreamManager, filter string) {
+	defer ws.Close()
+
+	events, unsubscribe := streamManager.events.subscribe()
+	defer unsubscribe()
+
+	// The reader only notices the client going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if filter != "" && event.StreamID != filter {
+				continue
+			}
+
+			ws.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+			if err := websocket.JSON.Send(ws, event); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// connect opens the source at a position in the URL list
+func (w *RTSPWorker) connect(index int) (Source, error) {
+	log.Printf("[%s] Stream connecting to %s", w.streamID, w.urls[index])
+
+	source, err := newSource(w.urls[index], w.rtspOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := source.Open(); err != nil {
+		source.Close()
+		return nil, err
+	}
+	return source, nil
+}
+
+// failover moves to the next URL after a keyframe timeout or repeated connection errors
+func (w *RTSPWorker) failover(err error) {
+	if len(w.urls) < 2 || w.pending != nil {
+		return
+	}
+
+	// Stopping and idling on-demand streams are not source failures
+	if err == nil || errors.Is(err, configs.ErrStreamExitNoViewer) {
+		return
+	}
+
+	// A session that went live clears the errors that came before it
+	if w.live {
+		w.failures = 0
+		w.live = false
+	}
+	w.failures++
+
+	if !errors.Is(err, configs.ErrStreamExitNoVideoOnStream) && w.failures < sourceFailoverAttempts() {
+		return
+	}
+
+	w.index = (w.index + 1) % len(w.urls)
+	w.failures = 0
+	log.Printf("[%s] Failing over to source %d of %d: %s", w.streamID, w.index+1, len(w.urls), w.urls[w.index])
+}
+
+// sourceFailoverAttempts returns how many consecutive errors move a stream to its next source
+func sourceFailoverAttempts() int {
+	if attempts := configs.GlobalConfig.SourceFailoverAttempts; attempts > 0 {
+		return attempts
+	}
+	return 3
+}
+
+// sourcePrimaryRetry returns how often a stream running on a backup probes its primary
+func sourcePrimaryRetry() time.Duration {
+	if seconds := configs.GlobalConfig.SourcePrimaryRetrySeconds; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 60 * time.Second
+}
+
+// SetBackupURLs sets the sources a stream fails over to, in order; a running worker picks them up on its next start
+func (sm *StreamManager) SetBackupURLs(id string, urls []string) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return configs.ErrStreamNotFound
+	}
+
+	stream.BackupURLs = urls
+	return nil
+}
+
+// setActiveURL records which of a stream's sources its worker is pulling from
+func (sm *StreamManager) setActiveURL(id string, url string) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if stream, exists := sm.Streams[id]; exists {
+		stream.ActiveURL = url
+	}
+}
+
+// sourceURLs returns a stream's primary URL followed by its backups
+func (stream *StreamConfig) sourceURLs() []string {
+	urls := make([]string, 0, 1+len(stream.BackupURLs))
+	urls = append(urls, stream.URL)
+	return append(urls, stream.BackupURLs...)
+}
@@ -0,0 +1,274 @@
+package lib
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/fmp4"
+	"github.com/deepch/vdk/format/fmp4/fragment"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// fmp4Tracks selects the codecs the fMP4 fragmenter supports and maps source packet indexes onto them
+func fmp4Tracks(codecs []av.CodecData) ([]av.CodecData, map[int8]int8) {
+	tracks := make([]av.CodecData, 0, len(codecs))
+	indexes := make(map[int8]int8)
+
+	for i, codec := range codecs {
+		switch codec.Type() {
+		case av.H264, av.AAC, av.OPUS:
+			indexes[int8(i)] = int8(len(tracks))
+			tracks = append(tracks, codec)
+		}
+	}
+
+	return tracks, indexes
+}
+
+// mp4Tracks selects the codecs the MP4 muxer supports (H.264/H.265/AAC) and maps source packet indexes onto them
+func mp4Tracks(codecs []av.CodecData) ([]av.CodecData, map[int8]int8) {
+	tracks := make([]av.CodecData, 0, len(codecs))
+	indexes := make(map[int8]int8)
+
+	for i, codec := range codecs {
+		switch codec.Type() {
+		case av.H264, av.H265, av.AAC:
+			indexes[int8(i)] = int8(len(tracks))
+			tracks = append(tracks, codec)
+		}
+	}
+
+	return tracks, indexes
+}
+
+// fmp4Fragmenter is the part of the vdk movie and track fragmenters the muxer uses
+type fmp4Fragmenter interface {
+	WritePacket(pkt av.Packet) error
+	Fragment() (fragment.Fragment, error)
+	MovieHeader() (filename, contentType string, blob []byte)
+}
+
+// fmp4Supported reports whether the fMP4 outputs can carry a stream's codecs.
+// The fragmenter has no hvc1 sample entry, and needs an H.264 track unless the stream is a single audio track.
+func fmp4Supported(codecs []av.CodecData) error {
+	tracks, _ := fmp4Tracks(codecs)
+
+	video := false
+	for _, codec := range codecs {
+		switch codec.Type() {
+		case av.H265:
+			return configs.ErrStreamFMP4Unsupported
+		case av.H264:
+			video = true
+		}
+	}
+
+	if len(tracks) == 0 || (!video && len(tracks) > 1) {
+		return configs.ErrStreamFMP4Unsupported
+	}
+	return nil
+}
+
+// newFMP4Fragmenter builds a fragmenter for a stream's codecs and maps source packet indexes onto its tracks
+func newFMP4Fragmenter(codecs []av.CodecData) (fmp4Fragmenter, []av.CodecData, map[int8]int8, error) {
+	if err := fmp4Supported(codecs); err != nil {
+		return nil, nil, nil, err
+	}
+
+	tracks, indexes := fmp4Tracks(codecs)
+
+	// Audio-only streams are a single CMAF track; the movie fragmenter insists on video
+	if len(tracks) == 1 && tracks[0].Type().IsAudio() {
+		track, err := fmp4.NewTrack(tracks[0])
+		return track, tracks, indexes, err
+	}
+
+	movie, err := fmp4.NewMovie(tracks)
+	return movie, tracks, indexes, err
+}
+
+// muxFMP4Init builds the init.mp4 (ftyp+moov) for a stream's codecs
+func muxFMP4Init(codecs []av.CodecData) ([]byte, error) {
+	fragmenter, _, _, err := newFMP4Fragmenter(codecs)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, init := fragmenter.MovieHeader()
+	return init, nil
+}
+
+// muxFMP4Segment renders a segment's packets as a single styp+moof+mdat fragment numbered seq in its mfhd box
+func muxFMP4Segment(codecs []av.CodecData, packets []*av.Packet, duration time.Duration, seq uint32) ([]byte, error) {
+	if len(packets) == 0 {
+		return nil, configs.ErrStreamNotHLSSegments
+	}
+
+	fragmenter, tracks, indexes, err := newFMP4Fragmenter(codecs)
+	if err != nil {
+		return nil, err
+	}
+
+	return writeFMP4Fragment(fragmenter, len(tracks), indexes, packets, packets[0].Time+duration, seq)
+}
+
+// muxFMP4TrackSegment renders the packets of one source track as a single-track CMAF fragment
+func muxFMP4TrackSegment(codec av.CodecData, idx int8, packets []*av.Packet, duration time.Duration, seq uint32) ([]byte, error) {
+	if len(packets) == 0 {
+		return nil, configs.ErrStreamNotHLSSegments
+	}
+
+	track, err := fmp4.NewTrack(codec)
+	if err != nil {
+		return nil, err
+	}
+
+	return writeFMP4Fragment(track, 1, map[int8]int8{idx: 0}, packets, packets[0].Time+duration, seq)
+}
+
+// writeFMP4Fragment feeds packets mapped by indexes to a fragmenter and cuts one fragment ending at end
+func writeFMP4Fragment(fragmenter fmp4Fragmenter, tracks int, indexes map[int8]int8, packets []*av.Packet, end time.Duration, seq uint32) ([]byte, error) {
+	// Track the last timestamp per track so the closing sample never runs backwards
+	lastTimes := make([]time.Duration, tracks)
+
+	for _, packet := range packets {
+		idx, ok := indexes[packet.Idx]
+		if !ok {
+			continue
+		}
+
+		pkt := *packet
+		pkt.Idx = idx
+		if err := fragmenter.WritePacket(pkt); err != nil {
+			return nil, err
+		}
+		lastTimes[idx] = pkt.Time
+	}
+
+	// The fragmenter holds back the last packet of each track until it sees the next one,
+	// so close every track with an empty packet at the segment boundary
+	for i := range lastTimes {
+		closeTime := end
+		if lastTimes[i] > closeTime {
+			closeTime = lastTimes[i]
+		}
+		if err := fragmenter.WritePacket(av.Packet{Idx: int8(i), Time: closeTime}); err != nil {
+			return nil, err
+		}
+	}
+
+	frag, err := fragmenter.Fragment()
+	if err != nil {
+		return nil, err
+	}
+	if len(frag.Bytes) == 0 {
+		// None of the tracks had a packet in this segment
+		return nil, configs.ErrStreamNotHLSSegments
+	}
+
+	setFragmentSequence(frag.Bytes, seq)
+	return frag.Bytes, nil
+}
+
+// setFragmentSequence overwrites the sequence_number of the mfhd box inside a fragment's moof.
+// Every segment gets a fresh fragmenter, which would otherwise number them all 1.
+func setFragmentSequence(data []byte, seq uint32) {
+	for offset := 0; offset+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		if size < 8 || offset+size > len(data) {
+			return
+		}
+
+		if string(data[offset+4:offset+8]) == "moof" {
+			// mfhd is a full box: size, type, version and flags, then the sequence number
+			mfhd := data[offset+8 : offset+size]
+			if len(mfhd) >= 16 && string(mfhd[4:8]) == "mfhd" {
+				binary.BigEndian.PutUint32(mfhd[12:], seq)
+			}
+			return
+		}
+
+		offset += size
+	}
+}
+
+// GetFMP4Init returns the cached init.mp4 for a stream, building it on first use
+func (sm *StreamManager) GetFMP4Init(id string) ([]byte, error) {
+	codecs, err := sm.GetCodecs(id)
+	if err != nil {
+		return nil, err
+	}
+
+	sm.mutex.RLock()
+	stream, exists := sm.Streams[id]
+	if !exists {
+		sm.mutex.RUnlock()
+		return nil, configs.ErrStreamNotFound
+	}
+	init := stream.FMP4Init
+	sm.mutex.RUnlock()
+
+	if init != nil {
+		return init, nil
+	}
+
+	init, err = muxFMP4Init(codecs)
+	if err != nil {
+		return nil, err
+	}
+
+	sm.mutex.Lock()
+	if stream, exists := sm.Streams[id]; exists {
+		stream.FMP4Init = init
+	}
+	sm.mutex.Unlock()
+
+	return init, nil
+}
+
+// GetHLSSegmentFMP4 returns the fMP4 bytes and ETag of a segment, rendering them on first request
+func (sm *StreamManager) GetHLSSegmentFMP4(id string, seq int) ([]byte, string, error) {
+	sm.mutex.RLock()
+	stream, exists := sm.Streams[id]
+	if !exists {
+		sm.mutex.RUnlock()
+		return nil, "", configs.ErrStreamNotFound
+	}
+
+	segment, exists := stream.HLSSegmentBuffer[seq]
+	if !exists {
+		sm.mutex.RUnlock()
+		return nil, "", configs.ErrStreamNotHLSSegments
+	}
+
+	if segment.FMP4 != nil {
+		sm.mutex.RUnlock()
+		return segment.FMP4, segment.FMP4ETag, nil
+	}
+
+	codecs := stream.Codecs
+	packets := segment.Data
+	duration := segment.Duration
+	parts := segment.Parts
+	sm.mutex.RUnlock()
+
+	// With LL-HLS the parent segment is the concatenation of its parts
+	data := concatFMP4Parts(parts)
+	if data == nil {
+		var err error
+		data, err = muxFMP4Segment(codecs, packets, duration, uint32(seq))
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	etag := segmentETag(data)
+
+	sm.mutex.Lock()
+	segment.FMP4 = data
+	segment.FMP4ETag = etag
+	sm.mutex.Unlock()
+
+	return data, etag, nil
+}
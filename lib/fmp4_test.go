@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// typeOnlyCodec stands in for codecs whose parameter sets the test does not need
+type typeOnlyCodec av.CodecType
+
+func (c typeOnlyCodec) Type() av.CodecType { return av.CodecType(c) }
+
+// testH264 returns the codec data of a 320x240 Baseline stream
+func testH264(t *testing.T) h264parser.CodecData {
+	t.Helper()
+
+	sps, _ := hex.DecodeString("6742c00dd90141fb0110000003001000000303c0f1429960")
+	pps, _ := hex.DecodeString("68ce3c80")
+	codec, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		t.Fatalf("h264 codec: %v", err)
+	}
+	return codec
+}
+
+// testAAC returns the codec data of a 44.1 kHz stereo AAC-LC stream
+func testAAC(t *testing.T) aacparser.CodecData {
+	t.Helper()
+
+	codec, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes([]byte{0x12, 0x10})
+	if err != nil {
+		t.Fatalf("aac codec: %v", err)
+	}
+	return codec
+}
+
+func TestFMP4Supported(t *testing.T) {
+	h264 := testH264(t)
+	aac := testAAC(t)
+	opus := codec.NewOpusCodecData(48000, av.CH_STEREO)
+
+	tests := []struct {
+		name   string
+		codecs []av.CodecData
+		ok     bool
+	}{
+		{"h264 and aac", []av.CodecData{h264, aac}, true},
+		{"h264 only", []av.CodecData{h264}, true},
+		{"aac only", []av.CodecData{aac}, true},
+		{"opus only", []av.CodecData{opus}, true},
+		{"h265", []av.CodecData{typeOnlyCodec(av.H265)}, false},
+		{"h265 and aac", []av.CodecData{typeOnlyCodec(av.H265), aac}, false},
+		{"two audio tracks", []av.CodecData{aac, opus}, false},
+		{"no supported tracks", []av.CodecData{typeOnlyCodec(av.PCM_ALAW)}, false},
+		{"no codecs", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fmp4Supported(tt.codecs)
+			if tt.ok && err != nil {
+				t.Fatalf("fmp4Supported() = %v, want nil", err)
+			}
+			if !tt.ok && !errors.Is(err, configs.ErrStreamFMP4Unsupported) {
+				t.Fatalf("fmp4Supported() = %v, want ErrStreamFMP4Unsupported", err)
+			}
+		})
+	}
+}
+
+// fragmentSequence finds the mfhd sequence number in a muxed fragment
+func fragmentSequence(t *testing.T, data []byte) uint32 {
+	t.Helper()
+
+	i := bytes.Index(data, []byte("mfhd"))
+	if i < 4 || i+12 > len(data) {
+		t.Fatalf("fragment has no mfhd box")
+	}
+	return binary.BigEndian.Uint32(data[i+8:])
+}
+
+func TestMuxFMP4Segment(t *testing.T) {
+	h264 := testH264(t)
+	aac := testAAC(t)
+
+	// A keyframe access unit is enough for the fragmenter; it does not decode the slice
+	keyframe := []byte{0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00}
+	audio := []byte{0x21, 0x10, 0x04, 0x60, 0x8c, 0x1c}
+
+	tests := []struct {
+		name    string
+		codecs  []av.CodecData
+		packets []*av.Packet
+		seq     uint32
+	}{
+		{
+			name:   "audio and video",
+			codecs: []av.CodecData{h264, aac},
+			packets: []*av.Packet{
+				{Idx: 0, IsKeyFrame: true, Time: 0, Data: keyframe},
+				{Idx: 1, Time: 0, Data: audio},
+				{Idx: 0, Time: 40 * time.Millisecond, Data: keyframe},
+				{Idx: 1, Time: 23 * time.Millisecond, Data: audio},
+			},
+			seq: 42,
+		},
+		{
+			name:   "audio only",
+			codecs: []av.CodecData{aac},
+			packets: []*av.Packet{
+				{Idx: 0, Time: 0, Data: audio},
+				{Idx: 0, Time: 23 * time.Millisecond, Data: audio},
+			},
+			seq: 7,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := muxFMP4Init(tt.codecs); err != nil {
+				t.Fatalf("muxFMP4Init() = %v", err)
+			}
+
+			data, err := muxFMP4Segment(tt.codecs, tt.packets, 80*time.Millisecond, tt.seq)
+			if err != nil {
+				t.Fatalf("muxFMP4Segment() = %v", err)
+			}
+			if got := fragmentSequence(t, data); got != tt.seq {
+				t.Fatalf("mfhd sequence = %d, want %d", got, tt.seq)
+			}
+		})
+	}
+}
+
+func TestMuxFMP4SegmentUnsupported(t *testing.T) {
+	codecs := []av.CodecData{typeOnlyCodec(av.H265), testAAC(t)}
+	packets := []*av.Packet{{Idx: 1, Data: []byte{0x21}}}
+
+	if _, err := muxFMP4Init(codecs); !errors.Is(err, configs.ErrStreamFMP4Unsupported) {
+		t.Fatalf("muxFMP4Init() = %v, want ErrStreamFMP4Unsupported", err)
+	}
+	if _, err := muxFMP4Segment(codecs, packets, time.Second, 1); !errors.Is(err, configs.ErrStreamFMP4Unsupported) {
+		t.Fatalf("muxFMP4Segment() = %v, want ErrStreamFMP4Unsupported", err)
+	}
+}
@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"time"
+
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// hlsSessionTimeout returns the idle window after which an HLS viewer is dropped
+func hlsSessionTimeout() time.Duration {
+	timeout := configs.GlobalConfig.HlsSessionTimeout
+	if timeout <= 0 {
+		timeout = 30
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// TouchHLSSession refreshes an HLS viewer session, issuing a new token if the given one is unknown.
+// A request without a known token reuses the live session of the same client, since cross-origin players
+// reload the playlist without the session cookie; viewers sharing an address and User-Agent count as one.
+func (sm *StreamManager) TouchHLSSession(id string, token string, client string) (string, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return "", configs.ErrStreamNotFound
+	}
+
+	now := time.Now()
+	sm.pruneHLSSessions(id, stream, now)
+
+	if _, known := stream.HLSSessions[token]; token == "" || !known {
+		token = stream.HLSSessionClients[client]
+		if _, known := stream.HLSSessions[token]; client == "" || !known {
+			token = generateUUID()
+			sm.events.publish(Event{Type: EventViewerJoined, StreamID: id, Viewer: ViewerHLS})
+		}
+	}
+	stream.HLSSessions[token] = now
+	if client != "" {
+		stream.HLSSessionClients[client] = token
+	}
+
+	return token, nil
+}
+
+// RefreshHLSSession refreshes an existing HLS viewer session without issuing a new one
+func (sm *StreamManager) RefreshHLSSession(id string, token string) bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists || token == "" {
+		return false
+	}
+
+	now := time.Now()
+	sm.pruneHLSSessions(id, stream, now)
+
+	if _, known := stream.HLSSessions[token]; !known {
+		return false
+	}
+	stream.HLSSessions[token] = now
+
+	return true
+}
+
+// HLSSessionCount returns the number of HLS viewers seen within the idle window
+func (sm *StreamManager) HLSSessionCount(id string) int {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return 0
+	}
+
+	return activeHLSSessions(stream, time.Now())
+}
+
+// activeHLSSessions counts unexpired sessions; caller must hold the mutex
+func activeHLSSessions(stream *StreamConfig, now time.Time) int {
+	timeout := hlsSessionTimeout()
+
+	count := 0
+	for _, lastSeen := range stream.HLSSessions {
+		if now.Sub(lastSeen) < timeout {
+			count++
+		}
+	}
+	return count
+}
+
+// pruneHLSSessions drops expired sessions, reporting each as a viewer leaving; caller must hold the write lock
+func (sm *StreamManager) pruneHLSSessions(id string, stream *StreamConfig, now time.Time) {
+	timeout := hlsSessionTimeout()
+
+	for token, lastSeen := range stream.HLSSessions {
+		if now.Sub(lastSeen) >= timeout {
+			delete(stream.HLSSessions, token)
+			sm.events.publish(Event{Type: EventViewerLeft, StreamID: id, Viewer: ViewerHLS})
+		}
+	}
+	for client, token := range stream.HLSSessionClients {
+		if _, known := stream.HLSSessions[token]; !known {
+			delete(stream.HLSSessionClients, client)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTouchHLSSession(t *testing.T) {
+	const id = "cam1"
+	const player = "203.0.113.7 hls.js"
+
+	// request is one playlist request; ref names the token to send, taken from an earlier step
+	type request struct {
+		ref    int
+		client string
+		same   int
+	}
+
+	tests := []struct {
+		name     string
+		requests []request
+		// expire ages every session past the idle window before the last request
+		expire   bool
+		sessions int
+	}{
+		{
+			name:     "token in the request keeps the session",
+			requests: []request{{ref: -1, client: player}, {ref: 0, client: player, same: 0}},
+			sessions: 1,
+		},
+		{
+			name:     "reload without a token reuses the client's session",
+			requests: []request{{ref: -1, client: player}, {ref: -1, client: player, same: 0}, {ref: -1, client: player, same: 0}},
+			sessions: 1,
+		},
+		{
+			name:     "other clients get their own session",
+			requests: []request{{ref: -1, client: player}, {ref: -1, client: "198.51.100.2 Safari", same: -1}},
+			sessions: 2,
+		},
+		{
+			name:     "unknown client without a token gets a new session each time",
+			requests: []request{{ref: -1}, {ref: -1, same: -1}},
+			sessions: 2,
+		},
+		{
+			name:     "expired session is not reused",
+			requests: []request{{ref: -1, client: player}, {ref: -1, client: player, same: -1}},
+			expire:   true,
+			sessions: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := NewStreamManager()
+			sm.AddStream(id, "rtsp://camera/stream", true)
+
+			var tokens []string
+			for i, req := range tt.requests {
+				if tt.expire && i == len(tt.requests)-1 {
+					sm.mutex.Lock()
+					for token := range sm.Streams[id].HLSSessions {
+						sm.Streams[id].HLSSessions[token] = time.Now().Add(-2 * hlsSessionTimeout())
+					}
+					sm.mutex.Unlock()
+				}
+
+				token := ""
+				if req.ref >= 0 {
+					token = tokens[req.ref]
+				}
+				got, err := sm.TouchHLSSession(id, token, req.client)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if i > 0 {
+					if req.same >= 0 && got != tokens[req.same] {
+						t.Fatalf("request %d got a new session, want the one from request %d", i, req.same)
+					}
+					if req.same < 0 && got == tokens[i-1] {
+						t.Fatalf("request %d reused the session of request %d", i, i-1)
+					}
+				}
+				tokens = append(tokens, got)
+			}
+
+			if count := sm.HLSSessionCount(id); count != tt.sessions {
+				t.Fatalf("HLSSessionCount() = %d, want %d", count, tt.sessions)
+			}
+		})
+	}
+
+	sm := NewStreamManager()
+	if _, err := sm.TouchHLSSession("missing", "", player); err == nil {
+		t.Fatal("TouchHLSSession() on an unknown stream succeeded")
+	}
+}
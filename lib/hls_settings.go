@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"math"
+	"time"
+
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// hlsWindowSize returns the number of segments kept in a stream's live playlist; caller must hold the mutex
+func hlsWindowSize(stream *StreamConfig) int {
+	if stream.HLSWindowSize > 0 {
+		return stream.HLSWindowSize
+	}
+	if configs.GlobalConfig.HlsWindowSize > 0 {
+		return configs.GlobalConfig.HlsWindowSize
+	}
+	return 6
+}
+
+// hlsTargetDuration returns the configured segment target duration; caller must hold the mutex
+func hlsTargetDuration(stream *StreamConfig) time.Duration {
+	seconds := stream.HLSTargetDuration
+	if seconds <= 0 {
+		seconds = configs.GlobalConfig.HlsTargetDuration
+	}
+	if seconds <= 0 {
+		seconds = 4
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// hlsPlaylistTargetDuration computes EXT-X-TARGETDURATION from the longest segment seen; caller must hold the mutex.
+// The maximum is tracked over the stream's lifetime so the tag never shrinks between reloads.
+func hlsPlaylistTargetDuration(stream *StreamConfig) int {
+	target := int(math.Ceil(stream.HLSMaxSegmentDuration.Seconds()))
+	if target < 1 {
+		target = int(hlsTargetDuration(stream).Seconds())
+	}
+	return target
+}
+
+// SetHLSSettings overrides the playlist window and target duration of a stream, zero keeps the global setting
+func (sm *StreamManager) SetHLSSettings(id string, windowSize int, targetDuration int) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return configs.ErrStreamNotFound
+	}
+
+	stream.HLSWindowSize = windowSize
+	stream.HLSTargetDuration = targetDuration
+
+	return nil
+}
+
+// GetHLSTargetDuration returns the segment target duration used to split long GOPs
+func (sm *StreamManager) GetHLSTargetDuration(id string) time.Duration {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return hlsTargetDuration(&StreamConfig{})
+	}
+
+	return hlsTargetDuration(stream)
+}
+
+// GetHLSPlaylistTargetDuration returns the EXT-X-TARGETDURATION currently advertised for a stream
+func (sm *StreamManager) GetHLSPlaylistTargetDuration(id string) time.Duration {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return hlsTargetDuration(&StreamConfig{})
+	}
+
+	return time.Duration(hlsPlaylistTargetDuration(stream)) * time.Second
+}
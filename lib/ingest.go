@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"log"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// packetIngest cuts a source's packets into HLS segments and parts and fans them out to viewers and the recorder.
+// It is independent of the source protocol, so pulled and pushed streams share one pipeline.
+type packetIngest struct {
+	manager   *StreamManager
+	streamID  string
+	codecs    []av.CodecData
+	audioOnly bool
+	stats     *ingestStats
+
+	// discontinuity flags the next segment as not continuing from the previous one
+	discontinuity bool
+
+	// Segment state
+	targetDuration time.Duration
+	splitLongGOP   bool
+	segmentStartTS time.Duration
+	segmentBuffer  []*av.Packet
+	segmentOpen    bool
+
+	// Partial segment (LL-HLS) state; parts are only cut when a part duration is configured
+	partTarget      time.Duration
+	partBuffer      []*av.Packet
+	partStartTS     time.Duration
+	lastVideoTS     time.Duration
+	frameDelta      time.Duration
+	partIndependent bool
+	partOpen        bool
+}
+
+// newPacketIngest prepares an ingest pipeline for one source connection
+func newPacketIngest(manager *StreamManager, streamID string) *packetIngest {
+	stats := manager.ingestStats(streamID)
+	stats.startSession()
+
+	return &packetIngest{
+		manager:        manager,
+		streamID:       streamID,
+		stats:          stats,
+		targetDuration: manager.GetHLSTargetDuration(streamID),
+		splitLongGOP:   configs.GlobalConfig.HlsSplitLongGop,
+		partTarget:     hlsPartTarget(),
+	}
+}
+
+// setCodecs records the source codecs and publishes them to the stream
+func (in *packetIngest) setCodecs(codecs []av.CodecData) {
+	in.codecs = codecs
+	in.audioOnly = len(codecs) == 1 && codecs[0].Type().IsAudio()
+	if in.audioOnly {
+		log.Printf("[%s] Detected audio-only stream", in.streamID)
+	}
+
+	// LL-HLS parts are fMP4 fragments, so they are only cut for codecs the fragmenter can carry
+	in.partTarget = hlsPartTarget()
+	if in.partTarget > 0 && fmp4Supported(codecs) != nil {
+		log.Printf("[%s] Codecs not supported by fMP4, LL-HLS parts disabled", in.streamID)
+		in.partTarget = 0
+	}
+
+	in.manager.UpdateCodecs(in.streamID, codecs)
+}
+
+// writePacket adds one source packet to the running segment and part, then hands it to viewers and the recorder
+func (in *packetIngest) writePacket(packet *av.Packet) {
+	isVideo := int(packet.Idx) < len(in.codecs) && in.codecs[packet.Idx].Type().IsVideo()
+	in.stats.observe(packet, isVideo, in.audioOnly)
+
+	// Segments start on keyframes; audio-only streams and, when enabled, long GOPs are cut at the target duration
+	elapsed := packet.Time - in.segmentStartTS
+	startSegment := packet.IsKeyFrame
+	if in.audioOnly {
+		startSegment = !in.segmentOpen || elapsed >= in.targetDuration || in.discontinuity
+	} else if in.splitLongGOP && isVideo && in.segmentOpen && elapsed >= in.targetDuration {
+		startSegment = true
+	}
+
+	// Process packet for HLS segmentation and broadcast
+	if startSegment {
+		// Close the running part so the segment ends on a part boundary
+		if in.partTarget > 0 && len(in.partBuffer) > 0 {
+			in.addPart(packet.Time - in.partStartTS)
+		}
+		in.partStartTS = packet.Time
+		in.partIndependent = packet.IsKeyFrame || in.audioOnly
+		in.partOpen = in.partTarget > 0
+
+		// If we already have a segment, finalize it
+		if in.segmentOpen && len(in.segmentBuffer) > 0 {
+			err := in.manager.AddHLSSegment(in.streamID, in.segmentBuffer, elapsed)
+			if err != nil {
+				log.Printf("[%s] Error adding HLS segment: %v", in.streamID, err)
+			}
+			// Clear segment buffer for new segment
+			in.segmentBuffer = make([]*av.Packet, 0, len(in.segmentBuffer))
+		}
+		if in.discontinuity {
+			in.manager.MarkHLSDiscontinuity(in.streamID)
+			in.discontinuity = false
+		}
+
+		// Start new segment
+		in.segmentStartTS = packet.Time
+		in.segmentOpen = true
+	} else if in.partOpen && isVideo && len(in.partBuffer) > 0 {
+		// Cut before this frame if waiting for the next one would overrun the part target
+		if in.lastVideoTS > 0 {
+			in.frameDelta = packet.Time - in.lastVideoTS
+		}
+		if packet.Time-in.partStartTS+in.frameDelta > in.partTarget {
+			in.addPart(packet.Time - in.partStartTS)
+			in.partStartTS = packet.Time
+			in.partIndependent = false
+		}
+	}
+
+	if isVideo {
+		in.lastVideoTS = packet.Time
+	}
+
+	// Add packet to current segment buffer; packets before the first keyframe cannot be decoded
+	if in.segmentOpen {
+		in.segmentBuffer = append(in.segmentBuffer, packet)
+	}
+	if in.partOpen {
+		in.partBuffer = append(in.partBuffer, packet)
+	}
+
+	// Broadcast packet to all connected clients
+	in.manager.BroadcastPacket(in.streamID, *packet)
+
+	// Continuous recording, when enabled for the stream
+	in.manager.RecordPacket(in.streamID, *packet)
+}
+
+// markDiscontinuity makes the segment starting at the next keyframe carry an EXT-X-DISCONTINUITY
+func (in *packetIngest) markDiscontinuity() {
+	in.discontinuity = true
+}
+
+// addPart hands the running LL-HLS partial segment to the manager and starts a new one
+func (in *packetIngest) addPart(duration time.Duration) {
+	if err := in.manager.AddHLSPart(in.streamID, in.partBuffer, duration, in.partIndependent); err != nil {
+		log.Printf("[%s] Error adding HLS part: %v", in.streamID, err)
+	}
+	in.partBuffer = make([]*av.Packet, 0, len(in.partBuffer))
+}
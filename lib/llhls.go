@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/fmp4"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// Part represents an LL-HLS partial segment
+type Part struct {
+	Duration    time.Duration
+	Independent bool
+	Data        []*av.Packet
+	FMP4        []byte
+	ETag        string
+}
+
+// hlsPartTarget returns the configured partial segment duration, zero when LL-HLS is disabled
+func hlsPartTarget() time.Duration {
+	return time.Duration(configs.GlobalConfig.HlsPartDuration) * time.Millisecond
+}
+
+// AddHLSPart muxes a partial segment and appends it to the segment in progress
+func (sm *StreamManager) AddHLSPart(id string, packets []*av.Packet, duration time.Duration, independent bool) error {
+	sm.mutex.RLock()
+	stream, exists := sm.Streams[id]
+	if !exists {
+		sm.mutex.RUnlock()
+		return configs.ErrStreamNotFound
+	}
+	codecs := stream.Codecs
+	fragmentSeq := stream.HLSPartSequence + 1
+	sm.mutex.RUnlock()
+
+	part := &Part{
+		Duration:    duration,
+		Independent: independent,
+		Data:        packets,
+	}
+
+	// Parts are numbered across the stream so the fragments of consecutive segments keep increasing
+	data, err := muxFMP4Segment(codecs, packets, duration, fragmentSeq)
+	if err != nil {
+		return err
+	}
+	part.FMP4 = data
+	part.ETag = segmentETag(data)
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	stream, exists = sm.Streams[id]
+	if !exists {
+		return configs.ErrStreamNotFound
+	}
+
+	stream.HLSPendingParts = append(stream.HLSPendingParts, part)
+	stream.HLSPartSequence = fragmentSeq
+	notifyHLSUpdate(stream)
+
+	return nil
+}
+
+// notifyHLSUpdate wakes requests blocked on new segments or parts; caller must hold the write lock
+func notifyHLSUpdate(stream *StreamConfig) {
+	close(stream.hlsNotify)
+	stream.hlsNotify = make(chan struct{})
+}
+
+// hlsPartAvailable reports whether a segment (part < 0) or part has been produced; caller must hold the mutex
+func hlsPartAvailable(stream *StreamConfig, msn int, part int) bool {
+	if msn <= stream.HLSSegmentNumber {
+		return true
+	}
+
+	return part >= 0 && msn == stream.HLSSegmentNumber+1 && part < len(stream.HLSPendingParts)
+}
+
+// WaitForHLSPart blocks until the given media sequence number and part exist or the timeout expires
+func (sm *StreamManager) WaitForHLSPart(id string, msn int, part int, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		sm.mutex.RLock()
+		stream, exists := sm.Streams[id]
+		if !exists {
+			sm.mutex.RUnlock()
+			return configs.ErrStreamNotFound
+		}
+
+		if hlsPartAvailable(stream, msn, part) {
+			sm.mutex.RUnlock()
+			return nil
+		}
+
+		notify := stream.hlsNotify
+		sm.mutex.RUnlock()
+
+		select {
+		case <-notify:
+		case <-deadline.C:
+			return configs.ErrStreamNotHLSSegments
+		}
+	}
+}
+
+// GetHLSPartFMP4 returns the fMP4 bytes and ETag of a partial segment
+func (sm *StreamManager) GetHLSPartFMP4(id string, seq int, index int) ([]byte, string, error) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return nil, "", configs.ErrStreamNotFound
+	}
+
+	var parts []*Part
+	if seq == stream.HLSSegmentNumber+1 {
+		parts = stream.HLSPendingParts
+	} else if segment, exists := stream.HLSSegmentBuffer[seq]; exists {
+		parts = segment.Parts
+	}
+
+	if index < 0 || index >= len(parts) {
+		return nil, "", configs.ErrStreamNotHLSSegments
+	}
+
+	return parts[index].FMP4, parts[index].ETag, nil
+}
+
+// concatFMP4Parts joins part fragments into the parent segment, keeping only the leading styp box
+func concatFMP4Parts(parts []*Part) []byte {
+	header := fmp4.FragmentHeader()
+
+	var out bytes.Buffer
+	for i, part := range parts {
+		if part.FMP4 == nil {
+			return nil
+		}
+
+		data := part.FMP4
+		if i > 0 && bytes.HasPrefix(data, header) {
+			data = data[len(header):]
+		}
+		out.Write(data)
+	}
+
+	return out.Bytes()
+}
+
+// renderHLSParts writes EXT-X-PART tags for the given parts of segment seq; caller must hold the mutex
+func renderHLSParts(parts []*Part, seq int, session string) string {
+	var playlist string
+
+	for i, part := range parts {
+		duration := strconv.FormatFloat(part.Duration.Seconds(), 'f', 3, 64)
+		playlist += "#EXT-X-PART:DURATION=" + duration + ",URI=\"" + partURI(seq, i, session) + "\""
+		if part.Independent {
+			playlist += ",INDEPENDENT=YES"
+		}
+		playlist += "\r\n"
+	}
+
+	return playlist
+}
+
+// partURI builds the playlist-relative URI of a partial segment
+func partURI(seq int, index int, session string) string {
+	return "segment/" + strconv.Itoa(seq) + "/part/" + strconv.Itoa(index) + "/file.m4s" + sessionQuery(session)
+}
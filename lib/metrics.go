@@ -0,0 +1,365 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metricsContentType is the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// segmentLatencyBuckets are the upper bounds, in seconds, of the segment serve latency histogram
+var segmentLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// serverMetrics holds the counters that are not derived from stream state at scrape time
+type serverMetrics struct {
+	mutex            sync.Mutex
+	startTime        time.Time
+	httpRequests     map[httpRequestKey]int64
+	segmentLatency   map[string]*latencyHistogram
+	playlistTimeouts map[playlistTimeoutKey]int64
+}
+
+// httpRequestKey labels one HTTP request counter
+type httpRequestKey struct {
+	method string
+	route  string
+	code   int
+}
+
+// playlistTimeoutKey labels one playlist wait timeout counter
+type playlistTimeoutKey struct {
+	stream string
+	format string
+}
+
+// latencyHistogram is a cumulative Prometheus histogram over segmentLatencyBuckets
+type latencyHistogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// metricsSnapshot is a copy of the server counters taken for one scrape
+type metricsSnapshot struct {
+	httpRequests     map[httpRequestKey]int64
+	segmentLatency   map[string]latencyHistogram
+	playlistTimeouts map[playlistTimeoutKey]int64
+}
+
+// newServerMetrics prepares empty counters
+func newServerMetrics() serverMetrics {
+	return serverMetrics{
+		startTime:        time.Now(),
+		httpRequests:     make(map[httpRequestKey]int64),
+		segmentLatency:   make(map[string]*latencyHistogram),
+		playlistTimeouts: make(map[playlistTimeoutKey]int64),
+	}
+}
+
+// observeRequest counts a finished HTTP request, and its latency when it served a segment
+func (m *serverMetrics) observeRequest(method string, route string, code int, elapsed time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.httpRequests[httpRequestKey{method: method, route: route, code: code}]++
+
+	if !strings.Contains(route, "/segment/") {
+		return
+	}
+
+	histogram, exists := m.segmentLatency[route]
+	if !exists {
+		histogram = &latencyHistogram{counts: make([]int64, len(segmentLatencyBuckets))}
+		m.segmentLatency[route] = histogram
+	}
+
+	seconds := elapsed.Seconds()
+	for i, bound := range segmentLatencyBuckets {
+		if seconds <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+}
+
+// playlistTimeout counts a playlist request that gave up waiting for segments
+func (m *serverMetrics) playlistTimeout(stream string, format string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.playlistTimeouts[playlistTimeoutKey{stream: stream, format: format}]++
+}
+
+// snapshot copies the counters and histograms so a scrape can render them without holding the lock
+func (m *serverMetrics) snapshot() metricsSnapshot {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	latency := make(map[string]latencyHistogram, len(m.segmentLatency))
+	for route, histogram := range m.segmentLatency {
+		copied := *histogram
+		copied.counts = slices.Clone(histogram.counts)
+		latency[route] = copied
+	}
+
+	return metricsSnapshot{
+		httpRequests:     maps.Clone(m.httpRequests),
+		segmentLatency:   latency,
+		playlistTimeouts: maps.Clone(m.playlistTimeouts),
+	}
+}
+
+// MetricsMiddleware counts every request by route and status code and times segment responses
+func (sm *StreamManager) MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		sm.metrics.observeRequest(c.Request.Method, route, c.Writer.Status(), time.Since(start))
+	}
+}
+
+// ServeMetrics writes the process and per-stream metrics in the Prometheus text format
+func ServeMetrics(c *gin.Context, streamManager *StreamManager) {
+	c.Header("Content-Type", metricsContentType)
+	c.Status(200)
+	streamManager.writeMetrics(c.Writer)
+}
+
+// streamMetrics is the per-stream state captured for one scrape
+type streamMetrics struct {
+	id       string
+	state    string
+	segments int
+	viewers  map[string]int
+	stats    StreamStats
+}
+
+// writeMetrics renders every metric family
+func (sm *StreamManager) writeMetrics(out io.Writer) {
+	w := &metricsWriter{out: out}
+
+	// Capture stream state under the manager lock, then read the ingest counters without it
+	sm.mutex.RLock()
+	now := time.Now()
+	streams := make([]streamMetrics, 0, len(sm.Streams))
+	collectors := make([]*ingestStats, 0, len(sm.Streams))
+	for id, stream := range sm.Streams {
+		viewers := make(map[string]int)
+		for _, viewer := range stream.Clients {
+			viewers[viewer.Kind]++
+		}
+		if sessions := activeHLSSessions(stream, now); sessions > 0 {
+			viewers[ViewerHLS] = sessions
+		}
+
+		streams = append(streams, streamMetrics{
+			id:       id,
+			state:    stream.State,
+			segments: stream.HLSSegmentNumber,
+			viewers:  viewers,
+		})
+		collectors = append(collectors, stream.stats)
+	}
+	workers := len(sm.workers)
+	publishers := len(sm.publishers)
+	sm.mutex.RUnlock()
+
+	for i := range streams {
+		collectors[i].fill(&streams[i].stats)
+	}
+	counters := sm.metrics.snapshot()
+	slices.SortFunc(streams, func(a, b streamMetrics) int {
+		return strings.Compare(a.id, b.id)
+	})
+
+	// Process
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+
+	w.family("process_start_time_seconds", "gauge", "Start time of the process since the Unix epoch in seconds.")
+	w.sample("process_start_time_seconds", nil, float64(sm.metrics.startTime.UnixNano())/1e9)
+	w.family("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	w.sample("go_goroutines", nil, float64(runtime.NumGoroutine()))
+	w.family("go_memstats_heap_alloc_bytes", "gauge", "Number of heap bytes allocated and still in use.")
+	w.sample("go_memstats_heap_alloc_bytes", nil, float64(memory.HeapAlloc))
+	w.family("go_memstats_sys_bytes", "gauge", "Number of bytes obtained from the system.")
+	w.sample("go_memstats_sys_bytes", nil, float64(memory.Sys))
+
+	// Streams and workers
+	byState := make(map[string]int)
+	for _, stream := range streams {
+		byState[stream.state]++
+	}
+
+	w.family("rtsphls_streams", "gauge", "Number of configured streams by lifecycle state.")
+	for _, state := range streamStates {
+		w.sample("rtsphls_streams", []string{"state", state}, float64(byState[state]))
+	}
+	w.family("rtsphls_streams_active", "gauge", "Number of streams with a running worker or a connected publisher.")
+	w.sample("rtsphls_streams_active", nil, float64(workers+publishers))
+	w.family("rtsphls_workers", "gauge", "Number of running source workers.")
+	w.sample("rtsphls_workers", nil, float64(workers))
+	w.family("rtsphls_publishers", "gauge", "Number of connected RTMP publishers.")
+	w.sample("rtsphls_publishers", nil, float64(publishers))
+
+	w.family("rtsphls_stream_state", "gauge", "Lifecycle state of a stream; the current state is 1.")
+	for _, stream := range streams {
+		for _, state := range streamStates {
+			value := 0.0
+			if stream.state == state {
+				value = 1
+			}
+			w.sample("rtsphls_stream_state", []string{"stream", stream.id, "state", state}, value)
+		}
+	}
+
+	w.family("rtsphls_stream_reconnects_total", "counter", "Source reconnections of a stream.")
+	for _, stream := range streams {
+		w.sample("rtsphls_stream_reconnects_total", []string{"stream", stream.id}, float64(stream.stats.Reconnects))
+	}
+	w.family("rtsphls_stream_ingest_bytes_total", "counter", "Media bytes ingested from a stream's source.")
+	for _, stream := range streams {
+		w.sample("rtsphls_stream_ingest_bytes_total", []string{"stream", stream.id}, float64(stream.stats.Bytes))
+	}
+	w.family("rtsphls_stream_ingest_packets_total", "counter", "Media packets ingested from a stream's source.")
+	for _, stream := range streams {
+		w.sample("rtsphls_stream_ingest_packets_total", []string{"stream", stream.id}, float64(stream.stats.Packets))
+	}
+	w.family("rtsphls_stream_lost_packets_total", "counter", "RTP packets a stream's source lost on the wire.")
+	for _, stream := range streams {
+		w.sample("rtsphls_stream_lost_packets_total", []string{"stream", stream.id}, float64(stream.stats.LostPackets))
+	}
+	w.family("rtsphls_stream_segments_total", "counter", "HLS segments produced for a stream since its source was last set.")
+	for _, stream := range streams {
+		w.sample("rtsphls_stream_segments_total", []string{"stream", stream.id}, float64(stream.segments))
+	}
+
+	w.family("rtsphls_stream_viewers", "gauge", "Connected viewers of a stream by output type.")
+	for _, stream := range streams {
+		for _, kind := range viewerKinds {
+			w.sample("rtsphls_stream_viewers", []string{"stream", stream.id, "type", kind}, float64(stream.viewers[kind]))
+		}
+	}
+
+	// HTTP
+	w.family("rtsphls_hls_playlist_wait_timeouts_total", "counter", "Playlist requests that timed out waiting for the first segments.")
+	timeouts := sortedKeys(counters.playlistTimeouts, func(a, b playlistTimeoutKey) int {
+		return cmpStrings(a.stream, b.stream, a.format, b.format)
+	})
+	for _, key := range timeouts {
+		w.sample("rtsphls_hls_playlist_wait_timeouts_total", []string{"stream", key.stream, "format", key.format}, float64(counters.playlistTimeouts[key]))
+	}
+
+	w.family("rtsphls_segment_serve_duration_seconds", "histogram", "Time taken to serve a media segment.")
+	routes := sortedKeys(counters.segmentLatency, strings.Compare)
+	for _, route := range routes {
+		histogram := counters.segmentLatency[route]
+		for i, bound := range segmentLatencyBuckets {
+			w.sample("rtsphls_segment_serve_duration_seconds_bucket", []string{"route", route, "le", formatMetricValue(bound)}, float64(histogram.counts[i]))
+		}
+		w.sample("rtsphls_segment_serve_duration_seconds_bucket", []string{"route", route, "le", "+Inf"}, float64(histogram.count))
+		w.sample("rtsphls_segment_serve_duration_seconds_sum", []string{"route", route}, histogram.sum)
+		w.sample("rtsphls_segment_serve_duration_seconds_count", []string{"route", route}, float64(histogram.count))
+	}
+
+	w.family("rtsphls_http_requests_total", "counter", "HTTP requests by method, route and status code.")
+	requests := sortedKeys(counters.httpRequests, func(a, b httpRequestKey) int {
+		return cmpStrings(a.route, b.route, a.method, b.method, strconv.Itoa(a.code), strconv.Itoa(b.code))
+	})
+	for _, key := range requests {
+		w.sample("rtsphls_http_requests_total", []string{"method", key.method, "route", key.route, "code", strconv.Itoa(key.code)}, float64(counters.httpRequests[key]))
+	}
+}
+
+// streamStates lists the lifecycle states in the order they are reported
+var streamStates = []string{
+	StreamStateIdle,
+	StreamStateConnecting,
+	StreamStateWaitingKeyframe,
+	StreamStateLive,
+	StreamStateReconnecting,
+	StreamStateFailed,
+	StreamStateStopped,
+}
+
+// viewerKinds lists the viewer output types in the order they are reported
+var viewerKinds = []string{ViewerHLS, ViewerWebRTC, ViewerMSE, ViewerFLV, ViewerMPEGTS, ViewerRTSP}
+
+// sortedKeys returns a map's keys in a stable order
+func sortedKeys[K comparable, V any](m map[K]V, compare func(a, b K) int) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, compare)
+	return keys
+}
+
+// cmpStrings compares pairs of strings in turn, the first unequal pair deciding
+func cmpStrings(pairs ...string) int {
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if c := strings.Compare(pairs[i], pairs[i+1]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// metricsWriter writes metric families in the Prometheus text exposition format
+type metricsWriter struct {
+	out io.Writer
+}
+
+// family writes the HELP and TYPE lines that precede a metric's samples
+func (w *metricsWriter) family(name string, kind string, help string) {
+	fmt.Fprintf(w.out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample; labels alternate between names and values
+func (w *metricsWriter) sample(name string, labels []string, value float64) {
+	var b strings.Builder
+	b.WriteString(name)
+
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(metricLabelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(formatMetricValue(value))
+	b.WriteByte('\n')
+	io.WriteString(w.out, b.String())
+}
+
+// metricLabelEscaper escapes label values as the text format requires
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatMetricValue prints a sample value in its shortest exact form
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
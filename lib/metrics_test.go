@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWriterSample(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []string
+		value  float64
+		want   string
+	}{
+		{"no labels", nil, 3, "m 3\n"},
+		{"several labels", []string{"stream", "cam1", "state", "live"}, 1, "m{stream=\"cam1\",state=\"live\"} 1\n"},
+		{"quote", []string{"stream", `say "hi"`}, 1, "m{stream=\"say \\\"hi\\\"\"} 1\n"},
+		{"backslash", []string{"route", `C:\cams`}, 1, "m{route=\"C:\\\\cams\"} 1\n"},
+		{"newline", []string{"stream", "a\nb"}, 1, "m{stream=\"a\\nb\"} 1\n"},
+		{"backslash before n is not a newline", []string{"stream", `a\nb`}, 1, "m{stream=\"a\\\\nb\"} 1\n"},
+		{"fractional value", nil, 0.25, "m 0.25\n"},
+		{"large value", nil, 1e21, "m 1e+21\n"},
+		{"infinity", nil, math.Inf(1), "m +Inf\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			w := &metricsWriter{out: &out}
+			w.sample("m", tt.labels, tt.value)
+			if got := out.String(); got != tt.want {
+				t.Fatalf("sample() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// lockCheckWriter fails the test if the metrics lock is held while the response is written
+type lockCheckWriter struct {
+	t       *testing.T
+	metrics *serverMetrics
+	out     strings.Builder
+}
+
+func (w *lockCheckWriter) Write(p []byte) (int, error) {
+	if !w.metrics.mutex.TryLock() {
+		w.t.Fatal("metrics lock held while writing the response")
+	}
+	w.metrics.mutex.Unlock()
+	return w.out.Write(p)
+}
+
+func TestWriteMetrics(t *testing.T) {
+	sm := NewStreamManager()
+	sm.AddStream("cam\"1", "rtsp://camera/stream", false)
+
+	sm.metrics.observeRequest("GET", "/play/hls/:cctvId/segment/:seq/file.ts", 200, 30*time.Millisecond)
+	sm.metrics.observeRequest("GET", "/play/hls/:cctvId/segment/:seq/file.ts", 404, 2*time.Second)
+	sm.metrics.observeRequest("GET", "/healthz", 200, time.Millisecond)
+	sm.metrics.playlistTimeout("cam\"1", "ts")
+
+	w := &lockCheckWriter{t: t, metrics: &sm.metrics}
+	sm.writeMetrics(w)
+	out := w.out.String()
+
+	route := `route="/play/hls/:cctvId/segment/:seq/file.ts"`
+	for _, want := range []string{
+		`rtsphls_streams{state="idle"} 1`,
+		`rtsphls_stream_state{stream="cam\"1",state="idle"} 1`,
+		`rtsphls_hls_playlist_wait_timeouts_total{stream="cam\"1",format="ts"} 1`,
+		`rtsphls_segment_serve_duration_seconds_bucket{` + route + `,le="0.025"} 0`,
+		`rtsphls_segment_serve_duration_seconds_bucket{` + route + `,le="0.05"} 1`,
+		`rtsphls_segment_serve_duration_seconds_bucket{` + route + `,le="+Inf"} 2`,
+		`rtsphls_segment_serve_duration_seconds_count{` + route + `} 2`,
+		`rtsphls_http_requests_total{method="GET",route="/healthz",code="200"} 1`,
+		`rtsphls_http_requests_total{method="GET",` + route + `,code="404"} 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Fatalf("metrics missing %q:\n%s", want, out)
+		}
+	}
+
+	// Only segment routes are timed
+	if strings.Contains(out, `rtsphls_segment_serve_duration_seconds_count{route="/healthz"}`) {
+		t.Fatalf("health check was timed as a segment:\n%s", out)
+	}
+
+	// Counting continues after a scrape without touching the rendered copy
+	sm.metrics.observeRequest("GET", "/healthz", 200, time.Millisecond)
+	w = &lockCheckWriter{t: t, metrics: &sm.metrics}
+	sm.writeMetrics(w)
+	if want := `rtsphls_http_requests_total{method="GET",route="/healthz",code="200"} 2`; !strings.Contains(w.out.String(), want+"\n") {
+		t.Fatalf("metrics missing %q after a second request", want)
+	}
+}
@@ -1,40 +1,108 @@
 package lib
 
 import (
-	"bytes"
+	"errors"
 	"log"
 	"strconv"
 	"time"
 
-	"github.com/deepch/vdk/format/ts"
 	"github.com/gin-gonic/gin"
+	"org.donghyuns.com/rtsphls/configs"
 )
 
-// PlayHLS handles m3u8 playlist requests
+// HLS viewer session token, carried as a query parameter and mirrored in a cookie
+const (
+	hlsSessionParam  = "session"
+	hlsSessionCookie = "hls_session"
+)
+
+// hlsSessionToken reads the viewer session token from the query string or cookie
+func hlsSessionToken(c *gin.Context) string {
+	if token := c.Query(hlsSessionParam); token != "" {
+		return token
+	}
+
+	token, _ := c.Cookie(hlsSessionCookie)
+	return token
+}
+
+// hlsSessionClient identifies the client of a playlist request that carries no session token
+func hlsSessionClient(c *gin.Context) string {
+	return c.ClientIP() + " " + c.Request.UserAgent()
+}
+
+// ensureStream registers an unknown CCTV ID from the database as an on-demand stream, writing a 404 on failure
+func ensureStream(c *gin.Context, streamManager *StreamManager, cctvId string) bool {
+	if err := lookupStream(streamManager, cctvId); err != nil {
+		c.String(404, "Stream not found")
+		return false
+	}
+	return true
+}
+
+// lookupStream registers an unknown CCTV ID from the database as an on-demand stream
+func lookupStream(streamManager *StreamManager, cctvId string) error {
+	if streamManager.StreamExists(cctvId) {
+		return nil
+	}
+
+	// Try to get URL from database
+	streamURL, err := GetDataUrl(cctvId)
+	if err != nil {
+		log.Printf("Error getting stream URL for CCTV ID %s: %v", cctvId, err)
+		return err
+	}
+
+	// Add stream to manager
+	streamManager.AddStream(cctvId, streamURL, true)
+	return nil
+}
+
+// PlayHLS handles MPEG-TS m3u8 playlist requests
 func PlayHLS(c *gin.Context, streamManager *StreamManager) {
+	playHLSPlaylist(c, streamManager, HLSFormatTS)
+}
+
+// PlayHLSFMP4 handles fMP4 (CMAF) m3u8 playlist requests
+func PlayHLSFMP4(c *gin.Context, streamManager *StreamManager) {
+	playHLSPlaylist(c, streamManager, HLSFormatFMP4)
+}
+
+// PlayHLSLL handles Low-Latency HLS playlist requests, including blocking reloads
+func PlayHLSLL(c *gin.Context, streamManager *StreamManager) {
+	playHLSPlaylist(c, streamManager, HLSFormatLL)
+}
+
+// PlayHLSDVR handles time-shift playlist requests over a stream's DVR window, honouring ?start=<timestamp>
+func PlayHLSDVR(c *gin.Context, streamManager *StreamManager) {
+	playHLSPlaylist(c, streamManager, HLSFormatDVR)
+}
+
+// playHLSPlaylist starts the stream if needed and waits for a playlist in the given format
+func playHLSPlaylist(c *gin.Context, streamManager *StreamManager, format string) {
 	cctvId := c.Param("cctvId")
 
-	// Check if stream exists
-	if !streamManager.StreamExists(cctvId) {
-		// Try to get URL from database
-		streamURL, err := GetDataUrl(cctvId)
-		if err != nil {
-			log.Printf("Error getting stream URL for CCTV ID %s: %v", cctvId, err)
-			c.String(404, "Stream not found")
-			return
-		}
+	if !ensureStream(c, streamManager, cctvId) {
+		return
+	}
 
-		// Add stream to manager
-		streamManager.AddStream(cctvId, streamURL, true)
+	// Register or refresh the viewer session before starting so on-demand workers see a viewer
+	session, err := streamManager.TouchHLSSession(cctvId, hlsSessionToken(c), hlsSessionClient(c))
+	if err != nil {
+		c.String(404, "Stream not found")
+		return
+	}
+	c.SetCookie(hlsSessionCookie, session, int(hlsSessionTimeout().Seconds()), "/play/hls/"+cctvId, "", false, true)
+
+	// Start RTSP worker if not running
+	streamManager.StartWorker(cctvId)
 
-		// Start RTSP worker
-		worker := NewRTSPWorker(streamManager, cctvId, streamURL, true)
-		worker.Start()
-	} else if streamManager.RunIfNotRunning(cctvId) {
-		// Start RTSP worker if not running
-		stream, _ := streamManager.GetStream(cctvId)
-		worker := NewRTSPWorker(streamManager, cctvId, stream.URL, stream.OnDemand)
-		worker.Start()
+	var start time.Time
+	if startStr := c.Query("start"); format == HLSFormatDVR && startStr != "" {
+		if start, err = ParseTimestamp(startStr); err != nil {
+			c.String(400, "Invalid start timestamp")
+			return
+		}
 	}
 
 	// Wait for playlist to be ready (with timeout)
@@ -42,7 +110,21 @@ func PlayHLS(c *gin.Context, streamManager *StreamManager) {
 	const retryInterval = 500 * time.Millisecond
 
 	for i := 0; i < maxRetries; i++ {
-		playlist, segmentCount, err := streamManager.GetHLSM3U8(cctvId)
+		var playlist string
+		var segmentCount int
+		if format == HLSFormatDVR {
+			playlist, segmentCount, err = streamManager.GetDVRPlaylist(cctvId, session, start)
+		} else {
+			playlist, segmentCount, err = streamManager.GetHLSPlaylist(cctvId, session, format)
+		}
+		if errors.Is(err, configs.ErrStreamDVRDisabled) {
+			c.String(404, "DVR not enabled for stream")
+			return
+		}
+		if errors.Is(err, configs.ErrStreamFMP4Unsupported) {
+			c.String(415, "Stream codecs not supported by fMP4 output")
+			return
+		}
 		if err != nil {
 			log.Printf("Error getting playlist for CCTV ID %s: %v", cctvId, err)
 			c.String(500, "Error generating playlist")
@@ -50,6 +132,14 @@ func PlayHLS(c *gin.Context, streamManager *StreamManager) {
 		}
 
 		if segmentCount >= 2 {
+			// Blocking playlist reload: hold the request until the requested segment or part exists
+			if format == HLSFormatLL && c.Query("_HLS_msn") != "" {
+				playlist, err = waitHLSBlockingReload(c, streamManager, cctvId, session)
+				if err != nil {
+					return
+				}
+			}
+
 			c.Header("Content-Type", "application/vnd.apple.mpegurl")
 			c.Header("Cache-Control", "no-cache")
 			c.String(200, playlist)
@@ -63,9 +153,51 @@ func PlayHLS(c *gin.Context, streamManager *StreamManager) {
 		time.Sleep(retryInterval)
 	}
 
+	streamManager.metrics.playlistTimeout(cctvId, format)
 	c.String(504, "Timeout waiting for stream to initialize")
 }
 
+// waitHLSBlockingReload honours _HLS_msn/_HLS_part and returns the refreshed playlist, writing the error response itself
+func waitHLSBlockingReload(c *gin.Context, streamManager *StreamManager, cctvId string, session string) (string, error) {
+	msn, err := strconv.Atoi(c.Query("_HLS_msn"))
+	if err != nil {
+		c.String(400, "Invalid _HLS_msn")
+		return "", err
+	}
+
+	part := -1
+	if partStr := c.Query("_HLS_part"); partStr != "" {
+		if part, err = strconv.Atoi(partStr); err != nil {
+			c.String(400, "Invalid _HLS_part")
+			return "", err
+		}
+	}
+
+	// Requests too far in the future can never be satisfied within the timeout
+	current, err := streamManager.GetHLSSegmentNumber(cctvId)
+	if err != nil {
+		c.String(404, "Stream not found")
+		return "", err
+	}
+	if msn > current+2 {
+		c.String(400, "Requested media sequence too far ahead")
+		return "", configs.ErrStreamNotHLSSegments
+	}
+
+	if err := streamManager.WaitForHLSPart(cctvId, msn, part, 3*streamManager.GetHLSPlaylistTargetDuration(cctvId)); err != nil {
+		c.String(503, "Requested segment not available")
+		return "", err
+	}
+
+	playlist, _, err := streamManager.GetHLSPlaylist(cctvId, session, HLSFormatLL)
+	if err != nil {
+		c.String(500, "Error generating playlist")
+		return "", err
+	}
+
+	return playlist, nil
+}
+
 // PlayHLSTS handles TS segment requests
 func PlayHLSTS(c *gin.Context, streamManager *StreamManager) {
 	cctvId := c.Param("cctvId")
@@ -79,60 +211,127 @@ func PlayHLSTS(c *gin.Context, streamManager *StreamManager) {
 		return
 	}
 
-	// Get codec information
-	codecs, err := streamManager.GetCodecs(cctvId)
+	// Segment fetches keep the viewer alive; restart an on-demand worker that already idled out
+	if streamManager.RefreshHLSSession(cctvId, hlsSessionToken(c)) {
+		streamManager.StartWorker(cctvId)
+	}
+
+	// Get the segment bytes muxed once when the segment was cut
+	data, etag, err := streamManager.GetHLSSegmentTS(cctvId, seq)
 	if err != nil {
-		log.Printf("Error getting codecs for CCTV ID %s: %v", cctvId, err)
-		c.String(500, "Stream codec information not available")
+		log.Printf("Error getting segment %d for CCTV ID %s: %v", seq, cctvId, err)
+		c.String(404, "Segment not found")
 		return
 	}
 
-	// Get segment data
-	packetData, err := streamManager.GetHLSSegment(cctvId, seq)
+	serveSegment(c, data, etag, "video/mp2t")
+}
+
+// PlayHLSInit handles fMP4 init segment requests
+func PlayHLSInit(c *gin.Context, streamManager *StreamManager) {
+	cctvId := c.Param("cctvId")
+
+	streamManager.RefreshHLSSession(cctvId, hlsSessionToken(c))
+
+	init, err := streamManager.GetFMP4Init(cctvId)
+	if errors.Is(err, configs.ErrStreamFMP4Unsupported) {
+		c.String(415, "Stream codecs not supported by fMP4 output")
+		return
+	}
 	if err != nil {
-		log.Printf("Error getting segment %d for CCTV ID %s: %v", seq, cctvId, err)
+		log.Printf("Error building init segment for CCTV ID %s: %v", cctvId, err)
+		c.String(404, "Init segment not available")
+		return
+	}
+
+	serveSegment(c, init, segmentETag(init), "video/mp4")
+}
+
+// PlayHLSFMP4Segment handles fMP4 media segment requests
+func PlayHLSFMP4Segment(c *gin.Context, streamManager *StreamManager) {
+	cctvId := c.Param("cctvId")
+
+	// Parse segment sequence number
+	seqStr := c.Param("seq")
+	seq, err := strconv.Atoi(seqStr)
+	if err != nil {
+		log.Printf("Invalid segment number: %s", seqStr)
+		c.String(400, "Invalid segment number")
+		return
+	}
+
+	// Segment fetches keep the viewer alive; restart an on-demand worker that already idled out
+	if streamManager.RefreshHLSSession(cctvId, hlsSessionToken(c)) {
+		streamManager.StartWorker(cctvId)
+	}
+
+	data, etag, err := streamManager.GetHLSSegmentFMP4(cctvId, seq)
+	if errors.Is(err, configs.ErrStreamFMP4Unsupported) {
+		c.String(415, "Stream codecs not supported by fMP4 output")
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting fMP4 segment %d for CCTV ID %s: %v", seq, cctvId, err)
 		c.String(404, "Segment not found")
 		return
 	}
 
-	if len(packetData) == 0 {
-		c.String(404, "Empty segment")
+	serveSegment(c, data, etag, "video/iso.segment")
+}
+
+// PlayHLSPart handles LL-HLS partial segment requests, waiting briefly for preload-hinted parts
+func PlayHLSPart(c *gin.Context, streamManager *StreamManager) {
+	cctvId := c.Param("cctvId")
+
+	seq, err := strconv.Atoi(c.Param("seq"))
+	if err != nil {
+		c.String(400, "Invalid segment number")
 		return
 	}
 
-	// Create TS muxer
-	outBuffer := bytes.NewBuffer([]byte{})
-	muxer := ts.NewMuxer(outBuffer)
+	part, err := strconv.Atoi(c.Param("part"))
+	if err != nil {
+		c.String(400, "Invalid part number")
+		return
+	}
+
+	if streamManager.RefreshHLSSession(cctvId, hlsSessionToken(c)) {
+		streamManager.StartWorker(cctvId)
+	}
+
+	// A preload hint points at a part that is still being produced
+	if err := streamManager.WaitForHLSPart(cctvId, seq, part, 3*hlsPartTarget()); err != nil {
+		c.String(404, "Part not found")
+		return
+	}
 
-	// Write TS header
-	if err := muxer.WriteHeader(codecs); err != nil {
-		log.Printf("Error writing TS header: %v", err)
-		c.String(500, "Error generating segment")
+	data, etag, err := streamManager.GetHLSPartFMP4(cctvId, seq, part)
+	if err != nil {
+		log.Printf("Error getting part %d.%d for CCTV ID %s: %v", seq, part, cctvId, err)
+		c.String(404, "Part not found")
 		return
 	}
 
-	// Enable padding for continuous counter
-	muxer.PaddingToMakeCounterCont = true
+	serveSegment(c, data, etag, "video/iso.segment")
+}
 
-	// Write packets
-	for _, packet := range packetData {
-		packet.CompositionTime = 1
-		if err := muxer.WritePacket(*packet); err != nil {
-			log.Printf("Error writing packet to TS muxer: %v", err)
-			c.String(500, "Error generating segment")
-			return
-		}
+// serveSegment writes immutable segment bytes, answering conditional requests by ETag
+func serveSegment(c *gin.Context, data []byte, etag string, contentType string) {
+	if len(data) == 0 {
+		c.String(404, "Empty segment")
+		return
 	}
 
-	// Write trailer
-	if err := muxer.WriteTrailer(); err != nil {
-		log.Printf("Error writing TS trailer: %v", err)
-		c.String(500, "Error generating segment")
+	// Segments are immutable once cut, so a matching ETag needs no body
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(304)
 		return
 	}
 
 	// Send response
-	c.Header("Content-Type", "video/mp2t")
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Length", strconv.Itoa(len(data)))
 	c.Header("Cache-Control", "no-cache")
-	c.Data(200, "video/mp2t", outBuffer.Bytes())
+	c.Data(200, contentType, data)
 }
@@ -0,0 +1,390 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/format/fmp4"
+	"github.com/gin-gonic/gin"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// PlayDASH handles dynamic MPD manifest requests over the live segment window
+func PlayDASH(c *gin.Context, streamManager *StreamManager) {
+	cctvId := c.Param("cctvId")
+
+	if !ensureStream(c, streamManager, cctvId) {
+		return
+	}
+
+	// DASH viewers share the HLS session tracking so on-demand workers see them
+	session, err := streamManager.TouchHLSSession(cctvId, hlsSessionToken(c), hlsSessionClient(c))
+	if err != nil {
+		c.String(404, "Stream not found")
+		return
+	}
+	c.SetCookie(hlsSessionCookie, session, int(hlsSessionTimeout().Seconds()), "/play/dash/"+cctvId, "", false, true)
+
+	streamManager.StartWorker(cctvId)
+
+	// Wait for manifest to be ready (with timeout)
+	const maxRetries = 40
+	const retryInterval = 500 * time.Millisecond
+
+	for i := 0; i < maxRetries; i++ {
+		manifest, segmentCount, err := streamManager.GetDASHManifest(cctvId, session)
+		if errors.Is(err, configs.ErrStreamFMP4Unsupported) {
+			c.String(415, "Stream codecs not supported by DASH output")
+			return
+		}
+		if err != nil {
+			log.Printf("Error getting DASH manifest for CCTV ID %s: %v", cctvId, err)
+			c.String(500, "Error generating manifest")
+			return
+		}
+
+		if segmentCount >= 2 {
+			c.Header("Content-Type", "application/dash+xml")
+			c.Header("Cache-Control", "no-cache")
+			c.String(200, manifest)
+			return
+		}
+
+		if i == 0 || i == maxRetries/2 {
+			log.Printf("Waiting for DASH segments for CCTV ID %s (%d/%d)", cctvId, i+1, maxRetries)
+		}
+
+		time.Sleep(retryInterval)
+	}
+
+	streamManager.metrics.playlistTimeout(cctvId, "dash")
+	c.String(504, "Timeout waiting for stream to initialize")
+}
+
+// PlayDASHInit handles the per-track initialization segment requests of the DASH adaptation sets
+func PlayDASHInit(c *gin.Context, streamManager *StreamManager) {
+	cctvId := c.Param("cctvId")
+
+	track, err := strconv.Atoi(c.Param("track"))
+	if err != nil {
+		c.String(400, "Invalid track number")
+		return
+	}
+
+	streamManager.RefreshHLSSession(cctvId, hlsSessionToken(c))
+
+	init, err := streamManager.GetDASHInit(cctvId, track)
+	if errors.Is(err, configs.ErrStreamFMP4Unsupported) {
+		c.String(415, "Stream codecs not supported by DASH output")
+		return
+	}
+	if err != nil {
+		log.Printf("Error building DASH init segment of track %d for CCTV ID %s: %v", track, cctvId, err)
+		c.String(404, "Init segment not available")
+		return
+	}
+
+	serveSegment(c, init.Data, init.ETag, init.ContentType)
+}
+
+// PlayDASHSegment handles DASH media segment requests of one track
+func PlayDASHSegment(c *gin.Context, streamManager *StreamManager) {
+	cctvId := c.Param("cctvId")
+
+	track, err := strconv.Atoi(c.Param("track"))
+	if err != nil {
+		c.String(400, "Invalid track number")
+		return
+	}
+
+	seq, err := strconv.Atoi(c.Param("seq"))
+	if err != nil {
+		c.String(400, "Invalid segment number")
+		return
+	}
+
+	// Segment fetches keep the viewer alive; restart an on-demand worker that already idled out
+	if streamManager.RefreshHLSSession(cctvId, hlsSessionToken(c)) {
+		streamManager.StartWorker(cctvId)
+	}
+
+	segment, err := streamManager.GetDASHSegment(cctvId, track, seq)
+	if errors.Is(err, configs.ErrStreamFMP4Unsupported) {
+		c.String(415, "Stream codecs not supported by DASH output")
+		return
+	}
+	if err != nil {
+		log.Printf("Error getting DASH segment %d of track %d for CCTV ID %s: %v", seq, track, cctvId, err)
+		c.String(404, "Segment not found")
+		return
+	}
+
+	serveSegment(c, segment.Data, segment.ETag, segment.ContentType)
+}
+
+// DASHFragment is a rendered DASH init or media segment of one track
+type DASHFragment struct {
+	Data        []byte
+	ETag        string
+	ContentType string
+}
+
+// GetDASHManifest generates a dynamic MPD with one adaptation set per track.
+// The SegmentTemplate numbers are the HLS media sequence numbers, shared by every track.
+func (sm *StreamManager) GetDASHManifest(id string, session string) (string, int, error) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return "", 0, configs.ErrStreamNotFound
+	}
+
+	if err := fmp4Supported(stream.Codecs); len(stream.Codecs) > 0 && err != nil {
+		return "", 0, err
+	}
+
+	var keys []int
+	for k := range stream.HLSSegmentBuffer {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	_, indexes := fmp4Tracks(stream.Codecs)
+	if len(keys) == 0 || len(indexes) == 0 {
+		return "", 0, nil
+	}
+
+	// Per-track bandwidth comes from the payload bytes of that track across the window
+	var window time.Duration
+	trackBytes := make(map[int8]int)
+	for _, k := range keys {
+		window += stream.HLSSegmentBuffer[k].Duration
+		for _, packet := range stream.HLSSegmentBuffer[k].Data {
+			trackBytes[packet.Idx] += len(packet.Data)
+		}
+	}
+
+	target := time.Duration(hlsPlaylistTargetDuration(stream)) * time.Second
+
+	var mpd strings.Builder
+	mpd.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(&mpd, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011" type="dynamic"`+
+		` availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="%s" minBufferTime="%s" timeShiftBufferDepth="%s" suggestedPresentationDelay="%s">`+"\n",
+		dashTime(stream.DASHStart), dashTime(time.Now()), dashDuration(target), dashDuration(target), dashDuration(window), dashDuration(3*target))
+	mpd.WriteString(`  <Period id="0" start="PT0S">` + "\n")
+
+	for i, codec := range stream.Codecs {
+		if _, ok := indexes[int8(i)]; !ok {
+			continue
+		}
+
+		contentType := "audio"
+		bandwidth := 128000
+		attributes := ""
+		var channelConfig string
+		switch codec := codec.(type) {
+		case av.VideoCodecData:
+			contentType = "video"
+			bandwidth = 1000000
+			attributes = fmt.Sprintf(` width="%d" height="%d"`, codec.Width(), codec.Height())
+		case av.AudioCodecData:
+			attributes = fmt.Sprintf(` audioSamplingRate="%d"`, codec.SampleRate())
+			channelConfig = fmt.Sprintf(`        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="%d"/>`+"\n",
+				codec.ChannelLayout().Count())
+		}
+		if window > 0 && trackBytes[int8(i)] > 0 {
+			bandwidth = int(float64(trackBytes[int8(i)]*8) / window.Seconds())
+		}
+
+		trackPath := "track/" + strconv.Itoa(i) + "/"
+		fmt.Fprintf(&mpd, `    <AdaptationSet id="%d" contentType="%s" mimeType="%s/mp4" segmentAlignment="true" startWithSAP="1">`+"\n", i, contentType, contentType)
+		fmt.Fprintf(&mpd, `      <Representation id="%d" codecs="%s" bandwidth="%d"%s>`+"\n", i, dashCodecs([]av.CodecData{codec}), bandwidth, attributes)
+		mpd.WriteString(channelConfig)
+		fmt.Fprintf(&mpd, `        <SegmentTemplate timescale="1000" initialization="%s" media="%s" startNumber="%d">`+"\n",
+			html.EscapeString(trackPath+"init.mp4"+sessionQuery(session)), html.EscapeString(trackPath+"segment/$Number$/file.m4s"+sessionQuery(session)), keys[0])
+		mpd.WriteString("          <SegmentTimeline>\n")
+		// Durations are differences of rounded start times, so each segment starts exactly where the previous one ends
+		for n, k := range keys {
+			segment := stream.HLSSegmentBuffer[k]
+			start := segment.DASHTime.Milliseconds()
+			duration := (segment.DASHTime + segment.Duration).Milliseconds() - start
+			if n == 0 {
+				fmt.Fprintf(&mpd, `            <S t="%d" d="%d"/>`+"\n", start, duration)
+			} else {
+				fmt.Fprintf(&mpd, `            <S d="%d"/>`+"\n", duration)
+			}
+		}
+		mpd.WriteString("          </SegmentTimeline>\n")
+		mpd.WriteString("        </SegmentTemplate>\n")
+		mpd.WriteString("      </Representation>\n")
+		mpd.WriteString("    </AdaptationSet>\n")
+	}
+
+	mpd.WriteString("  </Period>\n")
+	mpd.WriteString("</MPD>\n")
+
+	return mpd.String(), len(keys), nil
+}
+
+// dashTrack returns the codec of a DASH track, which is the source track with the same index; caller must hold the mutex
+func dashTrack(stream *StreamConfig, track int) (av.CodecData, error) {
+	if err := fmp4Supported(stream.Codecs); err != nil {
+		return nil, err
+	}
+
+	if track < 0 || track >= len(stream.Codecs) {
+		return nil, configs.ErrStreamNotHLSSegments
+	}
+	_, indexes := fmp4Tracks(stream.Codecs)
+	if _, ok := indexes[int8(track)]; !ok {
+		return nil, configs.ErrStreamNotHLSSegments
+	}
+
+	return stream.Codecs[track], nil
+}
+
+// dashContentType returns the MIME type of a track's segments
+func dashContentType(codec av.CodecData) string {
+	if codec.Type().IsVideo() {
+		return "video/mp4"
+	}
+	return "audio/mp4"
+}
+
+// GetDASHInit returns the cached single-track init segment of a DASH track, building it on first use
+func (sm *StreamManager) GetDASHInit(id string, track int) (DASHFragment, error) {
+	sm.mutex.RLock()
+	stream, exists := sm.Streams[id]
+	if !exists {
+		sm.mutex.RUnlock()
+		return DASHFragment{}, configs.ErrStreamNotFound
+	}
+
+	if init, cached := stream.DASHInit[track]; cached {
+		sm.mutex.RUnlock()
+		return init, nil
+	}
+
+	codec, err := dashTrack(stream, track)
+	sm.mutex.RUnlock()
+	if err != nil {
+		return DASHFragment{}, err
+	}
+
+	fragmenter, err := fmp4.NewTrack(codec)
+	if err != nil {
+		return DASHFragment{}, err
+	}
+	_, _, data := fragmenter.MovieHeader()
+
+	init := DASHFragment{Data: data, ETag: segmentETag(data), ContentType: dashContentType(codec)}
+
+	sm.mutex.Lock()
+	if stream, exists := sm.Streams[id]; exists {
+		if stream.DASHInit == nil {
+			stream.DASHInit = make(map[int]DASHFragment)
+		}
+		stream.DASHInit[track] = init
+	}
+	sm.mutex.Unlock()
+
+	return init, nil
+}
+
+// GetDASHSegment returns one track of a segment as a CMAF fragment timed on the DASH clock, rendering it on first request
+func (sm *StreamManager) GetDASHSegment(id string, track int, seq int) (DASHFragment, error) {
+	sm.mutex.RLock()
+	stream, exists := sm.Streams[id]
+	if !exists {
+		sm.mutex.RUnlock()
+		return DASHFragment{}, configs.ErrStreamNotFound
+	}
+
+	segment, exists := stream.HLSSegmentBuffer[seq]
+	if !exists || len(segment.Data) == 0 {
+		sm.mutex.RUnlock()
+		return DASHFragment{}, configs.ErrStreamNotHLSSegments
+	}
+
+	if fragment, cached := segment.DASH[track]; cached {
+		sm.mutex.RUnlock()
+		return fragment, nil
+	}
+
+	codec, err := dashTrack(stream, track)
+	if err != nil {
+		sm.mutex.RUnlock()
+		return DASHFragment{}, err
+	}
+
+	packets := segment.Data
+	duration := segment.Duration
+	shift := segment.DASHTime - segment.Data[0].Time
+	sm.mutex.RUnlock()
+
+	// Rebase copies onto the DASH clock so the fragment decode times match the manifest
+	rebased := make([]*av.Packet, len(packets))
+	for i, packet := range packets {
+		pkt := *packet
+		pkt.Time += shift
+		rebased[i] = &pkt
+	}
+
+	data, err := muxFMP4TrackSegment(codec, int8(track), rebased, duration, uint32(seq))
+	if err != nil {
+		return DASHFragment{}, err
+	}
+
+	fragment := DASHFragment{Data: data, ETag: segmentETag(data), ContentType: dashContentType(codec)}
+
+	sm.mutex.Lock()
+	if segment.DASH == nil {
+		segment.DASH = make(map[int]DASHFragment)
+	}
+	segment.DASH[track] = fragment
+	sm.mutex.Unlock()
+
+	return fragment, nil
+}
+
+// dashCodecs builds the RFC 6381 codecs attribute for the fMP4 tracks
+func dashCodecs(tracks []av.CodecData) string {
+	names := make([]string, 0, len(tracks))
+	for _, codec := range tracks {
+		switch codec := codec.(type) {
+		case h264parser.CodecData:
+			name := "avc1.42e01f"
+			if sps := codec.SPS(); len(sps) >= 4 {
+				name = fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3])
+			}
+			names = append(names, name)
+		case aacparser.CodecData:
+			names = append(names, fmt.Sprintf("mp4a.40.%d", codec.Config.ObjectType))
+		default:
+			if codec.Type() == av.OPUS {
+				names = append(names, "opus")
+			}
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// dashTime formats a wall-clock time as an xs:dateTime in UTC
+func dashTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// dashDuration formats a duration as an xs:duration in seconds
+func dashDuration(d time.Duration) string {
+	return "PT" + strconv.FormatFloat(d.Seconds(), 'f', 3, 64) + "S"
+}
@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/deepch/vdk/codec/aacparser"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+func TestDashCodecs(t *testing.T) {
+	h264 := testH264(t)
+	aac := testAAC(t)
+	opus := codec.NewOpusCodecData(48000, av.CH_STEREO)
+
+	// HE-AAC, 48 kHz stereo
+	heAAC, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes([]byte{0x29, 0x90})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tracks []av.CodecData
+		want   string
+	}{
+		{"h264 profile and level from the sps", []av.CodecData{h264}, "avc1.42c00d"},
+		{"aac lc", []av.CodecData{aac}, "mp4a.40.2"},
+		{"he-aac", []av.CodecData{heAAC}, "mp4a.40.5"},
+		{"opus", []av.CodecData{opus}, "opus"},
+		{"muxed tracks in order", []av.CodecData{h264, aac}, "avc1.42c00d,mp4a.40.2"},
+		{"unsupported codecs are skipped", []av.CodecData{typeOnlyCodec(av.PCM_ALAW), aac}, "mp4a.40.2"},
+		{"no tracks", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dashCodecs(tt.tracks); got != tt.want {
+				t.Fatalf("dashCodecs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDASHAdaptationSets(t *testing.T) {
+	const id = "cam1"
+	sm := NewStreamManager()
+	sm.AddStream(id, "rtmp://publisher", false)
+	sm.UpdateCodecs(id, []av.CodecData{testH264(t), testAAC(t)})
+
+	keyframe := []byte{0, 0, 0, 4, 0x65, 0x88, 0x84, 0x00}
+	audio := []byte{0x21, 0x10, 0x04, 0x60, 0x8c, 0x1c}
+	for i := 0; i < 2; i++ {
+		start := time.Duration(i) * time.Second
+		packets := []*av.Packet{
+			{Idx: 0, IsKeyFrame: true, Time: start, Data: keyframe},
+			{Idx: 1, Time: start, Data: audio},
+			{Idx: 1, Time: start + 500*time.Millisecond, Data: audio},
+		}
+		if err := sm.AddHLSSegment(id, packets, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest, count, err := sm.GetDASHManifest(id, "")
+	if err != nil || count != 2 {
+		t.Fatalf("GetDASHManifest() = %d segments, %v", count, err)
+	}
+	if sets := strings.Count(manifest, "<AdaptationSet "); sets != 2 {
+		t.Fatalf("manifest has %d adaptation sets, want 2:\n%s", sets, manifest)
+	}
+	for _, want := range []string{
+		`contentType="video" mimeType="video/mp4"`,
+		`codecs="avc1.42c00d"`,
+		`initialization="track/0/init.mp4" media="track/0/segment/$Number$/file.m4s" startNumber="1"`,
+		`contentType="audio" mimeType="audio/mp4"`,
+		`codecs="mp4a.40.2"`,
+		`audioSamplingRate="44100"`,
+		`initialization="track/1/init.mp4" media="track/1/segment/$Number$/file.m4s" startNumber="1"`,
+	} {
+		if !strings.Contains(manifest, want) {
+			t.Fatalf("manifest missing %q:\n%s", want, manifest)
+		}
+	}
+
+	for track, contentType := range []string{"video/mp4", "audio/mp4"} {
+		init, err := sm.GetDASHInit(id, track)
+		if err != nil || init.ContentType != contentType || len(init.Data) == 0 {
+			t.Fatalf("GetDASHInit(%d) = %q, %d bytes, %v", track, init.ContentType, len(init.Data), err)
+		}
+
+		segment, err := sm.GetDASHSegment(id, track, 2)
+		if err != nil || segment.ContentType != contentType {
+			t.Fatalf("GetDASHSegment(%d) = %q, %v", track, segment.ContentType, err)
+		}
+		if got := fragmentSequence(t, segment.Data); got != 2 {
+			t.Fatalf("track %d mfhd sequence = %d, want 2", track, got)
+		}
+
+		// Each fragment carries only its own track
+		if got := strings.Count(string(segment.Data), "traf"); got != 1 {
+			t.Fatalf("track %d fragment has %d traf boxes, want 1", track, got)
+		}
+	}
+
+	if _, err := sm.GetDASHSegment(id, 5, 2); !errors.Is(err, configs.ErrStreamNotHLSSegments) {
+		t.Fatalf("GetDASHSegment(unknown track) = %v, want ErrStreamNotHLSSegments", err)
+	}
+}
+
+func TestDASHSegmentTimeline(t *testing.T) {
+	const id = "cam1"
+	sm := NewStreamManager()
+	sm.AddStream(id, "rtmp://publisher", false)
+	sm.UpdateCodecs(id, []av.CodecData{testH264(t)})
+
+	// Segments a fraction of a millisecond long drift when each is rounded on its own
+	duration := time.Second + 600*time.Microsecond
+	keyframe := []byte{0, 0, 0, 4, 0x65, 0x88, 0x84, 0x00}
+	for i := 0; i < 3; i++ {
+		packets := []*av.Packet{{Idx: 0, IsKeyFrame: true, Time: time.Duration(i) * duration, Data: keyframe}}
+		if err := sm.AddHLSSegment(id, packets, duration); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest, _, err := sm.GetDASHManifest(id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `          <SegmentTimeline>
+            <S t="0" d="1000"/>
+            <S d="1001"/>
+            <S d="1000"/>
+          </SegmentTimeline>
+`
+	if !strings.Contains(manifest, want) {
+		t.Fatalf("manifest missing timeline\n%s\ngot:\n%s", want, manifest)
+	}
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"log"
+	"time"
+
+	"github.com/deepch/vdk/format/mp4f"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// Timeouts for live viewer connections
+const (
+	viewerNoVideoTimeout = 20 * time.Second
+	viewerWriteTimeout   = 10 * time.Second
+)
+
+// PlayMSE handles WebSocket requests streaming fMP4 fragments for Media Source Extensions players
+func PlayMSE(c *gin.Context, streamManager *StreamManager) {
+	cctvId := c.Param("cctvId")
+
+	if !ensureStream(c, streamManager, cctvId) {
+		return
+	}
+
+	// websocket.Server skips the Origin check; CORS is handled by the router
+	server := websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			serveMSE(ws, streamManager, cctvId)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// serveMSE sends the codec string, the init segment and then moof/mdat fragments until either side goes away
+func serveMSE(ws *websocket.Conn, streamManager *StreamManager, cctvId string) {
+	defer ws.Close()
+
+	// Register as a viewer before starting so on-demand workers keep running
+	clientID, packets, err := streamManager.AddClient(cctvId, ViewerMSE)
+	if err != nil {
+		log.Printf("Error adding MSE client for CCTV ID %s: %v", cctvId, err)
+		return
+	}
+	defer streamManager.RemoveClient(cctvId, clientID)
+
+	streamManager.StartWorker(cctvId)
+
+	codecs, err := streamManager.GetCodecs(cctvId)
+	if err != nil {
+		log.Printf("Error getting codecs for CCTV ID %s: %v", cctvId, err)
+		return
+	}
+
+	tracks, indexes := mp4Tracks(codecs)
+	if len(tracks) == 0 {
+		log.Printf("No MSE compatible tracks for CCTV ID %s", cctvId)
+		return
+	}
+
+	muxer := mp4f.NewMuxer(nil)
+	if err := muxer.WriteHeader(tracks); err != nil {
+		log.Printf("Error writing MSE header for CCTV ID %s: %v", cctvId, err)
+		return
+	}
+
+	// The codec string lets the player create its SourceBuffer before the init segment arrives
+	meta, init := muxer.GetInit(tracks)
+	ws.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+	if err := websocket.Message.Send(ws, meta); err != nil {
+		return
+	}
+	if err := websocket.Message.Send(ws, init); err != nil {
+		return
+	}
+
+	// MSE players never send data, so a failed read means the browser went away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var message []byte
+		for {
+			if err := websocket.Message.Receive(ws, &message); err != nil {
+				return
+			}
+		}
+	}()
+
+	hasVideo := false
+	for _, codec := range tracks {
+		hasVideo = hasVideo || codec.Type().IsVideo()
+	}
+
+	noVideoTimer := time.NewTimer(viewerNoVideoTimeout)
+	defer noVideoTimer.Stop()
+
+	started := !hasVideo
+	for {
+		select {
+		case <-closed:
+			return
+
+		case <-noVideoTimer.C:
+			log.Printf("MSE client for CCTV ID %s stopping: no video", cctvId)
+			return
+
+		case pkt, ok := <-packets:
+			if !ok {
+				return
+			}
+
+			idx, ok := indexes[pkt.Idx]
+			if !ok {
+				continue
+			}
+
+			if pkt.IsKeyFrame || !hasVideo {
+				noVideoTimer.Reset(viewerNoVideoTimeout)
+			}
+
+			// Decoding has to start at a keyframe
+			if !started {
+				if !pkt.IsKeyFrame {
+					continue
+				}
+				started = true
+			}
+
+			pkt.Idx = idx
+			ready, fragment, err := muxer.WritePacket(pkt, false)
+			if err != nil {
+				log.Printf("Error muxing MSE fragment for CCTV ID %s: %v", cctvId, err)
+				return
+			}
+
+			if ready {
+				ws.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+				if err := websocket.Message.Send(ws, fragment); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
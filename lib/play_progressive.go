@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/flv"
+	"github.com/deepch/vdk/format/ts"
+	"github.com/gin-gonic/gin"
+)
+
+// PlayFLV handles requests for an endless HTTP-FLV live stream
+func PlayFLV(c *gin.Context, streamManager *StreamManager) {
+	serveProgressive(c, streamManager, ViewerFLV, "video/x-flv", func(w io.Writer) av.Muxer {
+		return flv.NewMuxerWriteFlusher(nopFlusher{w})
+	})
+}
+
+// PlayTS handles requests for an endless MPEG-TS live stream
+func PlayTS(c *gin.Context, streamManager *StreamManager) {
+	serveProgressive(c, streamManager, ViewerMPEGTS, "video/mp2t", func(w io.Writer) av.Muxer {
+		return ts.NewMuxer(w)
+	})
+}
+
+// nopFlusher lets the FLV muxer write straight to the response; the handler flushes per packet
+type nopFlusher struct {
+	io.Writer
+}
+
+func (nopFlusher) Flush() error { return nil }
+
+// serveProgressive muxes a stream's packets into the response body until the client goes away,
+// starting with the cached GOP so playback begins at the latest keyframe
+func serveProgressive(c *gin.Context, streamManager *StreamManager, kind string, contentType string, newMuxer func(io.Writer) av.Muxer) {
+	cctvId := c.Param("cctvId")
+
+	if !ensureStream(c, streamManager, cctvId) {
+		return
+	}
+
+	clientID, packets, gop, err := streamManager.AddClientFromKeyframe(cctvId, kind)
+	if err != nil {
+		c.JSON(404, gin.H{"status": "error", "message": "Stream not found"})
+		return
+	}
+	defer streamManager.RemoveClient(cctvId, clientID)
+
+	streamManager.StartWorker(cctvId)
+
+	codecs, err := streamManager.GetCodecs(cctvId)
+	if err != nil {
+		log.Printf("Error getting codecs for CCTV ID %s: %v", cctvId, err)
+		c.JSON(503, gin.H{"status": "error", "message": "Stream not ready"})
+		return
+	}
+
+	tracks, indexes := mp4Tracks(codecs)
+	if len(tracks) == 0 {
+		c.JSON(406, gin.H{"status": "error", "message": "Stream has no compatible tracks"})
+		return
+	}
+
+	hasVideo := false
+	for _, codec := range tracks {
+		hasVideo = hasVideo || codec.Type().IsVideo()
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Cache-Control", "no-cache, no-store")
+	c.Status(200)
+
+	controller := http.NewResponseController(c.Writer)
+	controller.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+
+	muxer := newMuxer(c.Writer)
+	if err := muxer.WriteHeader(tracks); err != nil {
+		log.Printf("Error writing stream header for CCTV ID %s: %v", cctvId, err)
+		return
+	}
+	c.Writer.Flush()
+
+	// Timestamps are rebased so the output starts at zero with the first keyframe
+	started := !hasVideo
+	var base time.Duration
+	write := func(pkt av.Packet) error {
+		idx, ok := indexes[pkt.Idx]
+		if !ok {
+			return nil
+		}
+
+		if !started {
+			if !pkt.IsKeyFrame {
+				return nil
+			}
+			started = true
+			base = pkt.Time
+		}
+
+		pkt.Idx = idx
+		pkt.Time -= base
+		if pkt.Time < 0 {
+			pkt.Time = 0
+		}
+
+		controller.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+		if err := muxer.WritePacket(pkt); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	for _, pkt := range gop {
+		if err := write(pkt); err != nil {
+			return
+		}
+	}
+
+	noVideoTimer := time.NewTimer(viewerNoVideoTimeout)
+	defer noVideoTimer.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+
+		case <-noVideoTimer.C:
+			log.Printf("Live client for CCTV ID %s stopping: no video", cctvId)
+			return
+
+		case pkt, ok := <-packets:
+			if !ok {
+				return
+			}
+
+			if pkt.IsKeyFrame || !hasVideo {
+				noVideoTimer.Reset(viewerNoVideoTimeout)
+			}
+
+			if err := write(pkt); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/gin-gonic/gin"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// Limits for WHEP signalling
+const (
+	whepMaxOfferSize     = 64 * 1024
+	whepGatheringTimeout = 10 * time.Second
+)
+
+// webrtcSession is one WHEP viewer: a peer connection fed from a viewer channel
+type webrtcSession struct {
+	id        string
+	streamID  string
+	clientID  string
+	pc        *webrtc.PeerConnection
+	tracks    map[int8]*webrtcTrack
+	connected chan struct{}
+	done      chan struct{}
+	connOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// webrtcTrack is an outgoing track and the codec of the source stream it carries
+type webrtcTrack struct {
+	codec    av.CodecData
+	track    *webrtc.TrackLocalStaticSample
+	lastTime time.Duration
+}
+
+// webrtcSessions holds active WHEP sessions for all streams
+type webrtcSessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*webrtcSession
+}
+
+// errWebRTCOffer marks negotiation failures caused by the client's offer
+var errWebRTCOffer = errors.New("webrtc invalid offer")
+
+var (
+	webrtcAPIOnce sync.Once
+	webrtcAPI     *webrtc.API
+	webrtcAPIErr  error
+)
+
+// PlayWebRTC handles WHEP offers: it answers the SDP and starts forwarding packets as RTP
+func PlayWebRTC(c *gin.Context, streamManager *StreamManager) {
+	cctvId := c.Param("cctvId")
+
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if mediaType != "application/sdp" {
+		c.JSON(415, gin.H{"status": "error", "message": "Content-Type must be application/sdp"})
+		return
+	}
+
+	offer, err := io.ReadAll(io.LimitReader(c.Request.Body, whepMaxOfferSize))
+	if err != nil || len(offer) == 0 {
+		c.JSON(400, gin.H{"status": "error", "message": "Missing SDP offer"})
+		return
+	}
+
+	if !ensureStream(c, streamManager, cctvId) {
+		return
+	}
+
+	// Register as a viewer before starting so on-demand workers keep running
+	clientID, packets, err := streamManager.AddClient(cctvId, ViewerWebRTC)
+	if err != nil {
+		c.JSON(404, gin.H{"status": "error", "message": "Stream not found"})
+		return
+	}
+
+	streamManager.StartWorker(cctvId)
+
+	codecs, err := streamManager.GetCodecs(cctvId)
+	if err != nil {
+		streamManager.RemoveClient(cctvId, clientID)
+		log.Printf("Error getting codecs for CCTV ID %s: %v", cctvId, err)
+		c.JSON(503, gin.H{"status": "error", "message": "Stream not ready"})
+		return
+	}
+
+	session, answer, err := newWebRTCSession(cctvId, clientID, codecs, string(offer))
+	if err != nil {
+		streamManager.RemoveClient(cctvId, clientID)
+		log.Printf("Error creating WebRTC session for CCTV ID %s: %v", cctvId, err)
+
+		switch {
+		case errors.Is(err, configs.ErrWebRTCNoTracks):
+			c.JSON(406, gin.H{"status": "error", "message": "Stream has no WebRTC compatible tracks"})
+		case errors.Is(err, errWebRTCOffer):
+			c.JSON(400, gin.H{"status": "error", "message": "Invalid SDP offer"})
+		default:
+			c.JSON(500, gin.H{"status": "error", "message": "Failed to create WebRTC session"})
+		}
+		return
+	}
+
+	streamManager.whep.mutex.Lock()
+	streamManager.whep.sessions[session.id] = session
+	streamManager.whep.mutex.Unlock()
+
+	go streamManager.runWebRTCSession(session, packets)
+
+	c.Header("Location", "/play/webrtc/"+cctvId+"/"+session.id)
+	c.Data(201, "application/sdp", []byte(answer))
+}
+
+// StopWebRTC handles WHEP session teardown (DELETE on the resource URL)
+func StopWebRTC(c *gin.Context, streamManager *StreamManager) {
+	if err := streamManager.CloseWebRTCSession(c.Param("cctvId"), c.Param("sessionId")); err != nil {
+		c.JSON(404, gin.H{"status": "error", "message": "Session not found"})
+		return
+	}
+
+	c.Status(200)
+}
+
+// CloseWebRTCSession ends a WHEP session of a stream
+func (sm *StreamManager) CloseWebRTCSession(streamID, sessionID string) error {
+	sm.whep.mutex.Lock()
+	session, exists := sm.whep.sessions[sessionID]
+	sm.whep.mutex.Unlock()
+
+	if !exists || session.streamID != streamID {
+		return configs.ErrWebRTCSessionNotFound
+	}
+
+	session.close()
+	return nil
+}
+
+// newWebRTCSession creates a peer connection with one track per supported codec and answers the offer.
+// ICE candidates are gathered up front so the answer is complete (no trickle ICE).
+func newWebRTCSession(streamID, clientID string, codecs []av.CodecData, offer string) (*webrtcSession, string, error) {
+	api, err := getWebRTCAPI()
+	if err != nil {
+		return nil, "", err
+	}
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICEServers: webrtcICEServers()})
+	if err != nil {
+		return nil, "", err
+	}
+
+	session := &webrtcSession{
+		id:        generateUUID(),
+		streamID:  streamID,
+		clientID:  clientID,
+		pc:        pc,
+		tracks:    make(map[int8]*webrtcTrack),
+		connected: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	answer, err := session.negotiate(codecs, offer)
+	if err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+
+	return session, answer, nil
+}
+
+// negotiate adds the tracks, applies the offer and returns the gathered answer
+func (s *webrtcSession) negotiate(codecs []av.CodecData, offer string) (string, error) {
+	for i, codec := range codecs {
+		capability, ok := webrtcCapability(codec)
+		if !ok {
+			continue
+		}
+
+		track, err := webrtc.NewTrackLocalStaticSample(capability, codec.Type().String(), s.streamID)
+		if err != nil {
+			return "", err
+		}
+
+		sender, err := s.pc.AddTrack(track)
+		if err != nil {
+			return "", err
+		}
+
+		// RTCP has to be read for interceptors (NACK, reports) to work
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+
+		s.tracks[int8(i)] = &webrtcTrack{codec: codec, track: track}
+	}
+
+	if len(s.tracks) == 0 {
+		return "", configs.ErrWebRTCNoTracks
+	}
+
+	s.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			s.connOnce.Do(func() { close(s.connected) })
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			s.close()
+		}
+	})
+
+	if err := s.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", errors.Join(errWebRTCOffer, err)
+	}
+
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return "", errors.Join(errWebRTCOffer, err)
+	}
+
+	gathered := webrtc.GatheringCompletePromise(s.pc)
+	if err := s.pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+
+	select {
+	case <-gathered:
+	case <-time.After(whepGatheringTimeout):
+		return "", errors.New("webrtc ice gathering timeout")
+	}
+
+	return s.pc.LocalDescription().SDP, nil
+}
+
+// close signals the session to stop; the forwarding goroutine releases the resources
+func (s *webrtcSession) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// runWebRTCSession forwards packets to the peer from the first keyframe after it connects
+func (sm *StreamManager) runWebRTCSession(s *webrtcSession, packets chan av.Packet) {
+	defer func() {
+		sm.whep.mutex.Lock()
+		delete(sm.whep.sessions, s.id)
+		sm.whep.mutex.Unlock()
+
+		sm.RemoveClient(s.streamID, s.clientID)
+		s.pc.Close()
+	}()
+
+	hasVideo := false
+	for _, t := range s.tracks {
+		hasVideo = hasVideo || t.codec.Type().IsVideo()
+	}
+
+	noVideoTimer := time.NewTimer(viewerNoVideoTimeout)
+	defer noVideoTimer.Stop()
+
+	connectedCh := s.connected
+	connected := false
+	started := !hasVideo
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case <-connectedCh:
+			connected = true
+			connectedCh = nil
+
+		case <-noVideoTimer.C:
+			log.Printf("WebRTC client for CCTV ID %s stopping: no video", s.streamID)
+			return
+
+		case pkt, ok := <-packets:
+			if !ok {
+				return
+			}
+
+			t, ok := s.tracks[pkt.Idx]
+			if !ok {
+				continue
+			}
+
+			if pkt.IsKeyFrame || !hasVideo {
+				noVideoTimer.Reset(viewerNoVideoTimeout)
+			}
+
+			// Drop everything until ICE/DTLS is up, then start decoding at a keyframe
+			if !connected {
+				continue
+			}
+			if !started {
+				if !pkt.IsKeyFrame {
+					continue
+				}
+				started = true
+			}
+
+			if err := t.writePacket(pkt); err != nil {
+				log.Printf("Error writing WebRTC sample for CCTV ID %s: %v", s.streamID, err)
+				return
+			}
+		}
+	}
+}
+
+// writePacket converts a packet to a media sample; H.264 is sent as Annex B with SPS/PPS ahead of keyframes
+func (t *webrtcTrack) writePacket(pkt av.Packet) error {
+	duration := pkt.Duration
+	if duration <= 0 && t.lastTime > 0 && pkt.Time > t.lastTime {
+		duration = pkt.Time - t.lastTime
+	}
+	t.lastTime = pkt.Time
+
+	return t.track.WriteSample(media.Sample{Data: annexBPayload(t.codec, pkt), Duration: duration})
+}
+
+// annexBPayload returns a video packet as Annex B with the parameter sets ahead of keyframes; other packets are unchanged
+func annexBPayload(codec av.CodecData, pkt av.Packet) []byte {
+	var params [][]byte
+	switch codec := codec.(type) {
+	case h264parser.CodecData:
+		params = [][]byte{codec.SPS(), codec.PPS()}
+	case h265parser.CodecData:
+		params = [][]byte{codec.VPS(), codec.SPS(), codec.PPS()}
+	default:
+		return pkt.Data
+	}
+
+	nalus, _ := h264parser.SplitNALUs(pkt.Data)
+	if pkt.IsKeyFrame {
+		nalus = append(params, nalus...)
+	}
+
+	var buf bytes.Buffer
+	for _, nalu := range nalus {
+		buf.Write(h264parser.StartCodeBytes)
+		buf.Write(nalu)
+	}
+	return buf.Bytes()
+}
+
+// webrtcCapability maps a source codec to its RTP capability; AAC and H.265 cannot be sent without transcoding
+func webrtcCapability(codec av.CodecData) (webrtc.RTPCodecCapability, bool) {
+	switch codec.Type() {
+	case av.H264:
+		// Advertise the camera's profile so the matching payload type is picked from the offer
+		profile := "42e01f"
+		if sps := codec.(h264parser.CodecData).SPS(); len(sps) >= 4 {
+			profile = fmt.Sprintf("%02x%02x%02x", sps[1], sps[2], sps[3])
+		}
+		return webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+		}, true
+	case av.OPUS:
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, true
+	case av.PCM_ALAW:
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, true
+	case av.PCM_MULAW:
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, true
+	}
+
+	return webrtc.RTPCodecCapability{}, false
+}
+
+// getWebRTCAPI builds the shared pion API with the default codecs and interceptors once
+func getWebRTCAPI() (*webrtc.API, error) {
+	webrtcAPIOnce.Do(func() {
+		mediaEngine := &webrtc.MediaEngine{}
+		if webrtcAPIErr = mediaEngine.RegisterDefaultCodecs(); webrtcAPIErr != nil {
+			return
+		}
+
+		registry := &interceptor.Registry{}
+		if webrtcAPIErr = webrtc.RegisterDefaultInterceptors(mediaEngine, registry); webrtcAPIErr != nil {
+			return
+		}
+
+		settings := webrtc.SettingEngine{}
+		portMin := configs.GlobalConfig.WebrtcUdpPortMin
+		portMax := configs.GlobalConfig.WebrtcUdpPortMax
+		if portMin > 0 && portMax >= portMin {
+			if webrtcAPIErr = settings.SetEphemeralUDPPortRange(uint16(portMin), uint16(portMax)); webrtcAPIErr != nil {
+				return
+			}
+		}
+		if ips := splitList(configs.GlobalConfig.WebrtcPublicIPs); len(ips) > 0 {
+			settings.SetNAT1To1IPs(ips, webrtc.ICECandidateTypeHost)
+		}
+
+		webrtcAPI = webrtc.NewAPI(
+			webrtc.WithMediaEngine(mediaEngine),
+			webrtc.WithInterceptorRegistry(registry),
+			webrtc.WithSettingEngine(settings),
+		)
+	})
+
+	return webrtcAPI, webrtcAPIErr
+}
+
+// webrtcICEServers returns the configured STUN/TURN servers; none means host candidates only
+func webrtcICEServers() []webrtc.ICEServer {
+	urls := splitList(configs.GlobalConfig.WebrtcIceServers)
+	if len(urls) == 0 {
+		return nil
+	}
+
+	return []webrtc.ICEServer{{
+		URLs:       urls,
+		Username:   configs.GlobalConfig.WebrtcIceUsername,
+		Credential: configs.GlobalConfig.WebrtcIceCredential,
+	}}
+}
+
+// splitList splits a comma separated setting, dropping empty entries
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
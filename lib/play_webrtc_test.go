@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
+)
+
+// feedWebRTCStream broadcasts 25 fps H.264 with a keyframe every second and 20 ms Opus frames until stop closes
+func feedWebRTCStream(sm *StreamManager, id string, stop chan struct{}) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	keyframe := []byte{0, 0, 0, 4, 0x65, 0x88, 0x84, 0x00}
+	frame := []byte{0, 0, 0, 4, 0x41, 0x9a, 0x02, 0x00}
+	opus := []byte{0xfc, 0xff, 0xfe}
+
+	for tick := 0; ; tick++ {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Duration(tick) * 20 * time.Millisecond
+		sm.BroadcastPacket(id, av.Packet{Idx: 1, Time: now, Duration: 20 * time.Millisecond, Data: opus})
+
+		if tick%2 == 0 {
+			video := av.Packet{Idx: 0, Time: now, Duration: 40 * time.Millisecond, Data: frame}
+			if tick%50 == 0 {
+				video.IsKeyFrame = true
+				video.Data = keyframe
+			}
+			sm.BroadcastPacket(id, video)
+		}
+	}
+}
+
+func TestPlayWebRTC(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const id = "cam1"
+	sm := NewStreamManager()
+	sm.AddStream(id, "rtmp://publisher", false)
+
+	// A pushed stream has no worker to start, so the test feeds the packets itself
+	if err := sm.SetRTMPSource(id, "key"); err != nil {
+		t.Fatal(err)
+	}
+	sm.UpdateCodecs(id, []av.CodecData{testH264(t), codec.NewOpusCodecData(48000, av.CH_STEREO)})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go feedWebRTCStream(sm, id, stop)
+
+	router := gin.New()
+	router.POST("/play/webrtc/:cctvId", func(c *gin.Context) {
+		PlayWebRTC(c, sm)
+	})
+	router.DELETE("/play/webrtc/:cctvId/:sessionId", func(c *gin.Context) {
+		StopWebRTC(c, sm)
+	})
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// The viewer receives one video and one audio track
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mutex sync.Mutex
+	received := make(map[string]bool)
+	bothReceived := make(chan struct{})
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err != nil {
+			return
+		}
+
+		mutex.Lock()
+		received[track.Codec().MimeType] = true
+		if len(received) == 2 {
+			close(bothReceived)
+		}
+		mutex.Unlock()
+
+		// Keep draining so the sender is never blocked
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+		}
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	resp, err := http.Post(server.URL+"/play/webrtc/"+id, "application/sdp", strings.NewReader(pc.LocalDescription().SDP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("POST offer = %d %s, want 201", resp.StatusCode, answer)
+	}
+
+	location := resp.Header.Get("Location")
+	if !strings.HasPrefix(location, "/play/webrtc/"+id+"/") {
+		t.Fatalf("Location = %q", location)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-bothReceived:
+	case <-time.After(15 * time.Second):
+		mutex.Lock()
+		defer mutex.Unlock()
+		t.Fatalf("timed out waiting for RTP, received %v", received)
+	}
+
+	mutex.Lock()
+	if !received[webrtc.MimeTypeH264] || !received[webrtc.MimeTypeOpus] {
+		t.Fatalf("received %v, want H264 and opus", received)
+	}
+	mutex.Unlock()
+
+	// DELETE on the resource URL ends the session and releases the viewer
+	req, _ := http.NewRequest("DELETE", server.URL+location, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("DELETE session = %d, want 200", resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sm.whep.mutex.Lock()
+		sessions := len(sm.whep.sessions)
+		sm.whep.mutex.Unlock()
+
+		sm.mutex.RLock()
+		viewers := len(sm.Streams[id].Clients)
+		sm.mutex.RUnlock()
+
+		if sessions == 0 && viewers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after DELETE: %d sessions, %d viewers, want none", sessions, viewers)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// The session is gone, so a second DELETE is a 404
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Fatalf("second DELETE = %d, want 404", resp.StatusCode)
+	}
+}
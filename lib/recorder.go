@@ -0,0 +1,377 @@
+package lib
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/deepch/vdk/format/ts"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// Recording file layout: <dir>/<stream>/<YYYY-MM-DD>/<HH>/<start>_<durationMs>.<format>, times in UTC
+const (
+	recordingTimeLayout = "20060102T150405Z"
+	recordingSuffix     = ".recording"
+)
+
+// Recorder writes a stream's packets into rolling files on disk
+type Recorder struct {
+	mutex     sync.Mutex
+	streamID  string
+	dir       string
+	format    string
+	rollAfter time.Duration
+
+	file      *os.File
+	writer    *bufio.Writer
+	muxer     av.Muxer
+	path      string
+	indexes   map[int8]int8
+	audioOnly bool
+	fileStart time.Time
+	firstTS   time.Duration
+	lastTS    time.Duration
+	closed    bool
+}
+
+// NewRecorder creates a recorder for a stream using the global recording settings
+func NewRecorder(streamID string) *Recorder {
+	format := configs.GlobalConfig.RecordFormat
+	if format != "mp4" {
+		format = "ts"
+	}
+
+	rollAfter := time.Duration(configs.GlobalConfig.RecordSegmentSeconds) * time.Second
+	if rollAfter <= 0 {
+		rollAfter = time.Minute
+	}
+
+	return &Recorder{
+		streamID:  streamID,
+		dir:       filepath.Join(configs.GlobalConfig.RecordDir, safePathComponent(streamID)),
+		format:    format,
+		rollAfter: rollAfter,
+	}
+}
+
+// WritePacket appends a packet to the current file, rolling over on keyframes after the file duration or hour boundary
+func (r *Recorder) WritePacket(pkt av.Packet, codecs []av.CodecData) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// A packet may still be in flight from the worker after recording was disabled
+	if r.closed || len(codecs) == 0 {
+		return
+	}
+
+	boundary := pkt.IsKeyFrame || r.audioOnly
+	if r.file != nil && boundary {
+		now := time.Now().UTC()
+		if pkt.Time-r.firstTS >= r.rollAfter || now.Hour() != r.fileStart.Hour() {
+			r.closeFile()
+		}
+	}
+
+	if r.file == nil {
+		// Files must start on a keyframe to be playable on their own
+		audioOnly := len(codecs) == 1 && codecs[0].Type().IsAudio()
+		if !pkt.IsKeyFrame && !audioOnly {
+			return
+		}
+		if err := r.openFile(codecs, pkt.Time); err != nil {
+			log.Printf("[%s] Error opening recording file: %v", r.streamID, err)
+			return
+		}
+	}
+
+	idx, ok := r.indexes[pkt.Idx]
+	if !ok {
+		return
+	}
+
+	// Rebase timestamps so every file starts at zero
+	pkt.Idx = idx
+	pkt.Time -= r.firstTS
+	if pkt.Time < 0 {
+		pkt.Time = 0
+	}
+
+	if err := r.muxer.WritePacket(pkt); err != nil {
+		log.Printf("[%s] Error writing recording packet: %v", r.streamID, err)
+		r.closeFile()
+		return
+	}
+	r.lastTS = pkt.Time
+}
+
+// Reset finalizes the current file so the next keyframe starts a new one, used on codec changes and reconnects
+func (r *Recorder) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closeFile()
+}
+
+// openFile starts a new recording file; caller must hold the mutex
+func (r *Recorder) openFile(codecs []av.CodecData, firstTS time.Duration) error {
+	now := time.Now().UTC()
+	dir := filepath.Join(r.dir, now.Format("2006-01-02"), now.Format("15"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, now.Format(recordingTimeLayout)+"."+r.format+recordingSuffix)
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	tracks := codecs
+	r.indexes = make(map[int8]int8)
+	if r.format == "mp4" {
+		tracks, r.indexes = mp4Tracks(codecs)
+	} else {
+		for i := range codecs {
+			r.indexes[int8(i)] = int8(i)
+		}
+	}
+
+	var muxer av.Muxer
+	var writer *bufio.Writer
+	if r.format == "mp4" {
+		mp4Muxer := mp4.NewMuxer(file)
+		mp4Muxer.NegativeTsMakeZero = true
+		muxer = mp4Muxer
+	} else {
+		writer = bufio.NewWriterSize(file, 256*1024)
+		muxer = ts.NewMuxer(writer)
+	}
+
+	if err := muxer.WriteHeader(tracks); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+
+	r.file = file
+	r.writer = writer
+	r.muxer = muxer
+	r.path = path
+	r.audioOnly = len(codecs) == 1 && codecs[0].Type().IsAudio()
+	r.fileStart = now
+	r.firstTS = firstTS
+	r.lastTS = 0
+
+	return nil
+}
+
+// closeFile finalizes the current file and renames it with its duration; caller must hold the mutex
+func (r *Recorder) closeFile() {
+	if r.file == nil {
+		return
+	}
+
+	if err := r.muxer.WriteTrailer(); err != nil {
+		log.Printf("[%s] Error writing recording trailer: %v", r.streamID, err)
+	}
+	if r.writer != nil {
+		r.writer.Flush()
+	}
+	r.file.Close()
+
+	final := strings.TrimSuffix(r.path, "."+r.format+recordingSuffix) +
+		"_" + strconv.FormatInt(r.lastTS.Milliseconds(), 10) + "." + r.format
+	if err := os.Rename(r.path, final); err != nil {
+		log.Printf("[%s] Error finalizing recording %s: %v", r.streamID, r.path, err)
+	}
+
+	r.file = nil
+	r.writer = nil
+	r.muxer = nil
+	r.path = ""
+}
+
+// Close finalizes the current file and stops recording
+func (r *Recorder) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closeFile()
+	r.closed = true
+}
+
+// SetRecording enables or disables continuous recording for a stream
+func (sm *StreamManager) SetRecording(id string, enabled bool) error {
+	sm.mutex.Lock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		sm.mutex.Unlock()
+		return configs.ErrStreamNotFound
+	}
+
+	stream.Record = enabled
+
+	var stopped *Recorder
+	if enabled && stream.recorder == nil {
+		stream.recorder = NewRecorder(id)
+		sm.events.publish(Event{Type: EventRecordingStarted, StreamID: id})
+	} else if !enabled && stream.recorder != nil {
+		stopped = stream.recorder
+		stream.recorder = nil
+		sm.events.publish(Event{Type: EventRecordingStopped, StreamID: id})
+	}
+	sm.mutex.Unlock()
+
+	if stopped != nil {
+		stopped.Close()
+	}
+
+	// Recording needs ingest even for on-demand streams without viewers
+	if enabled {
+		sm.StartWorker(id)
+	}
+
+	return nil
+}
+
+// IsRecording reports whether continuous recording is enabled for a stream
+func (sm *StreamManager) IsRecording(id string) bool {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	stream, exists := sm.Streams[id]
+	return exists && stream.recorder != nil
+}
+
+// RecordPacket hands a packet to the stream's recorder, if recording is enabled
+func (sm *StreamManager) RecordPacket(id string, pkt av.Packet) {
+	sm.mutex.RLock()
+	stream, exists := sm.Streams[id]
+	if !exists || stream.recorder == nil {
+		sm.mutex.RUnlock()
+		return
+	}
+	recorder := stream.recorder
+	codecs := stream.Codecs
+	sm.mutex.RUnlock()
+
+	recorder.WritePacket(pkt, codecs)
+}
+
+// ResetRecording finalizes the stream's current recording file
+func (sm *StreamManager) ResetRecording(id string) {
+	sm.mutex.RLock()
+	stream, exists := sm.Streams[id]
+	if !exists || stream.recorder == nil {
+		sm.mutex.RUnlock()
+		return
+	}
+	recorder := stream.recorder
+	sm.mutex.RUnlock()
+
+	recorder.Reset()
+}
+
+// RecordingRetention periodically prunes recordings by age and total disk usage
+type RecordingRetention struct {
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// StartRecordingRetention launches the retention janitor for the recording directory
+func StartRecordingRetention() *RecordingRetention {
+	retention := &RecordingRetention{
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+
+	go retention.loop()
+	return retention
+}
+
+// Stop ends the retention janitor
+func (r *RecordingRetention) Stop() {
+	close(r.stopChan)
+	<-r.doneChan
+}
+
+// loop prunes once a minute until stopped
+func (r *RecordingRetention) loop() {
+	defer close(r.doneChan)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		maxAge := time.Duration(configs.GlobalConfig.RecordRetentionHours) * time.Hour
+		maxBytes := int64(configs.GlobalConfig.RecordMaxDiskMB) * 1024 * 1024
+		pruneRecordings(configs.GlobalConfig.RecordDir, maxAge, maxBytes)
+
+		select {
+		case <-r.stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordingFile is a finalized recording found on disk
+type recordingFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// pruneRecordings deletes finalized recordings older than maxAge, then the oldest ones until under maxBytes.
+// A zero limit disables that rule; files still being written are never touched.
+func pruneRecordings(root string, maxAge time.Duration, maxBytes int64) {
+	var files []recordingFile
+	var total int64
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, recordingSuffix) {
+			return nil
+		}
+		files = append(files, recordingFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	now := time.Now()
+	for _, file := range files {
+		expired := maxAge > 0 && now.Sub(file.modTime) > maxAge
+		overBudget := maxBytes > 0 && total > maxBytes
+		if !expired && !overBudget {
+			break
+		}
+
+		if err := os.Remove(file.path); err != nil {
+			log.Printf("Error removing recording %s: %v", file.path, err)
+			continue
+		}
+		total -= file.size
+
+		// Drop the hour and date directories once they are empty
+		dir := filepath.Dir(file.path)
+		for i := 0; i < 2 && dir != root; i++ {
+			if os.Remove(dir) != nil {
+				break
+			}
+			dir = filepath.Dir(dir)
+		}
+	}
+}
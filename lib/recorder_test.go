@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPruneRecordings(t *testing.T) {
+	// Files are listed oldest first; age is how long ago each was last written
+	type file struct {
+		name string
+		size int
+		age  time.Duration
+	}
+
+	files := []file{
+		{"2026-10-14/08/20261014T080000Z_60000.ts", 100, 50 * time.Hour},
+		{"2026-10-15/09/20261015T090000Z_60000.ts", 100, 26 * time.Hour},
+		{"2026-10-16/10/20261016T100000Z_60000.ts", 100, 2 * time.Hour},
+		{"2026-10-16/11/20261016T110000Z_60000.ts", 100, time.Hour},
+		{"2026-10-16/12/20261016T120000Z.ts.recording", 500, 100 * time.Hour},
+	}
+
+	tests := []struct {
+		name     string
+		maxAge   time.Duration
+		maxBytes int64
+		want     []string
+	}{
+		{
+			name: "no limits",
+			want: []string{files[0].name, files[1].name, files[2].name, files[3].name, files[4].name},
+		},
+		{
+			name:   "age limit",
+			maxAge: 24 * time.Hour,
+			want:   []string{files[2].name, files[3].name, files[4].name},
+		},
+		{
+			name:     "size limit",
+			maxBytes: 250,
+			want:     []string{files[2].name, files[3].name, files[4].name},
+		},
+		{
+			name:     "both limits",
+			maxAge:   48 * time.Hour,
+			maxBytes: 150,
+			want:     []string{files[3].name, files[4].name},
+		},
+		{
+			name:     "files in progress are never removed",
+			maxAge:   time.Minute,
+			maxBytes: 1,
+			want:     []string{files[4].name},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			now := time.Now()
+			for _, f := range files {
+				path := filepath.Join(root, f.name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, make([]byte, f.size), 0644); err != nil {
+					t.Fatal(err)
+				}
+				modTime := now.Add(-f.age)
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pruneRecordings(root, tt.maxAge, tt.maxBytes)
+
+			var got []string
+			filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					rel, _ := filepath.Rel(root, path)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("remaining = %v, want %v", got, tt.want)
+			}
+
+			// Emptied hour directories are removed with their last file
+			for _, f := range files {
+				if slices.Contains(got, f.name) {
+					continue
+				}
+				if _, err := os.Stat(filepath.Join(root, filepath.Dir(f.name))); !os.IsNotExist(err) {
+					t.Fatalf("directory of %s was not removed", f.name)
+				}
+			}
+		})
+	}
+}
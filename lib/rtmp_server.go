@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/format/rtmp"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// rtmpReadTimeout drops publishers that stop sending media
+const rtmpReadTimeout = 20 * time.Second
+
+// rtmpApp is the RTMP application publishers push to: rtmp://host/live/<id>?key=<publish key>
+const rtmpApp = "live"
+
+// RTMPServer accepts RTMP publishers and feeds their media into managed streams
+type RTMPServer struct {
+	manager *StreamManager
+	server  *rtmp.Server
+	mutex   sync.Mutex
+	active  map[*rtmpPublisher]struct{}
+	closed  bool
+}
+
+// rtmpPublisher is one connected publisher feeding a stream
+type rtmpPublisher struct {
+	conn     *rtmp.Conn
+	doneChan chan struct{}
+}
+
+// NewRTMPServer prepares an RTMP ingest server on the configured port
+func NewRTMPServer(manager *StreamManager) *RTMPServer {
+	s := &RTMPServer{
+		manager: manager,
+		active:  make(map[*rtmpPublisher]struct{}),
+	}
+
+	s.server = &rtmp.Server{
+		Addr:          ":" + configs.GlobalConfig.RtmpServerPort,
+		HandlePublish: s.handlePublish,
+	}
+
+	return s
+}
+
+// ListenAndServe accepts publishers until the process exits
+func (s *RTMPServer) ListenAndServe() error {
+	return s.server.ListenAndServe()
+}
+
+// Stop disconnects every publisher and refuses new ones.
+// The vdk listener cannot be closed, so it keeps accepting connections until the process exits.
+func (s *RTMPServer) Stop() {
+	s.mutex.Lock()
+	s.closed = true
+	publishers := make([]*rtmpPublisher, 0, len(s.active))
+	for p := range s.active {
+		publishers = append(publishers, p)
+	}
+	s.mutex.Unlock()
+
+	for _, p := range publishers {
+		p.Stop()
+	}
+}
+
+// Stop closes the publisher's connection and waits until its media loop has exited
+func (p *rtmpPublisher) Stop() {
+	p.conn.Close()
+	<-p.doneChan
+}
+
+// handlePublish validates the stream and key, then runs the publisher's media through the ingest pipeline
+func (s *RTMPServer) handlePublish(conn *rtmp.Conn) {
+	defer conn.Close()
+
+	streamID, key := rtmpStreamPath(conn)
+	remote := conn.NetConn().RemoteAddr().String()
+
+	if err := s.manager.checkPublishKey(streamID, key); err != nil {
+		log.Printf("RTMP publish to %q from %s refused: %v", streamID, remote, err)
+		return
+	}
+
+	publisher := &rtmpPublisher{conn: conn, doneChan: make(chan struct{})}
+	defer close(publisher.doneChan)
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.active[publisher] = struct{}{}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.active, publisher)
+		s.mutex.Unlock()
+	}()
+
+	if err := s.manager.attachPublisher(streamID, publisher); err != nil {
+		log.Printf("RTMP publish to %s from %s refused: %v", streamID, remote, err)
+		return
+	}
+	defer s.manager.detachPublisher(streamID, publisher)
+
+	log.Printf("[%s] RTMP publisher connected from %s", streamID, remote)
+	s.manager.setStreamState(streamID, StreamStateLive, nil)
+	s.manager.events.publish(Event{Type: EventStreamConnected, StreamID: streamID})
+	err := s.readPackets(conn, streamID)
+	log.Printf("[%s] RTMP publisher disconnected: %v", streamID, err)
+	s.manager.setStreamState(streamID, StreamStateIdle, err)
+	s.manager.events.publish(Event{Type: EventStreamDisconnected, StreamID: streamID, Error: errorString(err)})
+
+	// Finalize the recording file so the next publisher starts a clean one
+	s.manager.ResetRecording(streamID)
+}
+
+// readPackets feeds the publisher's codecs and packets into the stream until the connection ends
+func (s *RTMPServer) readPackets(conn *rtmp.Conn, streamID string) error {
+	conn.NetConn().SetReadDeadline(time.Now().Add(rtmpReadTimeout))
+
+	codecs, err := conn.Streams()
+	if err != nil {
+		return err
+	}
+
+	ingest := newPacketIngest(s.manager, streamID)
+	ingest.setCodecs(codecs)
+
+	for {
+		conn.NetConn().SetReadDeadline(time.Now().Add(rtmpReadTimeout))
+
+		packet, err := conn.ReadPacket()
+		if err != nil {
+			return err
+		}
+
+		ingest.writePacket(&packet)
+	}
+}
+
+// rtmpStreamPath extracts the stream ID and publish key from a publish URL; other applications yield no ID
+func rtmpStreamPath(conn *rtmp.Conn) (string, string) {
+	if conn.URL == nil {
+		return "", ""
+	}
+
+	app, streamID, found := strings.Cut(strings.Trim(conn.URL.Path, "/"), "/")
+	if !found || app != rtmpApp || strings.Contains(streamID, "/") {
+		return "", ""
+	}
+
+	return streamID, conn.URL.Query().Get("key")
+}
+
+// SetRTMPSource turns a stream into an RTMP pushed stream; an empty key falls back to the global publish key
+func (sm *StreamManager) SetRTMPSource(id string, publishKey string) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return configs.ErrStreamNotFound
+	}
+
+	stream.Source = SourceRTMP
+	stream.OnDemand = false
+	stream.PublishKey = publishKey
+
+	return nil
+}
+
+// checkPublishKey verifies a publisher may push to a stream; publishing without any configured key is refused
+func (sm *StreamManager) checkPublishKey(id string, key string) error {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return configs.ErrStreamNotFound
+	}
+	if stream.Source != SourceRTMP {
+		return configs.ErrStreamPushSource
+	}
+
+	expected := stream.PublishKey
+	if expected == "" {
+		expected = configs.GlobalConfig.RtmpPublishKey
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(key), []byte(expected)) != 1 {
+		return configs.ErrPublishKeyInvalid
+	}
+
+	return nil
+}
+
+// attachPublisher registers the publisher feeding a stream; only one may publish at a time
+func (sm *StreamManager) attachPublisher(id string, publisher *rtmpPublisher) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return configs.ErrStreamNotFound
+	}
+
+	if _, publishing := sm.publishers[id]; publishing {
+		return configs.ErrStreamAlreadyPublishing
+	}
+
+	sm.publishers[id] = publisher
+	stream.RunLock = true
+	return nil
+}
+
+// detachPublisher unregisters a publisher that disconnected
+func (sm *StreamManager) detachPublisher(id string, publisher *rtmpPublisher) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if current, exists := sm.publishers[id]; exists && current == publisher {
+		delete(sm.publishers, id)
+	}
+
+	if stream, exists := sm.Streams[id]; exists {
+		if _, publishing := sm.publishers[id]; !publishing {
+			stream.RunLock = false
+		}
+	}
+}
@@ -0,0 +1,1250 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// Limits for pulling RTSP
+const (
+	rtspClientMaxFrameSize = 8 * 1024 * 1024
+	rtspClientUDPBuffer    = 2 * 1024 * 1024
+
+	// rtspClientSyncWait is how long Open keeps reading for RTCP sender reports before aligning tracks by arrival
+	rtspClientSyncWait = 2 * time.Second
+)
+
+// errRTSPUnsupportedTransport is returned when the server refuses the requested transport with 461
+var errRTSPUnsupportedTransport = errors.New("rtsp transport not supported by server")
+
+// rtspClient pulls RTSP over TCP interleaved or UDP
+type rtspClient struct {
+	sourceFeed
+	rawURL       string
+	options      RTSPOptions
+	url          *url.URL
+	username     string
+	password     string
+	conn         net.Conn
+	reader       *bufio.Reader
+	writeMutex   sync.Mutex
+	cseq         int
+	session      string
+	keepalive    time.Duration
+	keepaliveAt  time.Time
+	control      string
+	realm        string
+	nonce        string
+	basic        bool
+	udp          bool
+	tracks       []*rtspClientTrack
+	udpPackets   chan rtspClientDatagram
+	udpErr       chan error
+	udpDone      chan struct{}
+	udpWG        sync.WaitGroup
+	pending      []*av.Packet
+	rtpInfo      bool
+	aligned      bool
+	anchor       *rtspClientTrack
+	codecMutex   sync.Mutex
+	codecs       []av.CodecData
+	codecChanges chan struct{}
+	lostPackets  atomic.Int64
+}
+
+// rtspClientTrack is one set-up media track and its depacketizer state
+type rtspClientTrack struct {
+	media     sdp.Media
+	idx       int8
+	clockRate uint32
+	channel   int
+	rtpConn   *net.UDPConn
+	rtcpConn  *net.UDPConn
+	serverIP  net.IP
+
+	// RTP sequence and timestamp tracking
+	started  bool
+	lastSeq  uint16
+	lastTS   uint32
+	extTS    int64
+	lastTime time.Duration
+
+	// Alignment to the other tracks; offset moves this track's timeline onto the first-arriving track's
+	synced   bool
+	syncTS   uint32
+	syncTime time.Duration
+	firstTS  uint32
+	firstAt  time.Time
+	offset   time.Duration
+
+	// Video access unit being assembled; broken drops it after packet loss
+	nalus     [][]byte
+	fragment  []byte
+	frameTS   uint32
+	frameTime time.Duration
+	keyFrame  bool
+	broken    bool
+	vps       []byte
+	sps       []byte
+	pps       []byte
+}
+
+// rtspClientDatagram is an RTP or RTCP packet received on a track's UDP ports
+type rtspClientDatagram struct {
+	track *rtspClientTrack
+	data  []byte
+	rtcp  bool
+}
+
+// rtspResponse is a parsed RTSP response
+type rtspResponse struct {
+	status int
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// newRTSPClient prepares an RTSP client for a URL
+func newRTSPClient(rawURL string, options RTSPOptions) *rtspClient {
+	return &rtspClient{
+		sourceFeed:   newSourceFeed(),
+		rawURL:       rawURL,
+		options:      options,
+		codecChanges: make(chan struct{}, 1),
+	}
+}
+
+// Open sets up the session and waits for the codecs; auto transport falls back to TCP when UDP fails
+func (c *rtspClient) Open() error {
+	switch c.options.Transport {
+	case RTSPTransportUDP:
+		return c.open(true)
+	case RTSPTransportAuto:
+		err := c.open(true)
+		if err == nil {
+			return nil
+		}
+		c.teardown()
+		c.reset()
+		return c.open(false)
+	}
+	return c.open(false)
+}
+
+// open runs OPTIONS, DESCRIBE, SETUP and PLAY, then reads until every track's codec is known
+func (c *rtspClient) open(udp bool) error {
+	u, err := url.Parse(c.rawURL)
+	if err != nil {
+		return err
+	}
+	c.username = u.User.Username()
+	c.password, _ = u.User.Password()
+	u.User = nil
+	if u.Port() == "" {
+		port := "554"
+		if u.Scheme == "rtsps" {
+			port = "322"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	c.url = u
+	c.control = u.String()
+	c.udp = udp
+
+	conn, err := net.DialTimeout("tcp", u.Host, c.options.dialTimeout())
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "rtsps" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: c.options.InsecureSkipVerify})
+		tlsConn.SetDeadline(time.Now().Add(c.options.dialTimeout()))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	// Some servers do not implement OPTIONS; only DESCRIBE decides whether the source is usable
+	c.request("OPTIONS", c.control, nil)
+
+	resp, err := c.request("DESCRIBE", c.control, map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return err
+	}
+	if base := resp.header.Get("Content-Base"); base != "" {
+		c.control = base
+	}
+
+	_, medias := sdp.Parse(string(resp.body))
+	for _, media := range medias {
+		if media.AVType == "audio" && c.options.DisableAudio {
+			continue
+		}
+		if err := c.setupTrack(media); err != nil {
+			return err
+		}
+	}
+	if len(c.tracks) == 0 {
+		return configs.ErrRTSPNoTracks
+	}
+
+	resp, err = c.request("PLAY", c.control, nil)
+	if err != nil {
+		return err
+	}
+	c.syncRTPInfo(resp.header.Get("RTP-Info"))
+
+	if c.udp {
+		c.udpPackets = make(chan rtspClientDatagram, 1024)
+		c.udpErr = make(chan error, 1)
+		c.udpDone = make(chan struct{})
+		for _, track := range c.tracks {
+			c.udpWG.Add(1)
+			go c.readUDP(track, c.udpPackets, c.udpDone)
+		}
+		c.udpWG.Add(1)
+		go c.drainControl(c.reader, c.udpErr)
+	}
+
+	// Video without sprop parameter sets in the SDP only becomes usable once they arrive in band,
+	// and UDP is only known to work once media gets through. Reading on briefly lets sender reports
+	// arrive so the tracks can be aligned exactly.
+	deadline := time.Now().Add(c.options.readTimeout())
+	syncDeadline := time.Now().Add(rtspClientSyncWait)
+	for !c.codecsReady() || (c.udp && !c.receiving()) || (!c.syncReady() && time.Now().Before(syncDeadline)) {
+		if time.Now().After(deadline) {
+			return configs.ErrStreamChannelCodecNotFound
+		}
+		packets, err := c.readPackets()
+		if err != nil {
+			return err
+		}
+		c.pending = append(c.pending, packets...)
+	}
+	c.alignTracks()
+
+	// Drop the pending flag set while waiting; the worker reads the codecs after Open
+	select {
+	case <-c.codecChanges:
+	default:
+	}
+
+	c.run(c.read)
+	return nil
+}
+
+// setupTrack adds a supported media and sets up its transport
+func (c *rtspClient) setupTrack(media sdp.Media) error {
+	codecData, ok := rtspClientCodec(media)
+	if !ok {
+		return nil
+	}
+
+	track := &rtspClientTrack{
+		media:     media,
+		idx:       int8(len(c.codecs)),
+		clockRate: uint32(media.TimeScale),
+		channel:   2 * len(c.tracks),
+	}
+	if track.clockRate == 0 {
+		track.clockRate = 8000
+		if media.AVType == "video" {
+			track.clockRate = 90000
+		}
+	}
+	if media.Type == av.H264 && len(media.SpropParameterSets) > 1 {
+		track.sps, track.pps = media.SpropParameterSets[0], media.SpropParameterSets[1]
+	}
+	if media.Type == av.H265 {
+		track.vps, track.sps, track.pps = media.SpropVPS, media.SpropSPS, media.SpropPPS
+	}
+
+	var transport string
+	if c.udp {
+		if err := track.listenUDP(); err != nil {
+			return err
+		}
+		rtpPort := track.rtpConn.LocalAddr().(*net.UDPAddr).Port
+		transport = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", rtpPort, rtpPort+1)
+	} else {
+		transport = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", track.channel, track.channel+1)
+	}
+
+	resp, err := c.request("SETUP", c.trackURL(media.Control), map[string]string{"Transport": transport})
+	if err != nil {
+		track.close()
+		return err
+	}
+
+	// Servers may pick their own interleaved channels
+	for _, field := range strings.Split(resp.header.Get("Transport"), ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		if key == "interleaved" && !c.udp {
+			first, _, _ := strings.Cut(value, "-")
+			if channel, err := strconv.Atoi(first); err == nil {
+				track.channel = channel
+			}
+		}
+	}
+	if c.udp {
+		track.serverIP = rtspHostIP(c.conn.RemoteAddr())
+	}
+
+	c.tracks = append(c.tracks, track)
+	c.codecs = append(c.codecs, codecData)
+	return nil
+}
+
+// reset clears the session state of a failed attempt before trying another transport.
+// It runs only after teardown waited for the attempt's goroutines, and before the reader goroutine starts.
+func (c *rtspClient) reset() {
+	c.conn = nil
+	c.reader = nil
+	c.cseq = 0
+	c.session = ""
+	c.keepaliveAt = time.Time{}
+	c.realm = ""
+	c.nonce = ""
+	c.basic = false
+	c.tracks = nil
+	c.codecs = nil
+	c.pending = nil
+	c.rtpInfo = false
+	c.aligned = false
+	c.anchor = nil
+	c.udpPackets = nil
+	c.udpErr = nil
+	c.udpDone = nil
+}
+
+// trackURL resolves a track's control attribute against the session URL
+func (c *rtspClient) trackURL(control string) string {
+	if control == "" || control == "*" {
+		return c.control
+	}
+	if strings.HasPrefix(control, "rtsp://") || strings.HasPrefix(control, "rtsps://") {
+		return control
+	}
+	if strings.HasSuffix(c.control, "/") {
+		return c.control + control
+	}
+	return c.control + "/" + control
+}
+
+// Codecs returns the track codecs, updated when the server sends new parameter sets
+func (c *rtspClient) Codecs() []av.CodecData {
+	c.codecMutex.Lock()
+	defer c.codecMutex.Unlock()
+
+	return append([]av.CodecData(nil), c.codecs...)
+}
+
+// CodecChanges fires when in-band parameter sets change a track's codec
+func (c *rtspClient) CodecChanges() <-chan struct{} {
+	return c.codecChanges
+}
+
+// LostPackets returns how many RTP packets went missing across all tracks
+func (c *rtspClient) LostPackets() int64 {
+	return c.lostPackets.Load()
+}
+
+// Close ends the session with TEARDOWN and closes the connections
+func (c *rtspClient) Close() error {
+	c.stop(c.teardown)
+	return nil
+}
+
+// teardown sends a best-effort TEARDOWN and closes every connection, interrupting blocked reads.
+// It leaves the fields in place, since the reader goroutine may still be using them until it sees the closed connections.
+func (c *rtspClient) teardown() {
+	if c.udpDone != nil {
+		select {
+		case <-c.udpDone:
+		default:
+			close(c.udpDone)
+		}
+	}
+	if c.conn != nil {
+		if c.session != "" {
+			c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			c.writeRequest("TEARDOWN", c.control, nil)
+		}
+		c.conn.Close()
+	}
+	for _, track := range c.tracks {
+		track.close()
+	}
+	c.udpWG.Wait()
+}
+
+// read delivers packets until the session fails or the source is closed
+func (c *rtspClient) read() error {
+	for _, packet := range c.pending {
+		if !c.send(packet) {
+			return nil
+		}
+	}
+	c.pending = nil
+
+	for {
+		packets, err := c.readPackets()
+		if err != nil {
+			select {
+			case <-c.closing():
+				return nil
+			default:
+				return err
+			}
+		}
+
+		for _, packet := range packets {
+			if !c.send(packet) {
+				return nil
+			}
+		}
+	}
+}
+
+// readPackets reads the next RTP packet from either transport and returns the media packets it completes.
+// Keepalives are sent from here so all session writes after PLAY come from the reading goroutine or Close.
+func (c *rtspClient) readPackets() ([]*av.Packet, error) {
+	c.sendKeepalive()
+
+	if c.udp {
+		timer := time.NewTimer(c.options.readTimeout())
+		defer timer.Stop()
+
+		select {
+		case datagram := <-c.udpPackets:
+			if datagram.rtcp {
+				c.handleRTCP(datagram.track, datagram.data)
+				return nil, nil
+			}
+			return c.handleRTP(datagram.track, datagram.data), nil
+		case err := <-c.udpErr:
+			return nil, err
+		case <-c.closing():
+			return nil, io.EOF
+		case <-timer.C:
+			return nil, configs.ErrRTSPReadTimeout
+		}
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(c.options.readTimeout()))
+
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Responses to keepalives arrive between interleaved frames
+	if first[0] != '$' {
+		if _, err := c.readResponse(); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	var frame [4]byte
+	if _, err := io.ReadFull(c.reader, frame[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(frame[2:]))
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return nil, err
+	}
+
+	for _, track := range c.tracks {
+		if int(frame[1]) == track.channel {
+			return c.handleRTP(track, data), nil
+		}
+		if int(frame[1]) == track.channel+1 {
+			c.handleRTCP(track, data)
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+// sendKeepalive refreshes the session before the server's timeout expires
+func (c *rtspClient) sendKeepalive() {
+	if c.keepaliveAt.IsZero() || time.Now().Before(c.keepaliveAt) {
+		return
+	}
+	c.keepaliveAt = time.Now().Add(c.keepalive)
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.options.readTimeout()))
+	c.writeRequest("GET_PARAMETER", c.control, nil)
+}
+
+// readUDP forwards datagrams from the server on a track's RTP and RTCP ports until done closes
+func (c *rtspClient) readUDP(track *rtspClientTrack, packets chan<- rtspClientDatagram, done <-chan struct{}) {
+	defer c.udpWG.Done()
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := track.rtcpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if track.serverIP != nil && !addr.IP.Equal(track.serverIP) {
+				continue
+			}
+
+			select {
+			case packets <- rtspClientDatagram{track: track, data: append([]byte(nil), buf[:n]...), rtcp: true}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := track.rtpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if track.serverIP != nil && !addr.IP.Equal(track.serverIP) {
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		select {
+		case packets <- rtspClientDatagram{track: track, data: data}:
+		case <-done:
+			return
+		}
+	}
+}
+
+// drainControl reads keepalive responses on the control connection of a UDP session; its failure ends the session
+func (c *rtspClient) drainControl(reader *bufio.Reader, errs chan<- error) {
+	defer c.udpWG.Done()
+
+	for {
+		if _, err := readRTSPResponse(reader); err != nil {
+			select {
+			case errs <- err:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// request sends a request and reads its response, retrying once with credentials on 401
+func (c *rtspClient) request(method string, uri string, header map[string]string) (*rtspResponse, error) {
+	c.conn.SetDeadline(time.Now().Add(c.options.readTimeout()))
+	defer c.conn.SetDeadline(time.Time{})
+
+	for attempt := 0; ; attempt++ {
+		if err := c.writeRequest(method, uri, header); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.status == 401 && attempt == 0 && c.username != "" {
+			c.authenticate(resp.header.Get("WWW-Authenticate"))
+			continue
+		}
+		if resp.status == 461 {
+			return nil, errRTSPUnsupportedTransport
+		}
+		if resp.status != 200 {
+			return nil, fmt.Errorf("rtsp %s: status %d", method, resp.status)
+		}
+
+		if session := resp.header.Get("Session"); session != "" {
+			id, params, _ := strings.Cut(session, ";")
+			c.session = strings.TrimSpace(id)
+			c.keepalive = rtspSessionTimeoutParam(params) / 2
+			c.keepaliveAt = time.Now().Add(c.keepalive)
+		}
+		return resp, nil
+	}
+}
+
+// writeRequest writes one request
+func (c *rtspClient) writeRequest(method string, uri string, header map[string]string) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.cseq++
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%s %s RTSP/1.0\r\n", method, uri)
+	fmt.Fprintf(&buf, "CSeq: %d\r\n", c.cseq)
+	fmt.Fprintf(&buf, "User-Agent: %s\r\n", c.options.userAgent())
+	if c.session != "" {
+		fmt.Fprintf(&buf, "Session: %s\r\n", c.session)
+	}
+	if auth := c.authorization(method, uri); auth != "" {
+		fmt.Fprintf(&buf, "Authorization: %s\r\n", auth)
+	}
+	for key, value := range header {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	buf.WriteString("\r\n")
+
+	_, err := io.WriteString(c.conn, buf.String())
+	return err
+}
+
+// readResponse reads one response with its body
+func (c *rtspClient) readResponse() (*rtspResponse, error) {
+	return readRTSPResponse(c.reader)
+}
+
+// readRTSPResponse reads one response with its body from a control connection
+func readRTSPResponse(buffered *bufio.Reader) (*rtspResponse, error) {
+	reader := textproto.NewReader(buffered)
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "RTSP/") {
+		return nil, fmt.Errorf("rtsp: malformed response %q", line)
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("rtsp: malformed response %q", line)
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &rtspResponse{status: status, header: header}
+	if length := header.Get("Content-Length"); length != "" {
+		size, err := strconv.Atoi(length)
+		if err != nil || size < 0 || size > rtspMaxBodySize {
+			return nil, fmt.Errorf("rtsp: bad content length %q", length)
+		}
+		resp.body = make([]byte, size)
+		if _, err := io.ReadFull(buffered, resp.body); err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// authenticate records the challenge of a 401 response
+func (c *rtspClient) authenticate(challenge string) {
+	if strings.HasPrefix(challenge, "Digest") {
+		c.realm = rtspAuthParam(challenge, "realm")
+		c.nonce = rtspAuthParam(challenge, "nonce")
+		c.basic = false
+		return
+	}
+	c.basic = true
+}
+
+// authorization builds the Authorization header for a request, empty before any challenge
+func (c *rtspClient) authorization(method string, uri string) string {
+	if c.basic {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+	}
+	if c.nonce == "" {
+		return ""
+	}
+
+	ha1 := fmt.Sprintf("%x", md5.Sum([]byte(c.username+":"+c.realm+":"+c.password)))
+	ha2 := fmt.Sprintf("%x", md5.Sum([]byte(method+":"+uri)))
+	response := fmt.Sprintf("%x", md5.Sum([]byte(ha1+":"+c.nonce+":"+ha2)))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`, c.username, c.realm, c.nonce, uri, response)
+}
+
+// rtspSessionTimeoutParam reads the timeout parameter of a Session header, defaulting to the RTSP standard 60s
+func rtspSessionTimeoutParam(params string) time.Duration {
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if key == "timeout" {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return rtspSessionTimeout
+}
+
+// codecsReady reports whether every track has a usable codec
+func (c *rtspClient) codecsReady() bool {
+	c.codecMutex.Lock()
+	defer c.codecMutex.Unlock()
+
+	for _, codecData := range c.codecs {
+		if codecData == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// receiving reports whether any RTP packet arrived yet
+func (c *rtspClient) receiving() bool {
+	for _, track := range c.tracks {
+		if track.started {
+			return true
+		}
+	}
+	return false
+}
+
+// setCodec replaces a track's codec after in-band parameter sets changed it
+func (c *rtspClient) setCodec(idx int8, codecData av.CodecData) {
+	c.codecMutex.Lock()
+	c.codecs[idx] = codecData
+	c.codecMutex.Unlock()
+
+	select {
+	case c.codecChanges <- struct{}{}:
+	default:
+	}
+}
+
+// handleRTP depacketizes one RTP packet into zero or more media packets
+func (c *rtspClient) handleRTP(track *rtspClientTrack, data []byte) []*av.Packet {
+	var packet rtp.Packet
+	if err := packet.Unmarshal(data); err != nil || len(packet.Payload) == 0 {
+		return nil
+	}
+
+	// Drop duplicates and late packets; a gap breaks the frame being assembled
+	if track.started {
+		delta := int16(packet.SequenceNumber - track.lastSeq)
+		if delta <= 0 {
+			return nil
+		}
+		if delta > 1 {
+			track.broken = true
+			track.fragment = nil
+			c.lostPackets.Add(int64(delta - 1))
+		}
+		track.extTS += int64(int32(packet.Timestamp - track.lastTS))
+	} else {
+		track.firstTS = packet.Timestamp
+		track.firstAt = time.Now()
+		if c.anchor == nil {
+			c.anchor = track
+		}
+		if c.aligned {
+			track.offset = c.trackOffset(track)
+			track.lastTime = track.offset
+		}
+	}
+	track.started = true
+	track.lastSeq = packet.SequenceNumber
+	track.lastTS = packet.Timestamp
+	ts := track.offset + time.Duration(track.extTS)*time.Second/time.Duration(track.clockRate)
+
+	switch track.media.Type {
+	case av.H264, av.H265:
+		return c.handleVideo(track, &packet, ts)
+	case av.AAC:
+		return track.handleAAC(packet.Payload, ts)
+	case av.OPUS:
+		return []*av.Packet{{Idx: track.idx, Data: packet.Payload, Time: ts, Duration: 20 * time.Millisecond}}
+	default:
+		duration := time.Duration(len(packet.Payload)) * time.Second / time.Duration(track.clockRate)
+		return []*av.Packet{{Idx: track.idx, Data: packet.Payload, Time: ts, Duration: duration}}
+	}
+}
+
+// handleRTCP records the timestamp mapping of a sender report unless RTP-Info already aligned the tracks
+func (c *rtspClient) handleRTCP(track *rtspClientTrack, data []byte) {
+	if c.rtpInfo {
+		return
+	}
+
+	packets, err := rtcp.Unmarshal(data)
+	if err != nil {
+		return
+	}
+	for _, packet := range packets {
+		if report, ok := packet.(*rtcp.SenderReport); ok {
+			track.synced = true
+			track.syncTS = report.RTPTime
+			track.syncTime = ntpDuration(report.NTPTime)
+		}
+	}
+}
+
+// syncRTPInfo maps every track's RTP timestamp to the play start from the PLAY response; it is only used when it covers all tracks
+func (c *rtspClient) syncRTPInfo(header string) {
+	rtpTimes := rtspRTPInfo(header)
+
+	syncTS := make([]uint32, len(c.tracks))
+	for i, track := range c.tracks {
+		found := false
+		for rawURL, rtpTime := range rtpTimes {
+			if rtspRTPInfoMatches(rawURL, c.trackURL(track.media.Control), track.media.Control) || (len(c.tracks) == 1 && len(rtpTimes) == 1) {
+				syncTS[i], found = rtpTime, true
+				break
+			}
+		}
+		if !found {
+			return
+		}
+	}
+
+	c.rtpInfo = true
+	for i, track := range c.tracks {
+		track.synced = true
+		track.syncTS = syncTS[i]
+		track.syncTime = 0
+	}
+}
+
+// syncReady reports whether every track has sent a packet and can be placed exactly on the common timeline
+func (c *rtspClient) syncReady() bool {
+	for _, track := range c.tracks {
+		if !track.started || !track.synced {
+			return false
+		}
+	}
+	return true
+}
+
+// alignTracks moves every started track onto the first-arriving track's timeline, including the packets read during Open.
+// Tracks that start later are aligned on their first packet.
+func (c *rtspClient) alignTracks() {
+	c.aligned = true
+
+	for _, track := range c.tracks {
+		if !track.started {
+			continue
+		}
+		track.offset = c.trackOffset(track)
+		track.lastTime += track.offset
+		track.frameTime += track.offset
+	}
+	for _, packet := range c.pending {
+		packet.Time += c.tracks[packet.Idx].offset
+	}
+}
+
+// trackOffset returns how far a track's first packet lies after the anchor's, exactly from the timestamp mappings or else by arrival
+func (c *rtspClient) trackOffset(track *rtspClientTrack) time.Duration {
+	anchor := c.anchor
+	if track == anchor {
+		return 0
+	}
+	if track.synced && anchor.synced {
+		return track.syncedTime(track.firstTS) - anchor.syncedTime(anchor.firstTS)
+	}
+	return track.firstAt.Sub(anchor.firstAt)
+}
+
+// syncedTime places an RTP timestamp on the common timeline of the track's sync point
+func (track *rtspClientTrack) syncedTime(timestamp uint32) time.Duration {
+	return track.syncTime + time.Duration(int32(timestamp-track.syncTS))*time.Second/time.Duration(track.clockRate)
+}
+
+// handleVideo collects NAL units into access units, flushing one on the marker bit or a new timestamp
+func (c *rtspClient) handleVideo(track *rtspClientTrack, packet *rtp.Packet, ts time.Duration) []*av.Packet {
+	var out []*av.Packet
+
+	if len(track.nalus) > 0 && packet.Timestamp != track.frameTS {
+		out = c.flushFrame(track, out)
+	}
+	if len(track.nalus) == 0 && track.fragment == nil {
+		track.frameTS = packet.Timestamp
+		track.frameTime = ts
+	}
+
+	if track.media.Type == av.H264 {
+		c.depacketizeH264(track, packet.Payload)
+	} else {
+		c.depacketizeH265(track, packet.Payload)
+	}
+
+	if packet.Marker {
+		out = c.flushFrame(track, out)
+	}
+	return out
+}
+
+// depacketizeH264 handles single NAL unit, STAP-A and FU-A payloads
+func (c *rtspClient) depacketizeH264(track *rtspClientTrack, payload []byte) {
+	switch nalType := payload[0] & 0x1f; {
+	case nalType >= 1 && nalType <= 23:
+		c.addNALU(track, payload)
+
+	case nalType == 24:
+		for rest := payload[1:]; len(rest) > 2; {
+			size := int(binary.BigEndian.Uint16(rest))
+			if size == 0 || size+2 > len(rest) {
+				break
+			}
+			c.addNALU(track, rest[2:2+size])
+			rest = rest[2+size:]
+		}
+
+	case nalType == 28 && len(payload) > 2:
+		header := payload[1]
+		if header&0x80 != 0 {
+			track.fragment = append([]byte{payload[0]&0xe0 | header&0x1f}, payload[2:]...)
+		} else if track.fragment != nil {
+			track.fragment = append(track.fragment, payload[2:]...)
+		}
+		if len(track.fragment) > rtspClientMaxFrameSize {
+			track.fragment = nil
+			track.broken = true
+		}
+		if header&0x40 != 0 && track.fragment != nil {
+			c.addNALU(track, track.fragment)
+			track.fragment = nil
+		}
+	}
+}
+
+// depacketizeH265 handles single NAL unit, aggregation and fragmentation payloads
+func (c *rtspClient) depacketizeH265(track *rtspClientTrack, payload []byte) {
+	if len(payload) < 3 {
+		return
+	}
+
+	switch nalType := (payload[0] >> 1) & 0x3f; nalType {
+	case 48:
+		for rest := payload[2:]; len(rest) > 2; {
+			size := int(binary.BigEndian.Uint16(rest))
+			if size == 0 || size+2 > len(rest) {
+				break
+			}
+			c.addNALU(track, rest[2:2+size])
+			rest = rest[2+size:]
+		}
+
+	case 49:
+		header := payload[2]
+		if header&0x80 != 0 {
+			fuType := header & 0x3f
+			track.fragment = append([]byte{payload[0]&0x81 | fuType<<1, payload[1]}, payload[3:]...)
+		} else if track.fragment != nil {
+			track.fragment = append(track.fragment, payload[3:]...)
+		}
+		if len(track.fragment) > rtspClientMaxFrameSize {
+			track.fragment = nil
+			track.broken = true
+		}
+		if header&0x40 != 0 && track.fragment != nil {
+			c.addNALU(track, track.fragment)
+			track.fragment = nil
+		}
+
+	default:
+		c.addNALU(track, payload)
+	}
+}
+
+// addNALU adds a complete NAL unit to the access unit, taking parameter sets out as codec updates
+func (c *rtspClient) addNALU(track *rtspClientTrack, nalu []byte) {
+	if len(nalu) == 0 {
+		return
+	}
+
+	if track.media.Type == av.H264 {
+		switch nalu[0] & 0x1f {
+		case h264parser.NALU_SPS:
+			c.updateParameterSet(track, &track.sps, nalu)
+			return
+		case h264parser.NALU_PPS:
+			c.updateParameterSet(track, &track.pps, nalu)
+			return
+		case h264parser.NALU_AUD:
+			return
+		case 5:
+			// IDR slice
+			track.keyFrame = true
+		}
+	} else {
+		switch nalType := (nalu[0] >> 1) & 0x3f; {
+		case nalType == h265parser.NAL_UNIT_VPS:
+			c.updateParameterSet(track, &track.vps, nalu)
+			return
+		case nalType == h265parser.NAL_UNIT_SPS:
+			c.updateParameterSet(track, &track.sps, nalu)
+			return
+		case nalType == h265parser.NAL_UNIT_PPS:
+			c.updateParameterSet(track, &track.pps, nalu)
+			return
+		case nalType == h265parser.NAL_UNIT_ACCESS_UNIT_DELIMITER:
+			return
+		case nalType >= h265parser.NAL_UNIT_CODED_SLICE_BLA_W_LP && nalType <= h265parser.NAL_UNIT_CODED_SLICE_CRA:
+			track.keyFrame = true
+		}
+	}
+
+	track.nalus = append(track.nalus, append([]byte(nil), nalu...))
+}
+
+// updateParameterSet stores a parameter set and rebuilds the codec when the set is complete and changed
+func (c *rtspClient) updateParameterSet(track *rtspClientTrack, current *[]byte, nalu []byte) {
+	if string(*current) == string(nalu) && c.codecs[track.idx] != nil {
+		return
+	}
+	*current = append([]byte(nil), nalu...)
+
+	var codecData av.CodecData
+	var err error
+	if track.media.Type == av.H264 {
+		if len(track.sps) == 0 || len(track.pps) == 0 {
+			return
+		}
+		codecData, err = h264parser.NewCodecDataFromSPSAndPPS(track.sps, track.pps)
+	} else {
+		if len(track.vps) == 0 || len(track.sps) == 0 || len(track.pps) == 0 {
+			return
+		}
+		codecData, err = h265parser.NewCodecDataFromVPSAndSPSAndPPS(track.vps, track.sps, track.pps)
+	}
+	if err != nil {
+		return
+	}
+
+	c.setCodec(track.idx, codecData)
+}
+
+// flushFrame emits the assembled access unit as one AVCC packet
+func (c *rtspClient) flushFrame(track *rtspClientTrack, out []*av.Packet) []*av.Packet {
+	nalus, broken, keyFrame := track.nalus, track.broken || track.fragment != nil, track.keyFrame
+	track.nalus = nil
+	track.fragment = nil
+	track.broken = false
+	track.keyFrame = false
+
+	if broken || len(nalus) == 0 {
+		return out
+	}
+
+	size := 0
+	for _, nalu := range nalus {
+		size += 4 + len(nalu)
+	}
+	data := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+		data = append(data, nalu...)
+	}
+
+	var duration time.Duration
+	if track.frameTime > track.lastTime {
+		duration = track.frameTime - track.lastTime
+	}
+	track.lastTime = track.frameTime
+
+	return append(out, &av.Packet{
+		Idx:        track.idx,
+		IsKeyFrame: keyFrame,
+		Data:       data,
+		Time:       track.frameTime,
+		Duration:   duration,
+	})
+}
+
+// handleAAC splits an RFC 3640 payload into its access units
+func (track *rtspClientTrack) handleAAC(payload []byte, ts time.Duration) []*av.Packet {
+	sizeLength := track.media.SizeLength
+	indexLength := track.media.IndexLength
+	if sizeLength == 0 {
+		sizeLength, indexLength = 13, 3
+	}
+	if len(payload) < 2 || sizeLength+indexLength != 16 {
+		return nil
+	}
+
+	headerBytes := (int(binary.BigEndian.Uint16(payload)) + 7) / 8
+	if 2+headerBytes > len(payload) {
+		return nil
+	}
+	headers := payload[2 : 2+headerBytes]
+	frames := payload[2+headerBytes:]
+
+	frameDuration := 1024 * time.Second / time.Duration(track.clockRate)
+	var out []*av.Packet
+	for i := 0; len(headers) >= 2; i++ {
+		size := int(binary.BigEndian.Uint16(headers) >> indexLength)
+		headers = headers[2:]
+		if size > len(frames) {
+			break
+		}
+
+		out = append(out, &av.Packet{
+			Idx:      track.idx,
+			Data:     frames[:size],
+			Time:     ts + time.Duration(i)*frameDuration,
+			Duration: frameDuration,
+		})
+		frames = frames[size:]
+	}
+	return out
+}
+
+// listenUDP binds an even RTP port and the RTCP port above it
+func (track *rtspClientTrack) listenUDP() error {
+	for attempt := 0; attempt < 10; attempt++ {
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return err
+		}
+
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 != 0 {
+			rtpConn.Close()
+			continue
+		}
+
+		rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+		if err != nil {
+			rtpConn.Close()
+			continue
+		}
+
+		rtpConn.SetReadBuffer(rtspClientUDPBuffer)
+		track.rtpConn = rtpConn
+		track.rtcpConn = rtcpConn
+		return nil
+	}
+
+	return errors.New("rtsp: no free RTP/RTCP port pair")
+}
+
+// close releases the track's UDP ports
+func (track *rtspClientTrack) close() {
+	if track.rtpConn != nil {
+		track.rtpConn.Close()
+	}
+	if track.rtcpConn != nil {
+		track.rtcpConn.Close()
+	}
+}
+
+// rtspClientCodec builds the codec for an SDP media; video without parameter sets yields a nil codec until they arrive in band
+func rtspClientCodec(media sdp.Media) (av.CodecData, bool) {
+	switch media.Type {
+	case av.H264:
+		if len(media.SpropParameterSets) > 1 {
+			if codecData, err := h264parser.NewCodecDataFromSPSAndPPS(media.SpropParameterSets[0], media.SpropParameterSets[1]); err == nil {
+				return codecData, true
+			}
+		}
+		return nil, true
+	case av.H265:
+		if codecData, err := h265parser.NewCodecDataFromVPSAndSPSAndPPS(media.SpropVPS, media.SpropSPS, media.SpropPPS); err == nil {
+			return codecData, true
+		}
+		return nil, true
+	case av.AAC:
+		codecData, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes(media.Config)
+		return codecData, err == nil
+	case av.OPUS:
+		layout := av.CH_MONO
+		if media.ChannelCount == 2 {
+			layout = av.CH_STEREO
+		}
+		return codec.NewOpusCodecData(48000, layout), true
+	case av.PCM_ALAW:
+		return codec.NewPCMAlawCodecData(), true
+	case av.PCM_MULAW:
+		return codec.NewPCMMulawCodecData(), true
+	}
+	return nil, false
+}
+
+// rtspRTPInfo returns the rtptime of each url in an RTP-Info header
+func rtspRTPInfo(header string) map[string]uint32 {
+	rtpTimes := make(map[string]uint32)
+	for _, entry := range strings.Split(header, ",") {
+		var rawURL string
+		var rtpTime uint32
+		var hasTime bool
+		for _, field := range strings.Split(entry, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "url":
+				rawURL = value
+			case "rtptime":
+				if parsed, err := strconv.ParseUint(value, 10, 32); err == nil {
+					rtpTime, hasTime = uint32(parsed), true
+				}
+			}
+		}
+		if rawURL != "" && hasTime {
+			rtpTimes[rawURL] = rtpTime
+		}
+	}
+	return rtpTimes
+}
+
+// rtspRTPInfoMatches reports whether an RTP-Info url names a track, given either in full or relative to the session
+func rtspRTPInfoMatches(rawURL string, trackURL string, control string) bool {
+	if rawURL == trackURL {
+		return true
+	}
+	if control == "" || control == "*" {
+		return false
+	}
+	return rawURL == control || strings.HasSuffix(rawURL, "/"+control)
+}
+
+// ntpDuration converts a 64-bit NTP timestamp to the time since the NTP epoch
+func ntpDuration(ntp uint64) time.Duration {
+	return time.Duration(ntp>>32)*time.Second + time.Duration((ntp&0xffffffff)*uint64(time.Second)>>32)
+}
+
+// rtspAuthParam extracts a quoted parameter of a WWW-Authenticate challenge
+func rtspAuthParam(challenge string, name string) string {
+	_, rest, found := strings.Cut(challenge, name+`="`)
+	if !found {
+		return ""
+	}
+	value, _, _ := strings.Cut(rest, `"`)
+	return value
+}
+
+// rtspHostIP returns the IP of a connection's remote address
+func rtspHostIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
@@ -0,0 +1,582 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"net"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec"
+	"github.com/deepch/vdk/format/rtsp/sdp"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// testRTP is one RTP packet fed to the depacketizer
+type testRTP struct {
+	seq     uint16
+	ts      uint32
+	marker  bool
+	payload []byte
+}
+
+func TestRTSPClientDepacketize(t *testing.T) {
+	h264 := testH264(t)
+	sps, pps := h264.SPS(), h264.PPS()
+	idr := []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	slice := []byte{0x41, 0x9a, 0x02}
+
+	// H.265 IDR_W_RADL and TRAIL_R slices
+	hevcIDR := []byte{0x26, 0x01, 0xaf, 0x09}
+	hevcSlice := []byte{0x02, 0x01, 0xd0, 0x28}
+
+	// avcc joins NAL units with 4-byte length prefixes
+	avcc := func(nalus ...[]byte) []byte {
+		var data []byte
+		for _, nalu := range nalus {
+			data = append(data, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+			data = append(data, nalu...)
+		}
+		return data
+	}
+	// aggregate builds a STAP-A or AP payload from its header and NAL units
+	aggregate := func(header []byte, nalus ...[]byte) []byte {
+		data := append([]byte(nil), header...)
+		for _, nalu := range nalus {
+			data = append(data, byte(len(nalu)>>8), byte(len(nalu)))
+			data = append(data, nalu...)
+		}
+		return data
+	}
+
+	tests := []struct {
+		name    string
+		media   sdp.Media
+		packets []testRTP
+		want    []av.Packet
+		lost    int64
+		codec   bool
+	}{
+		{
+			name:    "h264 single nal unit",
+			media:   sdp.Media{Type: av.H264, TimeScale: 90000},
+			packets: []testRTP{{seq: 1, ts: 9000, marker: true, payload: idr}},
+			want:    []av.Packet{{IsKeyFrame: true, Data: avcc(idr)}},
+		},
+		{
+			name:  "h264 stap-a takes the parameter sets out",
+			media: sdp.Media{Type: av.H264, TimeScale: 90000},
+			packets: []testRTP{
+				{seq: 1, ts: 0, marker: true, payload: aggregate([]byte{24}, sps, pps, idr)},
+			},
+			want:  []av.Packet{{IsKeyFrame: true, Data: avcc(idr)}},
+			codec: true,
+		},
+		{
+			name:  "h264 fu-a",
+			media: sdp.Media{Type: av.H264, TimeScale: 90000},
+			packets: []testRTP{
+				{seq: 1, ts: 0, payload: []byte{0x7c, 0x85, 0x88, 0x84}},
+				{seq: 2, ts: 0, payload: []byte{0x7c, 0x05, 0x00}},
+				{seq: 3, ts: 0, marker: true, payload: []byte{0x7c, 0x45, 0x33}},
+			},
+			want: []av.Packet{{IsKeyFrame: true, Data: avcc(idr)}},
+		},
+		{
+			name:  "h264 fu-a with a lost fragment is dropped",
+			media: sdp.Media{Type: av.H264, TimeScale: 90000},
+			packets: []testRTP{
+				{seq: 1, ts: 0, payload: []byte{0x7c, 0x85, 0x88, 0x84}},
+				{seq: 3, ts: 0, marker: true, payload: []byte{0x7c, 0x45, 0x33}},
+				{seq: 4, ts: 3600, marker: true, payload: slice},
+			},
+			want: []av.Packet{{Data: avcc(slice), Time: 40 * time.Millisecond, Duration: 40 * time.Millisecond}},
+			lost: 1,
+		},
+		{
+			name:  "h264 new timestamp ends a frame without a marker",
+			media: sdp.Media{Type: av.H264, TimeScale: 90000},
+			packets: []testRTP{
+				{seq: 1, ts: 0, payload: idr},
+				{seq: 2, ts: 3600, payload: slice},
+				{seq: 3, ts: 7200, marker: true, payload: slice},
+			},
+			want: []av.Packet{
+				{IsKeyFrame: true, Data: avcc(idr)},
+				{Data: avcc(slice), Time: 40 * time.Millisecond, Duration: 40 * time.Millisecond},
+				{Data: avcc(slice), Time: 80 * time.Millisecond, Duration: 40 * time.Millisecond},
+			},
+		},
+		{
+			name:  "duplicate and late packets are ignored",
+			media: sdp.Media{Type: av.H264, TimeScale: 90000},
+			packets: []testRTP{
+				{seq: 10, ts: 0, marker: true, payload: idr},
+				{seq: 10, ts: 0, marker: true, payload: idr},
+				{seq: 9, ts: 0, marker: true, payload: idr},
+			},
+			want: []av.Packet{{IsKeyFrame: true, Data: avcc(idr)}},
+		},
+		{
+			name:  "h265 aggregation packet",
+			media: sdp.Media{Type: av.H265, TimeScale: 90000},
+			packets: []testRTP{
+				{seq: 1, ts: 0, marker: true, payload: aggregate([]byte{0x60, 0x01}, hevcIDR, hevcSlice)},
+			},
+			want: []av.Packet{{IsKeyFrame: true, Data: avcc(hevcIDR, hevcSlice)}},
+		},
+		{
+			name:  "h265 fragmentation unit",
+			media: sdp.Media{Type: av.H265, TimeScale: 90000},
+			packets: []testRTP{
+				{seq: 1, ts: 0, payload: []byte{0x62, 0x01, 0x80 | 19, 0xaf}},
+				{seq: 2, ts: 0, marker: true, payload: []byte{0x62, 0x01, 0x40 | 19, 0x09}},
+			},
+			want: []av.Packet{{IsKeyFrame: true, Data: avcc(hevcIDR)}},
+		},
+		{
+			name:  "aac access units",
+			media: sdp.Media{Type: av.AAC, TimeScale: 48000, SizeLength: 13, IndexLength: 3},
+			packets: []testRTP{
+				{seq: 1, ts: 0, marker: true, payload: []byte{0x00, 0x20, 0x00, 0x18, 0x00, 0x10, 1, 2, 3, 4, 5}},
+				{seq: 2, ts: 2048, marker: true, payload: []byte{0x00, 0x10, 0x00, 0x08, 6}},
+			},
+			want: []av.Packet{
+				{Data: []byte{1, 2, 3}, Duration: 1024 * time.Second / 48000},
+				{Data: []byte{4, 5}, Time: 1024 * time.Second / 48000, Duration: 1024 * time.Second / 48000},
+				{Data: []byte{6}, Time: 2048 * time.Second / 48000, Duration: 1024 * time.Second / 48000},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newRTSPClient("rtsp://camera/stream", RTSPOptions{})
+			client.codecs = []av.CodecData{nil}
+			track := &rtspClientTrack{media: tt.media, clockRate: uint32(tt.media.TimeScale)}
+
+			var got []av.Packet
+			for _, p := range tt.packets {
+				packet := rtp.Packet{
+					Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: p.seq, Timestamp: p.ts, Marker: p.marker},
+					Payload: p.payload,
+				}
+				data, err := packet.Marshal()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, out := range client.handleRTP(track, data) {
+					got = append(got, *out)
+				}
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d packets %v, want %d", len(got), got, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if got[i].IsKeyFrame != want.IsKeyFrame || !slices.Equal(got[i].Data, want.Data) || got[i].Time != want.Time || got[i].Duration != want.Duration {
+					t.Fatalf("packet %d = %+v, want %+v", i, got[i], want)
+				}
+			}
+			if lost := client.LostPackets(); lost != tt.lost {
+				t.Fatalf("LostPackets() = %d, want %d", lost, tt.lost)
+			}
+			if codecSet := client.codecs[0] != nil; codecSet != tt.codec {
+				t.Fatalf("codec set = %v, want %v", codecSet, tt.codec)
+			}
+		})
+	}
+}
+
+func TestRTSPRTPInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   map[string]uint32
+	}{
+		{"empty", "", map[string]uint32{}},
+		{
+			name:   "two tracks",
+			header: "url=rtsp://camera/stream/trackID=0;seq=12;rtptime=90000, url=rtsp://camera/stream/trackID=1;seq=3;rtptime=4294967295",
+			want:   map[string]uint32{"rtsp://camera/stream/trackID=0": 90000, "rtsp://camera/stream/trackID=1": 4294967295},
+		},
+		{
+			name:   "entries without rtptime are skipped",
+			header: "url=rtsp://camera/stream/trackID=0;seq=12,url=trackID=1;rtptime=8000",
+			want:   map[string]uint32{"trackID=1": 8000},
+		},
+		{"rtptime out of range", "url=trackID=0;rtptime=4294967296", map[string]uint32{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rtspRTPInfo(tt.header); !maps.Equal(got, tt.want) {
+				t.Fatalf("rtspRTPInfo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRTSPClientAlignTracks(t *testing.T) {
+	idr := []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	slice := []byte{0x41, 0x9a, 0x02}
+	base := time.Unix(1700000000, 0)
+
+	// senderReport maps an RTP timestamp to a wall-clock time
+	senderReport := func(at time.Time, rtpTime uint32) []byte {
+		data, err := (&rtcp.SenderReport{SSRC: 1, NTPTime: ntpTime(at), RTPTime: rtpTime}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	bothRTPInfo := "url=rtsp://camera/stream/trackID=0;seq=1;rtptime=90000,url=rtsp://camera/stream/trackID=1;seq=1;rtptime=8000"
+
+	tests := []struct {
+		name    string
+		rtpInfo string
+		// reports are the sender reports of the video and audio track, nil for none
+		reports [][]byte
+		// audio and video are the RTP timestamps of each track's first packet; audio always arrives first
+		audio uint32
+		video uint32
+		// lateVideo sends the first video packet only after Open aligned the tracks
+		lateVideo bool
+		offset    time.Duration
+	}{
+		{
+			name:    "rtp-info",
+			rtpInfo: bothRTPInfo,
+			audio:   8000 + 800,
+			video:   90000 + 18000,
+			offset:  100 * time.Millisecond,
+		},
+		{
+			name:    "sender reports",
+			reports: [][]byte{senderReport(base, 90000), senderReport(base.Add(time.Second), 8000)},
+			audio:   8000,
+			video:   90000 + 94500,
+			offset:  50 * time.Millisecond,
+		},
+		{
+			name:      "track starting after open",
+			reports:   [][]byte{senderReport(base, 90000), senderReport(base.Add(time.Second), 8000)},
+			audio:     8000,
+			video:     90000 + 94500,
+			lateVideo: true,
+			offset:    50 * time.Millisecond,
+		},
+		{
+			name:    "rtp-info wins over sender reports",
+			rtpInfo: bothRTPInfo,
+			reports: [][]byte{senderReport(base, 90000), senderReport(base, 8000)},
+			audio:   8000 + 800,
+			video:   90000 + 18000,
+			offset:  100 * time.Millisecond,
+		},
+		{
+			name:    "rtp-info without every track is ignored",
+			rtpInfo: "url=rtsp://camera/stream/trackID=0;seq=1;rtptime=0",
+			reports: [][]byte{senderReport(base, 90000), senderReport(base.Add(time.Second), 8000)},
+			audio:   8000,
+			video:   90000 + 94500,
+			offset:  50 * time.Millisecond,
+		},
+		{
+			name:    "video ahead of audio",
+			rtpInfo: bothRTPInfo,
+			audio:   8000 + 1600,
+			video:   90000 + 9000,
+			offset:  -100 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newRTSPClient("rtsp://camera/stream", RTSPOptions{})
+			client.control = "rtsp://camera/stream"
+			client.codecs = []av.CodecData{testH264(t), codec.NewPCMMulawCodecData()}
+			video := &rtspClientTrack{media: sdp.Media{Type: av.H264, Control: "trackID=0"}, idx: 0, clockRate: 90000}
+			audio := &rtspClientTrack{media: sdp.Media{Type: av.PCM_MULAW, Control: "trackID=1"}, idx: 1, clockRate: 8000}
+			client.tracks = []*rtspClientTrack{video, audio}
+
+			client.syncRTPInfo(tt.rtpInfo)
+			for i, report := range tt.reports {
+				client.handleRTCP(client.tracks[i], report)
+			}
+
+			// Packets read before alignment wait in pending like they do during Open
+			var got []*av.Packet
+			feed := func(track *rtspClientTrack, seq uint16, ts uint32, payload []byte) {
+				packet := rtp.Packet{
+					Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: ts, Marker: true},
+					Payload: payload,
+				}
+				data, err := packet.Marshal()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if client.aligned {
+					got = append(got, client.handleRTP(track, data)...)
+				} else {
+					client.pending = append(client.pending, client.handleRTP(track, data)...)
+				}
+			}
+
+			feed(audio, 1, tt.audio, []byte{1, 2, 3, 4})
+			if !tt.lateVideo {
+				feed(video, 1, tt.video, idr)
+			}
+			client.alignTracks()
+			got = append(client.pending, got...)
+			if tt.lateVideo {
+				feed(video, 1, tt.video, idr)
+			}
+			feed(audio, 2, tt.audio+800, []byte{5, 6, 7, 8})
+			feed(video, 2, tt.video+9000, slice)
+
+			// timing is the time and duration of one packet
+			type timing struct{ at, duration time.Duration }
+			sample := 4 * time.Second / 8000
+			want := map[int8][]timing{
+				0: {{tt.offset, 0}, {tt.offset + 100*time.Millisecond, 100 * time.Millisecond}},
+				1: {{0, sample}, {100 * time.Millisecond, sample}},
+			}
+			for idx, timings := range want {
+				var times []timing
+				for _, packet := range got {
+					if packet.Idx == idx {
+						times = append(times, timing{packet.Time, packet.Duration})
+					}
+				}
+				if !slices.Equal(times, timings) {
+					t.Fatalf("track %d timings = %v, want %v", idx, times, timings)
+				}
+			}
+		})
+	}
+
+	// Without RTP-Info or sender reports the tracks are aligned by when their first packets arrived
+	client := newRTSPClient("rtsp://camera/stream", RTSPOptions{})
+	client.codecs = []av.CodecData{testH264(t), codec.NewPCMMulawCodecData()}
+	video := &rtspClientTrack{media: sdp.Media{Type: av.H264}, idx: 0, clockRate: 90000}
+	audio := &rtspClientTrack{media: sdp.Media{Type: av.PCM_MULAW}, idx: 1, clockRate: 8000}
+	client.tracks = []*rtspClientTrack{video, audio}
+	for _, track := range []*rtspClientTrack{audio, video} {
+		packet := rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: 1, Timestamp: 12345}, Payload: []byte{1}}
+		data, err := packet.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.handleRTP(track, data)
+		time.Sleep(30 * time.Millisecond)
+	}
+	client.alignTracks()
+	if audio.offset != 0 || video.offset < 30*time.Millisecond || video.offset > time.Second {
+		t.Fatalf("offsets by arrival = audio %v, video %v; want 0 and about 30ms", audio.offset, video.offset)
+	}
+}
+
+// serveRTSPAuth answers every request on conn with 401 until authorized accepts its Authorization header
+func serveRTSPAuth(conn net.Conn, challenge string, authorized func(method, uri, auth string) bool, attempts *int) {
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		*attempts++
+
+		fields := strings.Fields(line)
+		status := "401 Unauthorized\r\nWWW-Authenticate: " + challenge
+		if authorized(fields[0], fields[1], header.Get("Authorization")) {
+			status = "200 OK"
+		}
+		fmt.Fprintf(conn, "RTSP/1.0 %s\r\nCSeq: %s\r\n\r\n", status, header.Get("CSeq"))
+	}
+}
+
+func TestRTSPClientAuth(t *testing.T) {
+	basic := func(user, password string) func(method, uri, auth string) bool {
+		return func(method, uri, auth string) bool {
+			return auth == "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+		}
+	}
+	digest := func(user, password string) func(method, uri, auth string) bool {
+		return func(method, uri, auth string) bool {
+			ha1 := fmt.Sprintf("%x", md5.Sum([]byte(user+":cam:"+password)))
+			ha2 := fmt.Sprintf("%x", md5.Sum([]byte(method+":"+uri)))
+			response := fmt.Sprintf("%x", md5.Sum([]byte(ha1+":n0nce:"+ha2)))
+			return strings.HasPrefix(auth, "Digest ") &&
+				rtspAuthParam(auth, "username") == user &&
+				rtspAuthParam(auth, "uri") == uri &&
+				rtspAuthParam(auth, "response") == response
+		}
+	}
+
+	tests := []struct {
+		name       string
+		user       string
+		password   string
+		challenge  string
+		authorized func(method, uri, auth string) bool
+		ok         bool
+		attempts   int
+	}{
+		{"basic", "admin", "secret", `Basic realm="cam"`, basic("admin", "secret"), true, 2},
+		{"digest", "admin", "secret", `Digest realm="cam", nonce="n0nce"`, digest("admin", "secret"), true, 2},
+		{"wrong password", "admin", "guess", `Digest realm="cam", nonce="n0nce"`, digest("admin", "secret"), false, 2},
+		{"no credentials are not retried", "", "", `Basic realm="cam"`, basic("admin", "secret"), false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, conn := net.Pipe()
+			defer conn.Close()
+
+			attempts := 0
+			served := make(chan struct{})
+			go func() {
+				defer close(served)
+				serveRTSPAuth(server, tt.challenge, tt.authorized, &attempts)
+			}()
+
+			client := newRTSPClient("rtsp://camera/stream", RTSPOptions{})
+			client.conn = conn
+			client.reader = bufio.NewReader(conn)
+			client.username, client.password = tt.user, tt.password
+
+			_, err := client.request("DESCRIBE", "rtsp://camera:554/stream", nil)
+			if (err == nil) != tt.ok {
+				t.Fatalf("request() = %v, want ok %v", err, tt.ok)
+			}
+
+			conn.Close()
+			<-served
+			if attempts != tt.attempts {
+				t.Fatalf("server saw %d requests, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+// freeUDPPortPair finds an even UDP port whose odd neighbour is also free
+func freeUDPPortPair(t *testing.T) int {
+	t.Helper()
+
+	for attempt := 0; attempt < 20; attempt++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port &^ 1
+		conn.Close()
+
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err != nil {
+			continue
+		}
+		rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+		rtpConn.Close()
+		if err != nil {
+			continue
+		}
+		rtcpConn.Close()
+		return port
+	}
+
+	t.Fatal("no free UDP port pair")
+	return 0
+}
+
+func TestRTSPClientPull(t *testing.T) {
+	configs.GlobalConfig.RtspServerPort = "0"
+	configs.GlobalConfig.RtspServerUdpPort = freeUDPPortPair(t)
+	defer func() {
+		configs.GlobalConfig.RtspServerUdpPort = 0
+	}()
+
+	const id = "cam1"
+	sm := NewStreamManager()
+	sm.AddStream(id, "rtmp://publisher", false)
+
+	// A pushed stream has no worker to start, so the test feeds the packets itself
+	if err := sm.SetRTMPSource(id, "key"); err != nil {
+		t.Fatal(err)
+	}
+	sm.UpdateCodecs(id, []av.CodecData{testH264(t), testAAC(t)})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go feedRTSPStream(sm, id, stop)
+
+	server, err := StartRTSPServer(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	url := fmt.Sprintf("rtsp://127.0.0.1:%d/%s", server.listener.Addr().(*net.TCPAddr).Port, id)
+
+	for _, transport := range []string{RTSPTransportTCP, RTSPTransportUDP, RTSPTransportAuto} {
+		t.Run(transport, func(t *testing.T) {
+			source, err := newSource(url, RTSPOptions{Transport: transport})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := source.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer source.Close()
+
+			codecs := source.Codecs()
+			if len(codecs) != 2 || codecs[0].Type() != av.H264 || codecs[1].Type() != av.AAC {
+				t.Fatalf("Codecs() = %v, want H264 and AAC", codecs)
+			}
+
+			// Video must start on a keyframe once the first one arrives, and audio must follow
+			seen := make(map[int8]bool)
+			timeout := time.After(10 * time.Second)
+			for !seen[0] || !seen[1] {
+				select {
+				case packet, ok := <-source.Packets():
+					if !ok {
+						t.Fatalf("packets closed: %v", source.Err())
+					}
+					if packet.Idx == 0 && !seen[0] && !packet.IsKeyFrame {
+						continue
+					}
+					seen[packet.Idx] = true
+				case <-timeout:
+					t.Fatalf("timed out, received %v", seen)
+				}
+			}
+
+			if err := source.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// Closing again is harmless
+			if err := source.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for range source.Packets() {
+			}
+			if err := source.Err(); err != nil {
+				t.Fatalf("Err() after Close = %v", err)
+			}
+		})
+	}
+}
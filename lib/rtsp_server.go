@@ -0,0 +1,922 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/aacparser"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	rtpcodecs "github.com/pion/rtp/codecs"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// Limits for RTSP client sessions
+const (
+	rtspSessionTimeout = 60 * time.Second
+	rtspMaxBodySize    = 64 * 1024
+	rtspPayloadMTU     = 1400
+
+	// rtspSenderReportInterval is how often each track sends an RTCP sender report while packets flow
+	rtspSenderReportInterval = 5 * time.Second
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and the Unix epoch
+const ntpEpochOffset = 2208988800
+
+// rtspStatusText holds the reason phrases of the RTSP status codes the server sends
+var rtspStatusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	404: "Not Found",
+	415: "Unsupported Media Type",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	461: "Unsupported Transport",
+	501: "Not Implemented",
+	503: "Service Unavailable",
+}
+
+// errRTSPBadRequest marks requests that cannot be parsed; the connection is closed after replying
+var errRTSPBadRequest = errors.New("rtsp bad request")
+
+// RTSPServer serves managed streams to RTSP clients, fanning out from each stream's single source connection
+type RTSPServer struct {
+	manager  *StreamManager
+	listener net.Listener
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+	mutex    sync.Mutex
+	conns    map[*rtspConn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// rtspConn is one RTSP control connection; it owns at most one session
+type rtspConn struct {
+	server     *RTSPServer
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+	session    *rtspSession
+}
+
+// rtspSession is a set of tracks of one stream set up by a client, fed from a viewer channel once playing
+type rtspSession struct {
+	id       string
+	streamID string
+	clientID string
+	codecs   []av.CodecData
+	tracks   map[int8]*rtspTrack
+	playing  bool
+	done     chan struct{}
+	finished chan struct{}
+}
+
+// rtspTrack is an outgoing RTP track and where its packets are sent
+type rtspTrack struct {
+	codec       av.CodecData
+	media       rtspMedia
+	payloader   rtp.Payloader
+	ssrc        uint32
+	seq         uint16
+	tsBase      uint32
+	interleaved bool
+	channel     int
+	clientRTP   *net.UDPAddr
+	clientRTCP  *net.UDPAddr
+	clientPorts [2]int
+
+	// Sender statistics for RTCP sender reports
+	packets    uint32
+	octets     uint32
+	lastReport time.Time
+}
+
+// rtspMedia describes how a source codec is carried over RTP and announced in SDP
+type rtspMedia struct {
+	kind        string
+	payloadType uint8
+	clockRate   uint32
+	rtpmap      string
+	fmtp        string
+}
+
+// rtspRequest is a parsed RTSP request
+type rtspRequest struct {
+	method string
+	url    *url.URL
+	header textproto.MIMEHeader
+}
+
+// StartRTSPServer listens for RTSP clients on the configured port, plus the RTP/RTCP port pair when UDP is enabled
+func StartRTSPServer(manager *StreamManager) (*RTSPServer, error) {
+	listener, err := net.Listen("tcp", ":"+configs.GlobalConfig.RtspServerPort)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &RTSPServer{
+		manager:  manager,
+		listener: listener,
+		conns:    make(map[*rtspConn]struct{}),
+	}
+
+	if port := configs.GlobalConfig.RtspServerUdpPort; port > 0 {
+		if server.rtpConn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port}); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if server.rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port + 1}); err != nil {
+			server.rtpConn.Close()
+			listener.Close()
+			return nil, err
+		}
+
+		// Receiver reports are not used, but the socket is drained so they do not pile up; Stop ends the loop
+		go server.discardRTCP()
+	}
+
+	server.wg.Add(1)
+	go server.acceptLoop()
+
+	return server, nil
+}
+
+// Stop closes the listener and every client connection and waits for them to finish
+func (s *RTSPServer) Stop() {
+	s.listener.Close()
+
+	s.mutex.Lock()
+	s.closed = true
+	for rc := range s.conns {
+		rc.conn.Close()
+	}
+	s.mutex.Unlock()
+
+	s.wg.Wait()
+
+	if s.rtpConn != nil {
+		s.rtpConn.Close()
+		s.rtcpConn.Close()
+	}
+}
+
+// discardRTCP reads and drops RTCP sent by UDP clients until the socket is closed
+func (s *RTSPServer) discardRTCP() {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := s.rtcpConn.ReadFromUDP(buf); err != nil {
+			return
+		}
+	}
+}
+
+// acceptLoop hands each accepted connection to its own goroutine until the listener is closed
+func (s *RTSPServer) acceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		rc := &rtspConn{server: s, conn: conn, reader: bufio.NewReader(conn)}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[rc] = struct{}{}
+		s.wg.Add(1)
+		s.mutex.Unlock()
+
+		go rc.serve()
+	}
+}
+
+// serve answers requests until the client disconnects; the session ends with the connection
+func (rc *rtspConn) serve() {
+	defer func() {
+		rc.stopSession()
+		rc.conn.Close()
+
+		rc.server.mutex.Lock()
+		delete(rc.server.conns, rc)
+		rc.server.mutex.Unlock()
+		rc.server.wg.Done()
+	}()
+
+	for {
+		// Clients playing over TCP need not send keepalives; the connection itself shows they are alive
+		if rc.session != nil && rc.session.playing && rc.session.interleavedOnly() {
+			rc.conn.SetReadDeadline(time.Time{})
+		} else {
+			rc.conn.SetReadDeadline(time.Now().Add(rtspSessionTimeout))
+		}
+
+		req, err := rc.readRequest()
+		if errors.Is(err, errRTSPBadRequest) {
+			rc.writeResponse(nil, 400, nil, "")
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		rc.handle(req)
+	}
+}
+
+// readRequest reads the next request, skipping interleaved RTCP frames sent by the client
+func (rc *rtspConn) readRequest() (*rtspRequest, error) {
+	for {
+		first, err := rc.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] != '$' {
+			break
+		}
+
+		var frame [4]byte
+		if _, err := io.ReadFull(rc.reader, frame[:]); err != nil {
+			return nil, err
+		}
+		if _, err := rc.reader.Discard(int(binary.BigEndian.Uint16(frame[2:]))); err != nil {
+			return nil, err
+		}
+	}
+
+	reader := textproto.NewReader(rc.reader)
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[2] != "RTSP/1.0" {
+		return nil, errRTSPBadRequest
+	}
+
+	requestURL, err := url.Parse(fields[1])
+	if err != nil {
+		return nil, errRTSPBadRequest
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, errRTSPBadRequest
+	}
+
+	// Request bodies are not used by any supported method
+	if length := header.Get("Content-Length"); length != "" {
+		size, err := strconv.Atoi(length)
+		if err != nil || size < 0 || size > rtspMaxBodySize {
+			return nil, errRTSPBadRequest
+		}
+		if _, err := rc.reader.Discard(size); err != nil {
+			return nil, err
+		}
+	}
+
+	return &rtspRequest{method: fields[0], url: requestURL, header: header}, nil
+}
+
+// writeResponse sends a response echoing the request's CSeq
+func (rc *rtspConn) writeResponse(req *rtspRequest, status int, header map[string]string, body string) error {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "RTSP/1.0 %d %s\r\n", status, rtspStatusText[status])
+	if req != nil {
+		fmt.Fprintf(&buf, "CSeq: %s\r\n", req.header.Get("CSeq"))
+	}
+
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, header[key])
+	}
+
+	if body != "" {
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n", len(body))
+	}
+	buf.WriteString("\r\n")
+	buf.WriteString(body)
+
+	rc.writeMutex.Lock()
+	defer rc.writeMutex.Unlock()
+
+	rc.conn.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+	_, err := io.WriteString(rc.conn, buf.String())
+	return err
+}
+
+// handle dispatches a request by method
+func (rc *rtspConn) handle(req *rtspRequest) {
+	switch req.method {
+	case "OPTIONS":
+		rc.writeResponse(req, 200, map[string]string{"Public": "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"}, "")
+	case "DESCRIBE":
+		rc.handleDescribe(req)
+	case "SETUP":
+		rc.handleSetup(req)
+	case "PLAY":
+		rc.handlePlay(req)
+	case "TEARDOWN":
+		rc.handleTeardown(req)
+	case "GET_PARAMETER":
+		// Used by clients as a keepalive, with or without a session
+		if req.header.Get("Session") == "" {
+			rc.writeResponse(req, 200, nil, "")
+		} else if rc.checkSession(req) {
+			rc.writeResponse(req, 200, rc.sessionHeader(), "")
+		}
+	default:
+		rc.writeResponse(req, 501, nil, "")
+	}
+}
+
+// handleDescribe starts the stream if needed and answers with an SDP listing its RTP compatible tracks
+func (rc *rtspConn) handleDescribe(req *rtspRequest) {
+	streamID, _ := rtspStreamPath(req.url)
+	manager := rc.server.manager
+
+	if streamID == "" || lookupStream(manager, streamID) != nil {
+		rc.writeResponse(req, 404, nil, "")
+		return
+	}
+
+	// An on-demand worker started here stops on its own if the client never plays
+	manager.StartWorker(streamID)
+
+	codecs, err := manager.GetCodecs(streamID)
+	if err != nil {
+		log.Printf("Error getting codecs for CCTV ID %s: %v", streamID, err)
+		rc.writeResponse(req, 503, nil, "")
+		return
+	}
+
+	sdp, ok := rtspSDP(streamID, codecs)
+	if !ok {
+		rc.writeResponse(req, 415, nil, "")
+		return
+	}
+
+	base := *req.url
+	base.RawQuery = ""
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+
+	rc.writeResponse(req, 200, map[string]string{
+		"Content-Base": base.String(),
+		"Content-Type": "application/sdp",
+	}, sdp)
+}
+
+// handleSetup adds one track to the session, creating the session on the first call
+func (rc *rtspConn) handleSetup(req *rtspRequest) {
+	streamID, trackIdx := rtspStreamPath(req.url)
+	manager := rc.server.manager
+
+	if rc.session != nil {
+		if !rc.checkSession(req) {
+			return
+		}
+		if rc.session.playing || rc.session.streamID != streamID {
+			rc.writeResponse(req, 455, nil, "")
+			return
+		}
+	} else if req.header.Get("Session") != "" {
+		rc.writeResponse(req, 454, nil, "")
+		return
+	}
+
+	var codecs []av.CodecData
+	if rc.session != nil {
+		codecs = rc.session.codecs
+	} else if streamID != "" && lookupStream(manager, streamID) == nil {
+		manager.StartWorker(streamID)
+
+		var err error
+		if codecs, err = manager.GetCodecs(streamID); err != nil {
+			rc.writeResponse(req, 503, nil, "")
+			return
+		}
+	}
+
+	// A SETUP on the aggregate URL selects the first supported track
+	if trackIdx < 0 {
+		for i, codec := range codecs {
+			if _, ok := rtspMediaFor(i, codec); ok {
+				trackIdx = i
+				break
+			}
+		}
+	}
+	if trackIdx < 0 || trackIdx >= len(codecs) {
+		rc.writeResponse(req, 404, nil, "")
+		return
+	}
+
+	codec := codecs[trackIdx]
+	media, ok := rtspMediaFor(trackIdx, codec)
+	if !ok {
+		rc.writeResponse(req, 404, nil, "")
+		return
+	}
+
+	track := &rtspTrack{
+		codec:     codec,
+		media:     media,
+		payloader: newRTSPPayloader(codec),
+		ssrc:      rand.Uint32(),
+		seq:       uint16(rand.Uint32()),
+		tsBase:    rand.Uint32(),
+	}
+	if !rc.parseTransport(req.header.Get("Transport"), trackIdx, track) {
+		rc.writeResponse(req, 461, nil, "")
+		return
+	}
+
+	if rc.session == nil {
+		rc.session = &rtspSession{
+			id:       strings.ReplaceAll(generateUUID(), "-", ""),
+			streamID: streamID,
+			codecs:   codecs,
+			tracks:   make(map[int8]*rtspTrack),
+		}
+	}
+	rc.session.tracks[int8(trackIdx)] = track
+
+	var transport string
+	if track.interleaved {
+		transport = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X", track.channel, track.channel+1, track.ssrc)
+	} else {
+		port := rc.server.rtpConn.LocalAddr().(*net.UDPAddr).Port
+		transport = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d;server_port=%d-%d;ssrc=%08X",
+			track.clientPorts[0], track.clientPorts[1], port, port+1, track.ssrc)
+	}
+
+	header := rc.sessionHeader()
+	header["Transport"] = transport
+	rc.writeResponse(req, 200, header, "")
+}
+
+// parseTransport picks the first acceptable transport the client offered: TCP interleaved, or unicast UDP when enabled
+func (rc *rtspConn) parseTransport(value string, trackIdx int, track *rtspTrack) bool {
+	for _, spec := range strings.Split(value, ",") {
+		params := strings.Split(strings.TrimSpace(spec), ";")
+
+		var interleaved, clientPorts string
+		multicast := false
+		for _, param := range params[1:] {
+			key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+			switch key {
+			case "interleaved":
+				interleaved = val
+			case "client_port":
+				clientPorts = val
+			case "multicast":
+				multicast = true
+			}
+		}
+
+		switch params[0] {
+		case "RTP/AVP/TCP":
+			track.interleaved = true
+			track.channel = 2 * trackIdx
+			if interleaved != "" {
+				first, _, _ := strings.Cut(interleaved, "-")
+				channel, err := strconv.Atoi(first)
+				if err != nil || channel < 0 || channel > 254 {
+					continue
+				}
+				track.channel = channel
+			}
+			return true
+
+		case "RTP/AVP", "RTP/AVP/UDP":
+			if multicast || rc.server.rtpConn == nil || clientPorts == "" {
+				continue
+			}
+
+			first, second, found := strings.Cut(clientPorts, "-")
+			rtpPort, err := strconv.Atoi(first)
+			if err != nil || rtpPort <= 0 || rtpPort > 65535 {
+				continue
+			}
+			rtcpPort := rtpPort + 1
+			if found {
+				if rtcpPort, err = strconv.Atoi(second); err != nil {
+					continue
+				}
+			}
+
+			// Packets only ever go to the address the control connection came from
+			host := rc.conn.RemoteAddr().(*net.TCPAddr).IP
+			track.clientRTP = &net.UDPAddr{IP: host, Port: rtpPort}
+			track.clientRTCP = &net.UDPAddr{IP: host, Port: rtcpPort}
+			track.clientPorts = [2]int{rtpPort, rtcpPort}
+			return true
+		}
+	}
+
+	return false
+}
+
+// handlePlay registers the session as a viewer and starts sending RTP from the cached GOP
+func (rc *rtspConn) handlePlay(req *rtspRequest) {
+	if !rc.checkSession(req) {
+		return
+	}
+
+	session := rc.session
+	if len(session.tracks) == 0 {
+		rc.writeResponse(req, 455, nil, "")
+		return
+	}
+
+	header := rc.sessionHeader()
+	header["Range"] = "npt=0.000-"
+
+	if session.playing {
+		rc.writeResponse(req, 200, header, "")
+		return
+	}
+
+	manager := rc.server.manager
+	clientID, packets, gop, err := manager.AddClientFromKeyframe(session.streamID, ViewerRTSP)
+	if err != nil {
+		rc.writeResponse(req, 404, nil, "")
+		return
+	}
+
+	manager.StartWorker(session.streamID)
+
+	base := *req.url
+	base.RawQuery = ""
+	base.Path = "/" + session.streamID
+
+	indexes := make([]int, 0, len(session.tracks))
+	for idx := range session.tracks {
+		indexes = append(indexes, int(idx))
+	}
+	sort.Ints(indexes)
+
+	info := make([]string, 0, len(indexes))
+	for _, idx := range indexes {
+		info = append(info, fmt.Sprintf("url=%s/trackID=%d;seq=%d", base.String(), idx, session.tracks[int8(idx)].seq))
+	}
+	header["RTP-Info"] = strings.Join(info, ",")
+
+	// The reply has to go out before the first RTP packet
+	if err := rc.writeResponse(req, 200, header, ""); err != nil {
+		manager.RemoveClient(session.streamID, clientID)
+		return
+	}
+
+	session.clientID = clientID
+	session.playing = true
+	session.done = make(chan struct{})
+	session.finished = make(chan struct{})
+	go rc.play(session, packets, gop)
+}
+
+// handleTeardown ends the session; the connection stays open for further requests
+func (rc *rtspConn) handleTeardown(req *rtspRequest) {
+	if !rc.checkSession(req) {
+		return
+	}
+
+	rc.stopSession()
+	rc.writeResponse(req, 200, nil, "")
+}
+
+// checkSession verifies the request names the connection's session, replying 454 otherwise
+func (rc *rtspConn) checkSession(req *rtspRequest) bool {
+	id, _, _ := strings.Cut(req.header.Get("Session"), ";")
+	if rc.session == nil || strings.TrimSpace(id) != rc.session.id {
+		rc.writeResponse(req, 454, nil, "")
+		return false
+	}
+	return true
+}
+
+// sessionHeader returns the Session header of the connection's session
+func (rc *rtspConn) sessionHeader() map[string]string {
+	return map[string]string{
+		"Session": rc.session.id + ";timeout=" + strconv.Itoa(int(rtspSessionTimeout.Seconds())),
+	}
+}
+
+// stopSession stops a playing session and waits until it left the stream's viewers
+func (rc *rtspConn) stopSession() {
+	session := rc.session
+	rc.session = nil
+
+	if session == nil || !session.playing {
+		return
+	}
+
+	close(session.done)
+	<-session.finished
+}
+
+// interleavedOnly reports whether every track of the session is sent over the control connection
+func (s *rtspSession) interleavedOnly() bool {
+	for _, track := range s.tracks {
+		if !track.interleaved {
+			return false
+		}
+	}
+	return true
+}
+
+// play forwards packets from the first keyframe on; when the stream ends or the client stalls the connection is closed
+func (rc *rtspConn) play(s *rtspSession, packets chan av.Packet, gop []av.Packet) {
+	defer close(s.finished)
+	defer rc.server.manager.RemoveClient(s.streamID, s.clientID)
+
+	hasVideo := false
+	for _, track := range s.tracks {
+		hasVideo = hasVideo || track.codec.Type().IsVideo()
+	}
+
+	started := !hasVideo
+	write := func(pkt av.Packet) error {
+		track, ok := s.tracks[pkt.Idx]
+		if !ok {
+			return nil
+		}
+
+		if !started {
+			if !pkt.IsKeyFrame {
+				return nil
+			}
+			started = true
+		}
+
+		return rc.writeRTP(track, pkt)
+	}
+
+	for _, pkt := range gop {
+		if err := write(pkt); err != nil {
+			rc.conn.Close()
+			return
+		}
+	}
+
+	noVideoTimer := time.NewTimer(viewerNoVideoTimeout)
+	defer noVideoTimer.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case <-noVideoTimer.C:
+			log.Printf("RTSP client for CCTV ID %s stopping: no video", s.streamID)
+			rc.conn.Close()
+			return
+
+		case pkt, ok := <-packets:
+			if !ok {
+				rc.conn.Close()
+				return
+			}
+
+			if pkt.IsKeyFrame || !hasVideo {
+				noVideoTimer.Reset(viewerNoVideoTimeout)
+			}
+
+			if err := write(pkt); err != nil {
+				log.Printf("Error writing RTP for CCTV ID %s: %v", s.streamID, err)
+				rc.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// writeRTP packetizes one packet and sends it interleaved on the control connection or over UDP
+func (rc *rtspConn) writeRTP(track *rtspTrack, pkt av.Packet) error {
+	payloads := track.payloader.Payload(rtspPayloadMTU, annexBPayload(track.codec, pkt))
+	timestamp := track.tsBase + rtpTimestamp(pkt.Time, track.media.clockRate)
+	isVideo := track.codec.Type().IsVideo()
+
+	var frames []byte
+	for i, payload := range payloads {
+		packet := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         isVideo && i == len(payloads)-1,
+				PayloadType:    track.media.payloadType,
+				SequenceNumber: track.seq,
+				Timestamp:      timestamp,
+				SSRC:           track.ssrc,
+			},
+			Payload: payload,
+		}
+		track.seq++
+		track.packets++
+		track.octets += uint32(len(payload))
+
+		data, err := packet.Marshal()
+		if err != nil {
+			return err
+		}
+
+		if !track.interleaved {
+			if _, err := rc.server.rtpConn.WriteToUDP(data, track.clientRTP); err != nil {
+				return err
+			}
+			continue
+		}
+
+		frames = append(frames, '$', byte(track.channel), byte(len(data)>>8), byte(len(data)))
+		frames = append(frames, data...)
+	}
+
+	// The sender report maps the timestamp just sent to the wall clock, so players can sync the tracks
+	if now := time.Now(); now.Sub(track.lastReport) >= rtspSenderReportInterval {
+		track.lastReport = now
+
+		report, err := (&rtcp.SenderReport{
+			SSRC:        track.ssrc,
+			NTPTime:     ntpTime(now),
+			RTPTime:     timestamp,
+			PacketCount: track.packets,
+			OctetCount:  track.octets,
+		}).Marshal()
+		if err != nil {
+			return err
+		}
+
+		if track.interleaved {
+			frames = append(frames, '$', byte(track.channel+1), byte(len(report)>>8), byte(len(report)))
+			frames = append(frames, report...)
+		} else if _, err := rc.server.rtcpConn.WriteToUDP(report, track.clientRTCP); err != nil {
+			return err
+		}
+	}
+
+	if len(frames) == 0 {
+		return nil
+	}
+
+	rc.writeMutex.Lock()
+	defer rc.writeMutex.Unlock()
+
+	rc.conn.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+	_, err := rc.conn.Write(frames)
+	return err
+}
+
+// rtpTimestamp converts a packet time to clock units without overflowing on long-running streams
+func rtpTimestamp(t time.Duration, clockRate uint32) uint32 {
+	seconds := uint64(t / time.Second)
+	remainder := uint64(t % time.Second)
+	return uint32(seconds*uint64(clockRate) + remainder*uint64(clockRate)/uint64(time.Second))
+}
+
+// ntpTime converts a wall-clock time to the 64-bit NTP timestamp format used in RTCP
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
+
+// rtspStreamPath splits a request URL into the stream ID and the track index, -1 for the aggregate URL
+func rtspStreamPath(u *url.URL) (string, int) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	trackIdx := -1
+	if last := parts[len(parts)-1]; len(parts) > 1 && strings.HasPrefix(last, "trackID=") {
+		idx, err := strconv.Atoi(strings.TrimPrefix(last, "trackID="))
+		if err != nil {
+			return "", -1
+		}
+		trackIdx = idx
+	}
+
+	return parts[0], trackIdx
+}
+
+// rtspSDP describes the RTP compatible tracks of a stream; track controls are relative to the Content-Base
+func rtspSDP(streamID string, codecs []av.CodecData) (string, bool) {
+	var sdp strings.Builder
+	sdp.WriteString("v=0\r\n")
+	fmt.Fprintf(&sdp, "o=- %d 1 IN IP4 0.0.0.0\r\n", time.Now().UnixNano())
+	fmt.Fprintf(&sdp, "s=%s\r\n", streamID)
+	sdp.WriteString("c=IN IP4 0.0.0.0\r\n")
+	sdp.WriteString("t=0 0\r\n")
+	sdp.WriteString("a=control:*\r\n")
+
+	tracks := 0
+	for i, codec := range codecs {
+		media, ok := rtspMediaFor(i, codec)
+		if !ok {
+			continue
+		}
+		tracks++
+
+		fmt.Fprintf(&sdp, "m=%s 0 RTP/AVP %d\r\n", media.kind, media.payloadType)
+		fmt.Fprintf(&sdp, "a=rtpmap:%d %s\r\n", media.payloadType, media.rtpmap)
+		if media.fmtp != "" {
+			fmt.Fprintf(&sdp, "a=fmtp:%d %s\r\n", media.payloadType, media.fmtp)
+		}
+		fmt.Fprintf(&sdp, "a=control:trackID=%d\r\n", i)
+	}
+
+	return sdp.String(), tracks > 0
+}
+
+// rtspMediaFor maps a source codec to its RTP payload format; dynamic payload types are numbered by track
+func rtspMediaFor(idx int, codec av.CodecData) (rtspMedia, bool) {
+	dynamic := uint8(96 + idx%32)
+
+	switch codec.Type() {
+	case av.H264:
+		h264 := codec.(h264parser.CodecData)
+		fmtp := "packetization-mode=1"
+		if sps := h264.SPS(); len(sps) >= 4 {
+			fmtp += fmt.Sprintf(";profile-level-id=%02X%02X%02X", sps[1], sps[2], sps[3])
+		}
+		fmtp += ";sprop-parameter-sets=" + base64.StdEncoding.EncodeToString(h264.SPS()) + "," + base64.StdEncoding.EncodeToString(h264.PPS())
+		return rtspMedia{kind: "video", payloadType: dynamic, clockRate: 90000, rtpmap: "H264/90000", fmtp: fmtp}, true
+
+	case av.H265:
+		h265 := codec.(h265parser.CodecData)
+		fmtp := "sprop-vps=" + base64.StdEncoding.EncodeToString(h265.VPS()) +
+			";sprop-sps=" + base64.StdEncoding.EncodeToString(h265.SPS()) +
+			";sprop-pps=" + base64.StdEncoding.EncodeToString(h265.PPS())
+		return rtspMedia{kind: "video", payloadType: dynamic, clockRate: 90000, rtpmap: "H265/90000", fmtp: fmtp}, true
+
+	case av.AAC:
+		aac := codec.(aacparser.CodecData)
+		rate := uint32(aac.SampleRate())
+		fmtp := "profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=" + hex.EncodeToString(aac.MPEG4AudioConfigBytes())
+		rtpmap := fmt.Sprintf("mpeg4-generic/%d/%d", rate, aac.ChannelLayout().Count())
+		return rtspMedia{kind: "audio", payloadType: dynamic, clockRate: rate, rtpmap: rtpmap, fmtp: fmtp}, true
+
+	case av.OPUS:
+		return rtspMedia{kind: "audio", payloadType: dynamic, clockRate: 48000, rtpmap: "opus/48000/2"}, true
+
+	case av.PCM_ALAW:
+		return rtspMedia{kind: "audio", payloadType: 8, clockRate: 8000, rtpmap: "PCMA/8000"}, true
+
+	case av.PCM_MULAW:
+		return rtspMedia{kind: "audio", payloadType: 0, clockRate: 8000, rtpmap: "PCMU/8000"}, true
+	}
+
+	return rtspMedia{}, false
+}
+
+// newRTSPPayloader returns the RTP payloader for a codec accepted by rtspMediaFor
+func newRTSPPayloader(codec av.CodecData) rtp.Payloader {
+	switch codec.Type() {
+	case av.H264:
+		return &rtpcodecs.H264Payloader{}
+	case av.H265:
+		return &rtpcodecs.H265Payloader{}
+	case av.AAC:
+		return aacPayloader{}
+	case av.OPUS:
+		return &rtpcodecs.OpusPayloader{}
+	}
+	return &rtpcodecs.G711Payloader{}
+}
+
+// aacPayloader packs one AAC frame per RTP packet with a single AU header (RFC 3640 AAC-hbr)
+type aacPayloader struct{}
+
+func (aacPayloader) Payload(mtu uint16, frame []byte) [][]byte {
+	payload := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint16(payload[0:], 16)
+	binary.BigEndian.PutUint16(payload[2:], uint16(len(frame))<<3)
+	copy(payload[4:], frame)
+	return [][]byte{payload}
+}
@@ -0,0 +1,270 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// rtspTestClient speaks just enough RTSP to drive the server over one TCP connection
+type rtspTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	cseq   int
+}
+
+// request sends a request and returns the response status, headers and body
+func (c *rtspTestClient) request(method, url string, header map[string]string) (int, textproto.MIMEHeader, string) {
+	c.t.Helper()
+
+	c.cseq++
+	msg := fmt.Sprintf("%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, url, c.cseq)
+	for key, value := range header {
+		msg += key + ": " + value + "\r\n"
+	}
+	if _, err := io.WriteString(c.conn, msg+"\r\n"); err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+
+	// Media may still be flowing while the reply is on its way
+	for {
+		first, err := c.reader.Peek(1)
+		if err != nil {
+			c.t.Fatalf("%s: %v", method, err)
+		}
+		if first[0] != '$' {
+			break
+		}
+		c.readFrame()
+	}
+
+	reader := textproto.NewReader(c.reader)
+	line, err := reader.ReadLine()
+	if err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "RTSP/1.0" {
+		c.t.Fatalf("%s: bad status line %q", method, line)
+	}
+	status, _ := strconv.Atoi(fields[1])
+
+	respHeader, err := reader.ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+	if got := respHeader.Get("CSeq"); got != strconv.Itoa(c.cseq) {
+		c.t.Fatalf("%s: CSeq = %q, want %d", method, got, c.cseq)
+	}
+
+	var body []byte
+	if length, _ := strconv.Atoi(respHeader.Get("Content-Length")); length > 0 {
+		body = make([]byte, length)
+		if _, err := io.ReadFull(c.reader, body); err != nil {
+			c.t.Fatalf("%s: %v", method, err)
+		}
+	}
+
+	return status, respHeader, string(body)
+}
+
+// readFrame reads one interleaved binary frame
+func (c *rtspTestClient) readFrame() (int, []byte) {
+	c.t.Helper()
+
+	var frame [4]byte
+	if _, err := io.ReadFull(c.reader, frame[:]); err != nil {
+		c.t.Fatalf("reading interleaved frame: %v", err)
+	}
+	if frame[0] != '$' {
+		c.t.Fatalf("interleaved frame starts with %q", frame[0])
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(frame[2:]))
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		c.t.Fatalf("reading interleaved frame: %v", err)
+	}
+	return int(frame[1]), data
+}
+
+// feedRTSPStream broadcasts 25 fps H.264 with a keyframe every second and AAC frames until stop closes
+func feedRTSPStream(sm *StreamManager, id string, stop chan struct{}) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	keyframe := []byte{0, 0, 0, 4, 0x65, 0x88, 0x84, 0x00}
+	frame := []byte{0, 0, 0, 4, 0x41, 0x9a, 0x02, 0x00}
+	audio := []byte{0x21, 0x10, 0x04, 0x60, 0x8c, 0x1c}
+
+	for tick := 0; ; tick++ {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Duration(tick) * 20 * time.Millisecond
+		sm.BroadcastPacket(id, av.Packet{Idx: 1, Time: now, Data: audio})
+
+		if tick%2 == 0 {
+			video := av.Packet{Idx: 0, Time: now, Data: frame}
+			if tick%50 == 0 {
+				video.IsKeyFrame = true
+				video.Data = keyframe
+			}
+			sm.BroadcastPacket(id, video)
+		}
+	}
+}
+
+func TestRTSPServerInterleaved(t *testing.T) {
+	configs.GlobalConfig.RtspServerPort = "0"
+	configs.GlobalConfig.RtspServerUdpPort = 0
+
+	const id = "cam1"
+	sm := NewStreamManager()
+	sm.AddStream(id, "rtmp://publisher", false)
+
+	// A pushed stream has no worker to start, so the test feeds the packets itself
+	if err := sm.SetRTMPSource(id, "key"); err != nil {
+		t.Fatal(err)
+	}
+	sm.UpdateCodecs(id, []av.CodecData{testH264(t), testAAC(t)})
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go feedRTSPStream(sm, id, stop)
+
+	server, err := StartRTSPServer(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+
+	client := &rtspTestClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	base := "rtsp://" + server.listener.Addr().String() + "/" + id
+
+	status, header, sdp := client.request("DESCRIBE", base, map[string]string{"Accept": "application/sdp"})
+	if status != 200 {
+		t.Fatalf("DESCRIBE = %d, want 200", status)
+	}
+	if header.Get("Content-Type") != "application/sdp" || header.Get("Content-Base") != base+"/" {
+		t.Fatalf("DESCRIBE headers = %v", header)
+	}
+	for _, want := range []string{"m=video 0 RTP/AVP 96", "a=rtpmap:96 H264/90000", "m=audio 0 RTP/AVP 97", "a=rtpmap:97 mpeg4-generic/44100/2", "a=control:trackID=1"} {
+		if !strings.Contains(sdp, want) {
+			t.Fatalf("SDP missing %q:\n%s", want, sdp)
+		}
+	}
+
+	// Set up both tracks on their own channel pairs, sharing one session
+	ssrcs := make(map[int]uint32)
+	var session string
+	for track, channel := range []int{0, 2} {
+		transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1)
+		request := map[string]string{"Transport": transport}
+		if session != "" {
+			request["Session"] = session
+		}
+
+		status, header, _ := client.request("SETUP", base+"/trackID="+strconv.Itoa(track), request)
+		if status != 200 {
+			t.Fatalf("SETUP track %d = %d, want 200", track, status)
+		}
+		session, _, _ = strings.Cut(header.Get("Session"), ";")
+
+		reply := header.Get("Transport")
+		if !strings.HasPrefix(reply, transport+";ssrc=") {
+			t.Fatalf("SETUP track %d Transport = %q", track, reply)
+		}
+		ssrc, err := strconv.ParseUint(strings.TrimPrefix(reply, transport+";ssrc="), 16, 32)
+		if err != nil {
+			t.Fatalf("SETUP track %d ssrc: %v", track, err)
+		}
+		ssrcs[channel] = uint32(ssrc)
+	}
+
+	status, header, _ = client.request("PLAY", base+"/", map[string]string{"Session": session})
+	if status != 200 {
+		t.Fatalf("PLAY = %d, want 200", status)
+	}
+	if !strings.Contains(header.Get("RTP-Info"), "trackID=0;seq=") {
+		t.Fatalf("PLAY RTP-Info = %q", header.Get("RTP-Info"))
+	}
+
+	// Each track sends RTP on its channel and an RTCP sender report on the next one
+	rtpSeen := make(map[int]bool)
+	reports := make(map[int]*rtcp.SenderReport)
+	for len(rtpSeen) < 2 || len(reports) < 2 {
+		channel, data := client.readFrame()
+
+		if rtpChannel := channel &^ 1; ssrcs[rtpChannel] == 0 {
+			t.Fatalf("frame on unexpected channel %d", channel)
+		}
+
+		if channel%2 == 0 {
+			var packet rtp.Packet
+			if err := packet.Unmarshal(data); err != nil {
+				t.Fatalf("channel %d: %v", channel, err)
+			}
+			if packet.SSRC != ssrcs[channel] {
+				t.Fatalf("channel %d RTP SSRC = %08X, want %08X", channel, packet.SSRC, ssrcs[channel])
+			}
+			rtpSeen[channel] = true
+			continue
+		}
+
+		packets, err := rtcp.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("channel %d: %v", channel, err)
+		}
+		report, ok := packets[0].(*rtcp.SenderReport)
+		if !ok {
+			t.Fatalf("channel %d RTCP = %T, want a sender report", channel, packets[0])
+		}
+		if !rtpSeen[channel-1] {
+			t.Fatalf("channel %d sender report before any RTP", channel)
+		}
+		reports[channel-1] = report
+	}
+
+	now := time.Now()
+	for channel, report := range reports {
+		if report.SSRC != ssrcs[channel] {
+			t.Fatalf("channel %d SR SSRC = %08X, want %08X", channel, report.SSRC, ssrcs[channel])
+		}
+		if report.PacketCount == 0 || report.OctetCount == 0 {
+			t.Fatalf("channel %d SR counts = %d packets, %d octets", channel, report.PacketCount, report.OctetCount)
+		}
+
+		sent := time.Unix(int64(report.NTPTime>>32)-ntpEpochOffset, 0)
+		if d := now.Sub(sent); d < -time.Second || d > 5*time.Second {
+			t.Fatalf("channel %d SR NTP time %v is not near %v", channel, sent, now)
+		}
+	}
+
+	status, _, _ = client.request("TEARDOWN", base+"/", map[string]string{"Session": session})
+	if status != 200 {
+		t.Fatalf("TEARDOWN = %d, want 200", status)
+	}
+}
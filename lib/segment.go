@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/ts"
+)
+
+// muxTSSegment renders a segment's packets into MPEG-TS bytes
+func muxTSSegment(codecs []av.CodecData, packets []*av.Packet) ([]byte, error) {
+	outBuffer := bytes.NewBuffer([]byte{})
+	muxer := ts.NewMuxer(outBuffer)
+
+	// Write TS header
+	if err := muxer.WriteHeader(codecs); err != nil {
+		return nil, err
+	}
+
+	// Enable padding for continuous counter
+	muxer.PaddingToMakeCounterCont = true
+
+	// Write packets; copies keep the cached packets untouched for other outputs
+	for _, packet := range packets {
+		pkt := *packet
+		pkt.CompositionTime = 1
+		if err := muxer.WritePacket(pkt); err != nil {
+			return nil, err
+		}
+	}
+
+	// Write trailer
+	if err := muxer.WriteTrailer(); err != nil {
+		return nil, err
+	}
+
+	return outBuffer.Bytes(), nil
+}
+
+// segmentETag derives a strong ETag from rendered segment bytes
+func segmentETag(data []byte) string {
+	hash := fnv.New64a()
+	hash.Write(data)
+	return fmt.Sprintf("\"%x\"", hash.Sum64())
+}
@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// Source is a pulled media input feeding a stream's ingest pipeline
+type Source interface {
+	// Open connects to the input and reads its codecs
+	Open() error
+	// Codecs returns the codecs of the input, available after Open
+	Codecs() []av.CodecData
+	// Packets delivers media packets and is closed when the input ends or fails
+	Packets() <-chan *av.Packet
+	// Err reports why Packets was closed; nil means the input ended normally
+	Err() error
+	// Close disconnects from the input and waits for its reader to exit
+	Close() error
+}
+
+// codecNotifier is implemented by sources whose codecs can change mid-stream
+type codecNotifier interface {
+	CodecChanges() <-chan struct{}
+}
+
+// discontinuityMarker is implemented by sources whose media can restart mid-stream, such as a looping file
+type discontinuityMarker interface {
+	Discontinuity(packet *av.Packet) bool
+}
+
+// lossReporter is implemented by sources that can count packets lost on the wire
+type lossReporter interface {
+	LostPackets() int64
+}
+
+// newSource picks the source implementation for a stream URL by its scheme
+func newSource(rawURL string, rtspOptions RTSPOptions) (Source, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "rtsp", "rtsps":
+		return newRTSPClient(rawURL, rtspOptions), nil
+	case "rtmp":
+		return newRTMPSource(rawURL), nil
+	case "http", "https":
+		return newHLSSource(rawURL), nil
+	case "file":
+		return newFileSource(u), nil
+	}
+
+	return nil, configs.ErrSourceUnsupported
+}
+
+// CheckSourceURL reports whether a stream URL can be pulled by one of the sources
+func CheckSourceURL(rawURL string) error {
+	_, err := newSource(rawURL, RTSPOptions{})
+	return err
+}
+
+// sourceFeed is the packet channel and shutdown handling shared by the source implementations
+type sourceFeed struct {
+	packets   chan *av.Packet
+	closeChan chan struct{}
+	doneChan  chan struct{}
+	closeOnce sync.Once
+	started   bool
+	err       error
+}
+
+// newSourceFeed prepares an empty feed
+func newSourceFeed() sourceFeed {
+	return sourceFeed{
+		packets:   make(chan *av.Packet, 100),
+		closeChan: make(chan struct{}),
+		doneChan:  make(chan struct{}),
+	}
+}
+
+// Packets delivers the packets sent by the reader goroutine
+func (f *sourceFeed) Packets() <-chan *av.Packet {
+	return f.packets
+}
+
+// Err reports why the reader goroutine exited; only valid once Packets is closed
+func (f *sourceFeed) Err() error {
+	return f.err
+}
+
+// send hands a packet to the consumer; it returns false once the source is closing
+func (f *sourceFeed) send(packet *av.Packet) bool {
+	select {
+	case f.packets <- packet:
+		return true
+	case <-f.closeChan:
+		return false
+	}
+}
+
+// closing returns a channel closed once Close was called
+func (f *sourceFeed) closing() <-chan struct{} {
+	return f.closeChan
+}
+
+// run starts the reader goroutine; its return value becomes Err and the packet channel is closed
+func (f *sourceFeed) run(read func() error) {
+	f.started = true
+	go func() {
+		f.err = read()
+		close(f.packets)
+		close(f.doneChan)
+	}()
+}
+
+// stop tells the reader goroutine to exit and waits for it; unblock interrupts reads blocked on the input
+func (f *sourceFeed) stop(unblock func()) {
+	f.closeOnce.Do(func() {
+		close(f.closeChan)
+	})
+
+	if unblock != nil {
+		unblock()
+	}
+
+	if f.started {
+		<-f.doneChan
+	}
+}
+
+// maxPacerJump is the largest timestamp gap the pacer sleeps through; bigger jumps restart its timing
+const maxPacerJump = 10 * time.Second
+
+// packetPacer releases packets at the rate their timestamps advance, for inputs read faster than real time
+type packetPacer struct {
+	start   time.Time
+	base    time.Duration
+	started bool
+}
+
+// wait sleeps until a packet with the given timestamp is due; it returns false if closing fires first
+func (p *packetPacer) wait(ts time.Duration, closing <-chan struct{}) bool {
+	if !p.started {
+		p.start = time.Now()
+		p.base = ts
+		p.started = true
+		return true
+	}
+
+	delay := time.Until(p.start.Add(ts - p.base))
+	if ts < p.base || delay > maxPacerJump {
+		p.start = time.Now()
+		p.base = ts
+		return true
+	}
+	if delay <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-closing:
+		return false
+	}
+}
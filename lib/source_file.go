@@ -0,0 +1,186 @@
+package lib
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/deepch/vdk/format/ts"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// fileSource plays a local MP4 or MPEG-TS file in real time and loops it forever, for running without cameras.
+// Timestamps continue across loops so the segmenter, viewers and recorder see one unbroken stream.
+type fileSource struct {
+	sourceFeed
+	path    string
+	file    *os.File
+	demuxer av.Demuxer
+	codecs  []av.CodecData
+
+	// First packets of each repeat, reported once through Discontinuity
+	loopMutex  sync.Mutex
+	loopStarts map[*av.Packet]struct{}
+}
+
+// newFileSource prepares a source for a file:// URL; file://name is taken relative to the working directory
+func newFileSource(u *url.URL) *fileSource {
+	return &fileSource{
+		sourceFeed: newSourceFeed(),
+		path:       filepath.FromSlash(u.Host + u.Path),
+		loopStarts: make(map[*av.Packet]struct{}),
+	}
+}
+
+// Open opens the file and reads its codecs
+func (s *fileSource) Open() error {
+	file, demuxer, codecs, err := openFileDemuxer(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.file = file
+	s.demuxer = demuxer
+	s.codecs = codecs
+	s.run(s.read)
+	return nil
+}
+
+// Codecs returns the file's tracks
+func (s *fileSource) Codecs() []av.CodecData {
+	return s.codecs
+}
+
+// Discontinuity reports whether a packet is the first one of a repeat of the file
+func (s *fileSource) Discontinuity(packet *av.Packet) bool {
+	s.loopMutex.Lock()
+	defer s.loopMutex.Unlock()
+
+	if _, exists := s.loopStarts[packet]; !exists {
+		return false
+	}
+	delete(s.loopStarts, packet)
+	return true
+}
+
+// Close stops playback and closes the file
+func (s *fileSource) Close() error {
+	s.stop(nil)
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
+
+// read sends the file's packets paced by their timestamps, reopening it at the end.
+// Each repeat is shifted to start where the previous one ended.
+func (s *fileSource) read() error {
+	var pacer packetPacer
+
+	// offset maps the file's timestamps onto the output timeline; the first pass keeps them as they are
+	var offset time.Duration
+	var end time.Duration
+	first := true
+	loopStart := false
+	lastTimes := make(map[int8]time.Duration)
+	gaps := make(map[int8]time.Duration)
+
+	for {
+		packet, err := s.demuxer.ReadPacket()
+		if err == io.EOF {
+			// A file without packets would spin here
+			if first {
+				return configs.ErrStreamExitSourceEnded
+			}
+
+			if err := s.rewind(); err != nil {
+				return err
+			}
+			offset = end
+			first = true
+			loopStart = true
+			clear(lastTimes)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if first {
+			if loopStart {
+				offset -= packet.Time
+			}
+			first = false
+		}
+		packet.Time += offset
+
+		// Track where the pass ends; packets without a duration are assumed to last as long as the previous gap
+		if last, exists := lastTimes[packet.Idx]; exists && packet.Time > last {
+			gaps[packet.Idx] = packet.Time - last
+		}
+		lastTimes[packet.Idx] = packet.Time
+		duration := packet.Duration
+		if duration <= 0 {
+			duration = gaps[packet.Idx]
+		}
+		end = max(end, packet.Time+duration)
+
+		if loopStart {
+			s.loopMutex.Lock()
+			s.loopStarts[&packet] = struct{}{}
+			s.loopMutex.Unlock()
+			loopStart = false
+		}
+
+		if !pacer.wait(packet.Time, s.closing()) || !s.send(&packet) {
+			return nil
+		}
+	}
+}
+
+// rewind reopens the file at its beginning; a fresh demuxer also resets the MPEG-TS continuity state
+func (s *fileSource) rewind() error {
+	file, demuxer, _, err := openFileDemuxer(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+	s.demuxer = demuxer
+	return nil
+}
+
+// openFileDemuxer opens a media file with the demuxer matching its extension
+func openFileDemuxer(path string) (*os.File, av.Demuxer, []av.CodecData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var demuxer av.Demuxer
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4", ".m4v", ".mov":
+		demuxer = mp4.NewDemuxer(file)
+	case ".ts":
+		demuxer = ts.NewDemuxer(bufio.NewReader(file))
+	default:
+		file.Close()
+		return nil, nil, nil, configs.ErrSourceUnsupported
+	}
+
+	codecs, err := demuxer.Streams()
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, err
+	}
+
+	return file, demuxer, codecs, nil
+}
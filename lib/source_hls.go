@@ -0,0 +1,374 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/ts"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// Timeouts and limits for pulling HLS
+const (
+	hlsSourceFetchTimeout = 10 * time.Second
+	// hlsSourceLiveEdge is how many segments behind the live edge playback starts
+	hlsSourceLiveEdge = 3
+)
+
+// hlsSourceOpenTimeout bounds how long Open waits for the first segment's codecs
+var hlsSourceOpenTimeout = 20 * time.Second
+
+// hlsSource pulls a live HLS stream with MPEG-TS segments.
+// Downloaded segments are concatenated into one demuxer so timestamps continue across segment boundaries.
+// A discontinuity tag or skipped segments end the pipe and start a fresh demuxer on the next one.
+type hlsSource struct {
+	sourceFeed
+	url        string
+	client     *http.Client
+	pipeWriter *io.PipeWriter
+	fetchDone  chan struct{}
+	demuxer    *ts.Demuxer
+	codecs     []av.CodecData
+
+	// The pipe being demuxed and the one the fetcher moved on to; both are closed together
+	pipeMutex   sync.Mutex
+	pipeReader  *io.PipeReader
+	nextReader  *io.PipeReader
+	pipesClosed bool
+
+	// First packets after each discontinuity, reported once through Discontinuity
+	markMutex sync.Mutex
+	marks     map[*av.Packet]struct{}
+}
+
+// hlsPlaylist is the part of an M3U8 playlist the source needs
+type hlsPlaylist struct {
+	variants        []string
+	mediaSequence   int
+	segments        []string
+	discontinuities []bool
+	targetDuration  time.Duration
+	ended           bool
+	fmp4            bool
+}
+
+// newHLSSource prepares an HLS pull source for a playlist URL
+func newHLSSource(rawURL string) *hlsSource {
+	return &hlsSource{
+		sourceFeed: newSourceFeed(),
+		url:        rawURL,
+		client:     &http.Client{Timeout: hlsSourceFetchTimeout},
+		fetchDone:  make(chan struct{}),
+		marks:      make(map[*av.Packet]struct{}),
+	}
+}
+
+// Open resolves the media playlist, starts downloading segments and waits for the codecs in the first one
+func (s *hlsSource) Open() error {
+	playlistURL, err := url.Parse(s.url)
+	if err != nil {
+		return err
+	}
+
+	playlist, err := s.getPlaylist(playlistURL)
+	if err != nil {
+		return err
+	}
+
+	// Master playlists list renditions; the first one is pulled
+	if len(playlist.variants) > 0 {
+		if playlistURL, err = playlistURL.Parse(playlist.variants[0]); err != nil {
+			return err
+		}
+	}
+
+	s.pipeReader, s.pipeWriter = io.Pipe()
+	go s.fetch(playlistURL)
+
+	// A playlist that never delivers a segment would otherwise block here forever
+	timer := time.AfterFunc(hlsSourceOpenTimeout, func() {
+		s.pipeReader.CloseWithError(configs.ErrStreamChannelCodecNotFound)
+	})
+
+	s.demuxer = ts.NewDemuxer(s.pipeReader)
+	codecs, err := s.demuxer.Streams()
+	if !timer.Stop() {
+		// The timer closed the pipe, so whatever the demuxer returned, the cause is the missing segments
+		err = configs.ErrStreamChannelCodecNotFound
+	}
+	if err != nil {
+		// The fetcher keeps polling a live playlist until the source is closing, so stop it before waiting
+		s.stop(func() {
+			s.closePipes(err)
+		})
+		<-s.fetchDone
+		return err
+	}
+
+	s.codecs = codecs
+	s.run(s.read)
+	return nil
+}
+
+// Codecs returns the codecs found in the first segment
+func (s *hlsSource) Codecs() []av.CodecData {
+	return s.codecs
+}
+
+// Discontinuity reports whether a packet is the first one after a discontinuity tag or skipped segments
+func (s *hlsSource) Discontinuity(packet *av.Packet) bool {
+	s.markMutex.Lock()
+	defer s.markMutex.Unlock()
+
+	if _, exists := s.marks[packet]; !exists {
+		return false
+	}
+	delete(s.marks, packet)
+	return true
+}
+
+// Close stops downloading and demuxing
+func (s *hlsSource) Close() error {
+	s.pipeMutex.Lock()
+	opened := s.pipeReader != nil
+	s.pipeMutex.Unlock()
+
+	s.stop(func() {
+		if opened {
+			s.closePipes(io.ErrClosedPipe)
+		}
+	})
+	if opened {
+		<-s.fetchDone
+	}
+	return nil
+}
+
+// closePipes closes the pipe being demuxed and any pipe the fetcher already moved on to
+func (s *hlsSource) closePipes(err error) {
+	s.pipeMutex.Lock()
+	defer s.pipeMutex.Unlock()
+
+	s.pipeReader.CloseWithError(err)
+	if s.nextReader != nil {
+		s.nextReader.CloseWithError(err)
+	}
+	s.pipesClosed = true
+}
+
+// read sends the demuxed packets paced by their timestamps, so the startup backlog is not burst to viewers
+func (s *hlsSource) read() error {
+	var pacer packetPacer
+	discontinuity := false
+
+	for {
+		packet, err := s.demuxer.ReadPacket()
+		if err == io.EOF {
+			if !s.nextDemuxer() {
+				return nil
+			}
+			// Timestamps after a discontinuity need not follow on, so pacing starts over
+			pacer = packetPacer{}
+			discontinuity = true
+			continue
+		}
+		if err != nil {
+			select {
+			case <-s.closing():
+				return nil
+			default:
+				return err
+			}
+		}
+
+		if discontinuity {
+			s.markMutex.Lock()
+			s.marks[&packet] = struct{}{}
+			s.markMutex.Unlock()
+			discontinuity = false
+		}
+
+		if !pacer.wait(packet.Time, s.closing()) || !s.send(&packet) {
+			return nil
+		}
+	}
+}
+
+// nextDemuxer moves on to the pipe the fetcher started at a discontinuity; it returns false when the stream ended
+func (s *hlsSource) nextDemuxer() bool {
+	s.pipeMutex.Lock()
+	defer s.pipeMutex.Unlock()
+
+	if s.nextReader == nil {
+		return false
+	}
+	s.pipeReader, s.nextReader = s.nextReader, nil
+	s.demuxer = ts.NewDemuxer(s.pipeReader)
+	return true
+}
+
+// fetch downloads segments into the demuxer pipe until the playlist ends or fails
+func (s *hlsSource) fetch(playlistURL *url.URL) {
+	defer close(s.fetchDone)
+
+	err := s.fetchSegments(playlistURL)
+	s.pipeWriter.CloseWithError(err)
+}
+
+// splitPipe ends the current pipe after the segments already written and continues on a new one.
+// The reader drains the old pipe, so its last frames are still flushed, before it switches over.
+func (s *hlsSource) splitPipe() error {
+	reader, writer := io.Pipe()
+
+	s.pipeMutex.Lock()
+	if s.pipesClosed {
+		s.pipeMutex.Unlock()
+		return io.ErrClosedPipe
+	}
+	s.nextReader = reader
+	s.pipeMutex.Unlock()
+
+	s.pipeWriter.Close()
+	s.pipeWriter = writer
+	return nil
+}
+
+// fetchSegments polls the media playlist and writes each new segment once, in order
+func (s *hlsSource) fetchSegments(playlistURL *url.URL) error {
+	next := -1
+	written := false
+
+	for {
+		playlist, err := s.getPlaylist(playlistURL)
+		if err != nil {
+			return err
+		}
+		if playlist.fmp4 {
+			return configs.ErrSourceUnsupported
+		}
+
+		// Start near the live edge, and jump back there if the window moved past us or the sequence restarted.
+		// Finished playlists are played from the beginning.
+		last := playlist.mediaSequence + len(playlist.segments)
+		skipped := false
+		if next < playlist.mediaSequence || next > last {
+			skipped = written
+			next = max(playlist.mediaSequence, last-hlsSourceLiveEdge)
+			if playlist.ended {
+				next = playlist.mediaSequence
+			}
+		}
+
+		for i, uri := range playlist.segments {
+			seq := playlist.mediaSequence + i
+			if seq < next {
+				continue
+			}
+
+			segmentURL, err := playlistURL.Parse(uri)
+			if err != nil {
+				return err
+			}
+			data, err := s.get(segmentURL)
+			if err != nil {
+				return err
+			}
+
+			if written && (skipped || playlist.discontinuities[i]) {
+				if err := s.splitPipe(); err != nil {
+					return err
+				}
+			}
+			skipped = false
+
+			if _, err := s.pipeWriter.Write(data); err != nil {
+				return err
+			}
+			written = true
+			next = seq + 1
+		}
+
+		if playlist.ended {
+			return nil
+		}
+
+		// Poll at half the target duration, as players do when the playlist did not change
+		select {
+		case <-s.closing():
+			return nil
+		case <-time.After(playlist.targetDuration / 2):
+		}
+	}
+}
+
+// getPlaylist downloads and parses a playlist
+func (s *hlsSource) getPlaylist(playlistURL *url.URL) (hlsPlaylist, error) {
+	data, err := s.get(playlistURL)
+	if err != nil {
+		return hlsPlaylist{}, err
+	}
+	return parseHLSPlaylist(string(data)), nil
+}
+
+// get downloads a playlist or segment in full
+func (s *hlsSource) get(u *url.URL) ([]byte, error) {
+	resp, err := s.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u.Redacted(), resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// parseHLSPlaylist reads the variants of a master playlist or the segments of a media playlist
+func parseHLSPlaylist(body string) hlsPlaylist {
+	playlist := hlsPlaylist{targetDuration: 2 * time.Second}
+	variant := false
+	discontinuity := false
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF"):
+			variant = true
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			playlist.mediaSequence, _ = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:")); err == nil && seconds > 0 {
+				playlist.targetDuration = time.Duration(seconds) * time.Second
+			}
+		case strings.HasPrefix(line, "#EXT-X-MAP"):
+			playlist.fmp4 = true
+		case line == "#EXT-X-ENDLIST":
+			playlist.ended = true
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case strings.HasPrefix(line, "#"):
+		case variant:
+			playlist.variants = append(playlist.variants, line)
+			variant = false
+		default:
+			playlist.segments = append(playlist.segments, line)
+			playlist.discontinuities = append(playlist.discontinuities, discontinuity)
+			discontinuity = false
+		}
+	}
+
+	return playlist
+}
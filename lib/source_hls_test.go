@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/ts"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+func TestParseHLSPlaylist(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want hlsPlaylist
+	}{
+		{
+			name: "master playlist",
+			body: "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000\nlow/index.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2000000\nhigh/index.m3u8\n",
+			want: hlsPlaylist{variants: []string{"low/index.m3u8", "high/index.m3u8"}, targetDuration: 2 * time.Second},
+		},
+		{
+			name: "live media playlist",
+			body: "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:17\n#EXTINF:4.0,\nseg17.ts\n#EXTINF:4.0,\nseg18.ts\n",
+			want: hlsPlaylist{
+				mediaSequence:   17,
+				segments:        []string{"seg17.ts", "seg18.ts"},
+				discontinuities: []bool{false, false},
+				targetDuration:  4 * time.Second,
+			},
+		},
+		{
+			name: "discontinuity marks the next segment only",
+			body: "#EXTM3U\n#EXT-X-DISCONTINUITY-SEQUENCE:2\n#EXTINF:2.0,\na.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:2.0,\nb.ts\n#EXTINF:2.0,\nc.ts\n#EXT-X-ENDLIST\n",
+			want: hlsPlaylist{
+				segments:        []string{"a.ts", "b.ts", "c.ts"},
+				discontinuities: []bool{false, true, false},
+				targetDuration:  2 * time.Second,
+				ended:           true,
+			},
+		},
+		{
+			name: "fmp4 segments",
+			body: "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2.0,\nseg0.m4s\n",
+			want: hlsPlaylist{
+				segments:        []string{"seg0.m4s"},
+				discontinuities: []bool{false},
+				targetDuration:  2 * time.Second,
+				fmp4:            true,
+			},
+		},
+		{
+			name: "bad target duration keeps the default",
+			body: "#EXTM3U\n#EXT-X-TARGETDURATION:0\n\n  seg0.ts  \n",
+			want: hlsPlaylist{segments: []string{"seg0.ts"}, discontinuities: []bool{false}, targetDuration: 2 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseHLSPlaylist(tt.body)
+			if !slices.Equal(got.variants, tt.want.variants) ||
+				!slices.Equal(got.segments, tt.want.segments) ||
+				!slices.Equal(got.discontinuities, tt.want.discontinuities) ||
+				got.mediaSequence != tt.want.mediaSequence ||
+				got.targetDuration != tt.want.targetDuration ||
+				got.ended != tt.want.ended ||
+				got.fmp4 != tt.want.fmp4 {
+				t.Fatalf("parseHLSPlaylist() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testTSSegment muxes five H.264 frames 40 ms apart starting at start
+func testTSSegment(t *testing.T, codecs []av.CodecData, start time.Duration) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	muxer := ts.NewMuxer(&buf)
+	if err := muxer.WriteHeader(codecs); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		packet := av.Packet{Time: start + time.Duration(i)*40*time.Millisecond, Data: []byte{0, 0, 0, 4, 0x41, 0x9a, 0x02, 0x00}}
+		if i == 0 {
+			packet.IsKeyFrame = true
+			packet.Data = []byte{0, 0, 0, 4, 0x65, 0x88, 0x84, 0x00}
+		}
+		if err := muxer.WritePacket(packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHLSSourceDiscontinuity(t *testing.T) {
+	codecs := []av.CodecData{testH264(t)}
+	segments := make(map[string][]byte)
+	for i, start := range []time.Duration{0, 200 * time.Millisecond, 400 * time.Millisecond} {
+		segments[fmt.Sprintf("/seg%d.ts", i)] = testTSSegment(t, codecs, 10*time.Second+start)
+		segments[fmt.Sprintf("/seg%d.ts", i+10)] = testTSSegment(t, codecs, start)
+	}
+
+	tests := []struct {
+		name string
+		// playlists are served one per poll, the last one from then on
+		playlists []string
+		packets   int
+		marked    []int
+	}{
+		{
+			name:      "discontinuity tag",
+			playlists: []string{"#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:0.2,\nseg0.ts\n#EXTINF:0.2,\nseg1.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:0.2,\nseg10.ts\n#EXT-X-ENDLIST\n"},
+			packets:   15,
+			marked:    []int{10},
+		},
+		{
+			name: "window moved past the reader",
+			playlists: []string{
+				"#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:0.2,\nseg0.ts\n#EXTINF:0.2,\nseg1.ts\n#EXTINF:0.2,\nseg2.ts\n",
+				"#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXTINF:0.2,\nseg0.ts\n#EXTINF:0.2,\nseg1.ts\n#EXTINF:0.2,\nseg2.ts\n",
+				"#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:10\n#EXTINF:0.2,\nseg10.ts\n#EXTINF:0.2,\nseg11.ts\n#EXT-X-ENDLIST\n",
+			},
+			packets: 25,
+			marked:  []int{15},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var polls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/index.m3u8" {
+					poll := int(polls.Add(1)) - 1
+					w.Write([]byte(tt.playlists[min(poll, len(tt.playlists)-1)]))
+					return
+				}
+				data, exists := segments[r.URL.Path]
+				if !exists {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write(data)
+			}))
+			defer server.Close()
+
+			source := newHLSSource(server.URL + "/index.m3u8")
+			if err := source.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer source.Close()
+
+			var marked []int
+			count := 0
+			timeout := time.After(10 * time.Second)
+			for done := false; !done; {
+				select {
+				case packet, ok := <-source.Packets():
+					if !ok {
+						done = true
+						break
+					}
+					if source.Discontinuity(packet) {
+						marked = append(marked, count)
+					}
+					count++
+				case <-timeout:
+					t.Fatalf("timed out after %d packets", count)
+				}
+			}
+
+			if err := source.Err(); err != nil {
+				t.Fatalf("Err() = %v", err)
+			}
+			// Every frame is delivered, including the ones flushed when the first pipe ended
+			if count != tt.packets {
+				t.Fatalf("got %d packets, want %d", count, tt.packets)
+			}
+			if !slices.Equal(marked, tt.marked) {
+				t.Fatalf("discontinuities at packets %v, want %v", marked, tt.marked)
+			}
+		})
+	}
+}
+
+func TestHLSSourceOpenTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		hlsSourceOpenTimeout = timeout
+	}(hlsSourceOpenTimeout)
+	hlsSourceOpenTimeout = 300 * time.Millisecond
+
+	// A live playlist that never lists a segment
+	var polls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n"))
+	}))
+	defer server.Close()
+
+	source := newHLSSource(server.URL + "/index.m3u8")
+	opened := make(chan error, 1)
+	go func() {
+		opened <- source.Open()
+	}()
+
+	select {
+	case err := <-opened:
+		if !errors.Is(err, configs.ErrStreamChannelCodecNotFound) {
+			t.Fatalf("Open() = %v, want ErrStreamChannelCodecNotFound", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Open() did not return after the open timeout")
+	}
+
+	// The fetcher stopped polling, and closing afterwards does not block
+	seen := polls.Load()
+	time.Sleep(1200 * time.Millisecond)
+	if got := polls.Load(); got != seen {
+		t.Fatalf("playlist polled %d more times after Open failed", got-seen)
+	}
+	if err := source.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
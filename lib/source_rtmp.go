@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/rtmp"
+)
+
+// rtmpSource pulls a stream from an RTMP server
+type rtmpSource struct {
+	sourceFeed
+	url    string
+	conn   *rtmp.Conn
+	codecs []av.CodecData
+}
+
+// newRTMPSource prepares an RTMP pull source for a URL
+func newRTMPSource(url string) *rtmpSource {
+	return &rtmpSource{
+		sourceFeed: newSourceFeed(),
+		url:        url,
+	}
+}
+
+// Open connects, requests playback and waits for the stream's codecs
+func (s *rtmpSource) Open() error {
+	const dialTimeout = 5 * time.Second
+
+	conn, err := rtmp.DialTimeout(s.url, dialTimeout)
+	if err != nil {
+		return err
+	}
+
+	conn.NetConn().SetDeadline(time.Now().Add(rtmpReadTimeout))
+	codecs, err := conn.Streams()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	s.conn = conn
+	s.codecs = codecs
+	s.run(s.read)
+	return nil
+}
+
+// Codecs returns the codecs from the stream's metadata and sequence headers
+func (s *rtmpSource) Codecs() []av.CodecData {
+	return s.codecs
+}
+
+// Close disconnects from the server
+func (s *rtmpSource) Close() error {
+	s.stop(func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	})
+	return nil
+}
+
+// read forwards packets until the connection ends
+func (s *rtmpSource) read() error {
+	for {
+		s.conn.NetConn().SetReadDeadline(time.Now().Add(rtmpReadTimeout))
+
+		packet, err := s.conn.ReadPacket()
+		if err != nil {
+			select {
+			case <-s.closing():
+				return nil
+			default:
+				return err
+			}
+		}
+
+		if !s.send(&packet) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"time"
+
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// RTSP transports a stream can be pulled with
+const (
+	RTSPTransportTCP  = "tcp"
+	RTSPTransportUDP  = "udp"
+	RTSPTransportAuto = "auto"
+)
+
+// Defaults for RTSP connections when a stream does not set its own
+const (
+	rtspDefaultDialTimeout = 5 * time.Second
+	rtspDefaultReadTimeout = 5 * time.Second
+	rtspDefaultUserAgent   = "Lavf58.76.100"
+)
+
+// RTSPOptions tunes how a stream's RTSP source is pulled; zero values keep the defaults
+type RTSPOptions struct {
+	Transport          string `json:"transport,omitempty"`
+	DialTimeout        int    `json:"dial_timeout,omitempty"`
+	ReadTimeout        int    `json:"read_timeout,omitempty"`
+	DisableAudio       bool   `json:"disable_audio,omitempty"`
+	UserAgent          string `json:"user_agent,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// dialTimeout returns the connect timeout
+func (o RTSPOptions) dialTimeout() time.Duration {
+	if o.DialTimeout > 0 {
+		return time.Duration(o.DialTimeout) * time.Second
+	}
+	return rtspDefaultDialTimeout
+}
+
+// readTimeout returns the timeout for each read and write on the session
+func (o RTSPOptions) readTimeout() time.Duration {
+	if o.ReadTimeout > 0 {
+		return time.Duration(o.ReadTimeout) * time.Second
+	}
+	return rtspDefaultReadTimeout
+}
+
+// userAgent returns the User-Agent sent with requests
+func (o RTSPOptions) userAgent() string {
+	if o.UserAgent != "" {
+		return o.UserAgent
+	}
+	return rtspDefaultUserAgent
+}
+
+// SetRTSPOptions sets how a stream's RTSP source is pulled; a running worker picks them up on its next start
+func (sm *StreamManager) SetRTSPOptions(id string, options RTSPOptions) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return configs.ErrStreamNotFound
+	}
+
+	stream.RTSP = options
+	return nil
+}
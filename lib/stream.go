@@ -1,100 +1,190 @@
 package lib
 
 import (
+	"errors"
 	"log"
+	"sync"
 	"time"
 
-	"github.com/deepch/vdk/av"
-	"github.com/deepch/vdk/format/rtspv2"
 	"org.donghyuns.com/rtsphls/configs"
 )
 
-// RTSPWorker handles RTSP stream processing
+// RTSPWorker pulls a stream from its source URLs, reconnecting until stopped.
+// The first URL is the primary; the others are backups tried in order when it keeps failing.
 type RTSPWorker struct {
-	manager       *StreamManager
-	streamID      string
-	url           string
-	onDemand      bool
-	stopChan      chan struct{}
-	isRunning     bool
-	reconnectTime time.Duration
+	manager     *StreamManager
+	streamID    string
+	urls        []string
+	rtspOptions RTSPOptions
+	onDemand    bool
+	stopChan    chan struct{}
+	doneChan    chan struct{}
+	startOnce   sync.Once
+	stopOnce    sync.Once
+
+	// Reconnect and failover state, only touched by the worker loop
+	attempt   int
+	index     int
+	lastIndex int
+	failures  int
+	live      bool
+	pending   Source
 }
 
-// NewRTSPWorker creates a new RTSP worker
-func NewRTSPWorker(manager *StreamManager, streamID, url string, onDemand bool) *RTSPWorker {
+// NewRTSPWorker creates a new RTSP worker for a primary URL followed by its backups
+func NewRTSPWorker(manager *StreamManager, streamID string, urls []string, rtspOptions RTSPOptions, onDemand bool) *RTSPWorker {
 	return &RTSPWorker{
-		manager:       manager,
-		streamID:      streamID,
-		url:           url,
-		onDemand:      onDemand,
-		stopChan:      make(chan struct{}),
-		isRunning:     false,
-		reconnectTime: 5 * time.Second,
+		manager:     manager,
+		streamID:    streamID,
+		urls:        urls,
+		rtspOptions: rtspOptions,
+		onDemand:    onDemand,
+		stopChan:    make(chan struct{}),
+		doneChan:    make(chan struct{}),
+		lastIndex:   -1,
 	}
 }
 
 // Start begins the worker's processing loop
 func (w *RTSPWorker) Start() {
-	if w.isRunning {
-		return
-	}
-
-	w.isRunning = true
-	go w.loop()
+	w.startOnce.Do(func() {
+		go w.loop()
+	})
 }
 
-// Stop signals the worker to stop
+// Stop signals the worker to stop and waits until its RTSP session is closed
 func (w *RTSPWorker) Stop() {
-	if !w.isRunning {
-		return
+	w.stopOnce.Do(func() {
+		close(w.stopChan)
+	})
+
+	// A worker that was never started has nothing to wait for
+	started := true
+	w.startOnce.Do(func() {
+		started = false
+		close(w.doneChan)
+	})
+
+	if started {
+		<-w.doneChan
 	}
+}
 
-	w.isRunning = false
-	close(w.stopChan)
+// Done returns a channel closed once the worker loop has exited
+func (w *RTSPWorker) Done() <-chan struct{} {
+	return w.doneChan
 }
 
 // loop is the main processing loop
 func (w *RTSPWorker) loop() {
+	exitState, exitErr := StreamStateStopped, error(nil)
 	defer func() {
-		w.manager.SetRunLock(w.streamID, false)
+		if w.pending != nil {
+			w.pending.Close()
+		}
+		w.manager.workerExited(w, exitState, exitErr)
 		log.Printf("[%s] RTSP worker stopped", w.streamID)
+		close(w.doneChan)
 	}()
 
 	// Main worker loop
-	for w.isRunning {
-		log.Printf("[%s] Stream connecting to %s", w.streamID, w.url)
+	for {
+		select {
+		case <-w.stopChan:
+			return
+		default:
+		}
 
 		err := w.processStream()
-		if err != nil {
+		if errors.Is(err, configs.ErrStreamExitPrimaryRestored) {
+			log.Printf("[%s] Primary source is back, switching to it", w.streamID)
+		} else if err != nil {
 			log.Printf("[%s] Stream error: %v", w.streamID, err)
 		}
 
+		// Finalize the recording file so a reconnect starts a clean one
+		w.manager.ResetRecording(w.streamID)
+
+		select {
+		case <-w.stopChan:
+			return
+		default:
+		}
+
 		// Check if we should continue or exit (for on-demand streams)
-		if w.onDemand && !w.manager.HasViewer(w.streamID) {
+		if w.onDemand && !w.manager.NeedsIngest(w.streamID) {
 			log.Printf("[%s] On-demand stream stopping: no viewers", w.streamID)
-			break
+			exitState = StreamStateIdle
+			return
+		}
+
+		w.failover(err)
+
+		// A primary that answered the probe is already connected
+		if w.pending != nil {
+			continue
+		}
+
+		// Back off before reconnecting, giving up once the policy runs out of attempts
+		policy := reconnectPolicy()
+		w.attempt++
+		retry := RetryState{Attempt: w.attempt, MaxAttempts: policy.MaxAttempts}
+		if err != nil {
+			retry.LastError = err.Error()
 		}
 
-		// Wait before reconnecting
+		if policy.exhausted(w.attempt) {
+			log.Printf("[%s] Giving up after %d attempts", w.streamID, w.attempt)
+			w.manager.setRetryState(w.streamID, retry)
+			exitState, exitErr = StreamStateFailed, err
+			return
+		}
+
+		delay := policy.delay(w.attempt)
+		retry.NextAttempt = time.Now().Add(delay)
+		w.manager.setRetryState(w.streamID, retry)
+		w.manager.setStreamState(w.streamID, StreamStateReconnecting, err)
+		log.Printf("[%s] Reconnecting in %s (attempt %d)", w.streamID, delay.Round(time.Millisecond), w.attempt)
+
 		select {
 		case <-w.stopChan:
 			return
-		case <-time.After(w.reconnectTime):
+		case <-time.After(delay):
 			// Continue to reconnect
 		}
 	}
 }
 
-// processStream handles the RTSP connection and stream processing
-func (w *RTSPWorker) processStream() error {
+// processStream pulls the stream's source and feeds it through the ingest pipeline
+func (w *RTSPWorker) processStream() (err error) {
 	// Timeouts for various conditions
 	const (
 		keyFrameTimeout    = 20 * time.Second
 		clientCheckTimeout = 20 * time.Second
-		dialTimeout        = 5 * time.Second
-		readWriteTimeout   = 5 * time.Second
 	)
 
+	// Connect to the current source, unless a probe of the primary already did
+	source := w.pending
+	w.pending = nil
+	if source == nil {
+		w.manager.setStreamState(w.streamID, StreamStateConnecting, nil)
+
+		if source, err = w.connect(w.index); err != nil {
+			return err
+		}
+	}
+	defer source.Close()
+	w.manager.setStreamState(w.streamID, StreamStateWaitingKeyframe, nil)
+
+	activeURL := w.urls[w.index]
+	w.manager.setActiveURL(w.streamID, activeURL)
+	w.live = false
+
+	w.manager.events.publish(Event{Type: EventStreamConnected, StreamID: w.streamID, URL: activeURL})
+	defer func() {
+		w.manager.events.publish(Event{Type: EventStreamDisconnected, StreamID: w.streamID, URL: activeURL, Error: errorString(err)})
+	}()
+
 	keyFrameTimer := time.NewTimer(keyFrameTimeout)
 	clientCheckTimer := time.NewTimer(clientCheckTimeout)
 	defer func() {
@@ -102,35 +192,43 @@ func (w *RTSPWorker) processStream() error {
 		clientCheckTimer.Stop()
 	}()
 
-	// Initialize segment processing variables
-	var prevKeyFrameTS time.Duration
-	var segmentBuffer []*av.Packet
-
-	// Connect to RTSP source
-	client, err := rtspv2.Dial(rtspv2.RTSPClientOptions{
-		URL:              w.url,
-		DisableAudio:     false,
-		DialTimeout:      dialTimeout,
-		ReadWriteTimeout: readWriteTimeout,
-		Debug:            false,
-	})
+	// Update codec information
+	ingest := newPacketIngest(w.manager, w.streamID)
+	if codecs := source.Codecs(); codecs != nil {
+		ingest.setCodecs(codecs)
+	}
 
-	if err != nil {
-		return err
+	// Another source restarts timestamps and may change encoding, so the playlist must not treat it as a continuation
+	if w.lastIndex >= 0 && w.lastIndex != w.index {
+		ingest.markDiscontinuity()
 	}
-	defer client.Close()
+	w.lastIndex = w.index
 
-	// Update codec information
-	if client.CodecData != nil {
-		w.manager.UpdateCodecs(w.streamID, client.CodecData)
+	// While on a backup, the primary is probed in the background and taken over once it answers
+	var probeTimer *time.Timer
+	var probeTimerC <-chan time.Time
+	probeResult := make(chan Source, 1)
+	probing := false
+	if w.index != 0 {
+		probeTimer = time.NewTimer(sourcePrimaryRetry())
+		probeTimerC = probeTimer.C
+		defer probeTimer.Stop()
 	}
+	defer func() {
+		if probing {
+			if probed := <-probeResult; probed != nil {
+				probed.Close()
+			}
+		}
+	}()
 
-	// Determine if stream is audio-only
-	var isAudioOnly bool
-	if len(client.CodecData) == 1 && client.CodecData[0].Type().IsAudio() {
-		isAudioOnly = true
-		log.Printf("[%s] Detected audio-only stream", w.streamID)
+	// Only some sources renegotiate codecs mid-stream; a nil channel never fires
+	var codecChanges <-chan struct{}
+	if notifier, ok := source.(codecNotifier); ok {
+		codecChanges = notifier.CodecChanges()
 	}
+	marker, _ := source.(discontinuityMarker)
+	reporter, _ := source.(lossReporter)
 
 	// Main packet processing loop
 	for {
@@ -141,7 +239,7 @@ func (w *RTSPWorker) processStream() error {
 
 		case <-clientCheckTimer.C:
 			// For on-demand streams, check if we still have viewers
-			if w.onDemand && !w.manager.HasViewer(w.streamID) {
+			if w.onDemand && !w.manager.NeedsIngest(w.streamID) {
 				return configs.ErrStreamExitNoViewer
 			}
 			clientCheckTimer.Reset(clientCheckTimeout)
@@ -150,46 +248,59 @@ func (w *RTSPWorker) processStream() error {
 			// If we haven't received a keyframe for too long, reconnect
 			return configs.ErrStreamExitNoVideoOnStream
 
-		case signal := <-client.Signals:
-			switch signal {
-			case rtspv2.SignalCodecUpdate:
-				log.Printf("[%s] Codec update received", w.streamID)
-				w.manager.UpdateCodecs(w.streamID, client.CodecData)
-			case rtspv2.SignalStreamRTPStop:
-				return configs.ErrStreamExitRtspDisconnect
+		case <-probeTimerC:
+			probing = true
+			go func() {
+				probed, err := w.connect(0)
+				if err != nil {
+					log.Printf("[%s] Primary source still unavailable: %v", w.streamID, err)
+					probed = nil
+				}
+				probeResult <- probed
+			}()
+
+		case probed := <-probeResult:
+			probing = false
+			if probed != nil {
+				w.pending = probed
+				w.index = 0
+				w.failures = 0
+				return configs.ErrStreamExitPrimaryRestored
 			}
+			probeTimer.Reset(sourcePrimaryRetry())
+
+		case <-codecChanges:
+			log.Printf("[%s] Codec update received", w.streamID)
+			ingest.setCodecs(source.Codecs())
+			w.manager.events.publish(Event{Type: EventCodecUpdate, StreamID: w.streamID, Codecs: codecNames(ingest.codecs)})
 
-		case packet, ok := <-client.OutgoingPacketQueue:
+		case packet, ok := <-source.Packets():
 			if !ok {
-				return configs.ErrStreamExitRtspDisconnect
+				if err := source.Err(); err != nil {
+					return err
+				}
+				return configs.ErrStreamExitSourceEnded
 			}
 
-			// Process packet for HLS segmentation and broadcast
-			if packet.IsKeyFrame || isAudioOnly {
-				// Reset keyframe timeout
+			// Reset keyframe timeout
+			if packet.IsKeyFrame || ingest.audioOnly {
 				keyFrameTimer.Reset(keyFrameTimeout)
-
-				// If we already have a segment, finalize it
-				if prevKeyFrameTS > 0 && len(segmentBuffer) > 0 {
-					segmentDuration := packet.Time - prevKeyFrameTS
-					err := w.manager.AddHLSSegment(w.streamID, segmentBuffer, segmentDuration)
-					if err != nil {
-						log.Printf("[%s] Error adding HLS segment: %v", w.streamID, err)
-					}
-					// Clear segment buffer for new segment
-					segmentBuffer = make([]*av.Packet, 0, len(segmentBuffer))
+				if !w.live {
+					w.live = true
+					w.attempt = 0
+					w.manager.setRetryState(w.streamID, RetryState{})
+					w.manager.setStreamState(w.streamID, StreamStateLive, nil)
 				}
-
-				// Start new segment
-				prevKeyFrameTS = packet.Time
 			}
 
-			// Add packet to current segment buffer
-			pktCopy := packet
-			segmentBuffer = append(segmentBuffer, pktCopy)
+			if marker != nil && marker.Discontinuity(packet) {
+				ingest.markDiscontinuity()
+			}
+			if reporter != nil {
+				ingest.stats.setSourceLoss(reporter.LostPackets())
+			}
 
-			// Broadcast packet to all connected clients
-			w.manager.BroadcastPacket(w.streamID, *packet)
+			ingest.writePacket(packet)
 		}
 	}
 }
@@ -3,6 +3,9 @@ package lib
 import (
 	"crypto/rand"
 	"fmt"
+	"log"
+	"net/url"
+	"slices"
 	"sort"
 	"strconv"
 	"sync"
@@ -19,32 +22,93 @@ type ServerConfig struct {
 
 // StreamConfig represents configuration for a single stream
 type StreamConfig struct {
-	URL              string            `json:"url"`
-	Status           bool              `json:"status"`
-	OnDemand         bool              `json:"on_demand"`
-	RunLock          bool              `json:"-"`
-	HLSSegmentNumber int               `json:"-"`
-	HLSSegmentBuffer map[int]*Segment  `json:"-"`
-	Codecs           []av.CodecData    `json:"-"`
-	Clients          map[string]Viewer `json:"-"`
+	URL                      string               `json:"url"`
+	Source                   string               `json:"source"`
+	PublishKey               string               `json:"-"`
+	RTSP                     RTSPOptions          `json:"rtsp"`
+	BackupURLs               []string             `json:"backup_urls,omitempty"`
+	ActiveURL                string               `json:"active_url,omitempty"`
+	Status                   bool                 `json:"status"`
+	State                    string               `json:"state"`
+	StateSince               time.Time            `json:"state_since"`
+	LastError                string               `json:"last_error,omitempty"`
+	LastErrorAt              time.Time            `json:"last_error_at,omitzero"`
+	Transitions              []StateTransition    `json:"transitions,omitempty"`
+	Retry                    RetryState           `json:"retry"`
+	OnDemand                 bool                 `json:"on_demand"`
+	RunLock                  bool                 `json:"-"`
+	HLSWindowSize            int                  `json:"hls_window_size,omitempty"`
+	HLSTargetDuration        int                  `json:"hls_target_duration,omitempty"`
+	HLSSegmentNumber         int                  `json:"-"`
+	HLSMaxSegmentDuration    time.Duration        `json:"-"`
+	HLSSegmentBuffer         map[int]*Segment     `json:"-"`
+	Codecs                   []av.CodecData       `json:"-"`
+	Clients                  map[string]Viewer    `json:"-"`
+	HLSSessions              map[string]time.Time `json:"-"`
+	HLSSessionClients        map[string]string    `json:"-"`
+	FMP4Init                 []byte               `json:"-"`
+	DASHInit                 map[int]DASHFragment `json:"-"`
+	HLSPendingParts          []*Part              `json:"-"`
+	HLSPartSequence          uint32               `json:"-"`
+	DVRWindow                int                  `json:"dvr_window,omitempty"`
+	DVR                      *dvrStore            `json:"-"`
+	Record                   bool                 `json:"record"`
+	DASHStart                time.Time            `json:"-"`
+	DASHTime                 time.Duration        `json:"-"`
+	HLSDiscontinuitySequence int                  `json:"-"`
+	recorder                 *Recorder
+	stats                    *ingestStats
+	hlsDiscontinuity         bool
+	hlsNotify                chan struct{}
+	gopCache                 []av.Packet
 }
 
 // Segment represents a cached HLS segment
 type Segment struct {
-	Duration time.Duration
-	Data     []*av.Packet
+	Duration      time.Duration
+	Start         time.Time
+	Data          []*av.Packet
+	TS            []byte
+	ETag          string
+	FMP4          []byte
+	FMP4ETag      string
+	Parts         []*Part
+	DASHTime      time.Duration
+	DASH          map[int]DASHFragment
+	Discontinuity bool
 }
 
 // Viewer represents a connected client
 type Viewer struct {
 	Channel chan av.Packet
+	Kind    string
 }
 
+// HLS segment container formats
+const (
+	HLSFormatTS   = "ts"
+	HLSFormatFMP4 = "fmp4"
+	HLSFormatLL   = "llhls"
+	HLSFormatDVR  = "dvr"
+)
+
+// Stream source types: RTSP sources are pulled by a worker, RTMP sources are pushed by a publisher
+const (
+	SourceRTSP = "rtsp"
+	SourceRTMP = "rtmp"
+)
+
 // StreamManager manages multiple streams
 type StreamManager struct {
-	mutex   sync.RWMutex
-	Server  ServerConfig             `json:"server"`
-	Streams map[string]*StreamConfig `json:"streams"`
+	mutex      sync.RWMutex
+	Server     ServerConfig             `json:"server"`
+	Streams    map[string]*StreamConfig `json:"streams"`
+	workers    map[string]*RTSPWorker
+	publishers map[string]*rtmpPublisher
+	clips      clipJobs
+	whep       webrtcSessions
+	metrics    serverMetrics
+	events     eventBus
 }
 
 // NewStreamManager creates a new stream manager instance
@@ -54,7 +118,13 @@ func NewStreamManager() *StreamManager {
 			// Use configurable port or default
 			HTTPPort: configs.GlobalConfig.AppPort,
 		},
-		Streams: make(map[string]*StreamConfig),
+		Streams:    make(map[string]*StreamConfig),
+		workers:    make(map[string]*RTSPWorker),
+		publishers: make(map[string]*rtmpPublisher),
+		clips:      clipJobs{jobs: make(map[string]*ClipJob)},
+		whep:       webrtcSessions{sessions: make(map[string]*webrtcSession)},
+		metrics:    newServerMetrics(),
+		events:     eventBus{subscribers: make(map[chan Event]struct{})},
 	}
 }
 
@@ -64,15 +134,22 @@ func (sm *StreamManager) AddStream(id string, url string, onDemand bool) {
 	defer sm.mutex.Unlock()
 
 	sm.Streams[id] = &StreamConfig{
-		URL:              url,
-		Status:           false,
-		OnDemand:         onDemand,
-		RunLock:          false,
-		HLSSegmentNumber: 0,
-		HLSSegmentBuffer: make(map[int]*Segment),
-		Codecs:           []av.CodecData{},
-		Clients:          make(map[string]Viewer),
+		URL:               url,
+		Source:            SourceRTSP,
+		Status:            false,
+		OnDemand:          onDemand,
+		RunLock:           false,
+		HLSSegmentNumber:  0,
+		HLSSegmentBuffer:  make(map[int]*Segment),
+		Codecs:            []av.CodecData{},
+		Clients:           make(map[string]Viewer),
+		HLSSessions:       make(map[string]time.Time),
+		HLSSessionClients: make(map[string]string),
+		hlsNotify:         make(chan struct{}),
+		stats:             &ingestStats{},
 	}
+	sm.Streams[id].transition(StreamStateIdle, nil)
+	sm.events.publish(Event{Type: EventStreamAdded, StreamID: id, URL: url})
 }
 
 // GetStream returns a stream by ID
@@ -88,69 +165,273 @@ func (sm *StreamManager) GetStream(id string) (*StreamConfig, error) {
 	return stream, nil
 }
 
-// RemoveStream removes a stream from the manager
+// StreamSnapshot returns a copy of a stream's configuration and status, safe to serialize
+func (sm *StreamManager) StreamSnapshot(id string) (StreamConfig, error) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return StreamConfig{}, configs.ErrStreamNotFound
+	}
+
+	snapshot := *stream
+	snapshot.Transitions = slices.Clone(stream.Transitions)
+	return snapshot, nil
+}
+
+// RemoveStream stops the stream's worker and removes the stream from the manager
 func (sm *StreamManager) RemoveStream(id string) {
 	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
 
-	// Close all client channels
+	worker := sm.workers[id]
+	delete(sm.workers, id)
+
+	publisher := sm.publishers[id]
+	delete(sm.publishers, id)
+
+	// Close all client channels and release cached segments
+	var dvr *dvrStore
 	if stream, exists := sm.Streams[id]; exists {
 		for _, viewer := range stream.Clients {
 			close(viewer.Channel)
 		}
+		stream.Clients = make(map[string]Viewer)
+		stream.HLSSegmentBuffer = make(map[int]*Segment)
+		dvr = stream.DVR
+		stream.DVR = nil
+	}
+
+	var recorder *Recorder
+	stream, exists := sm.Streams[id]
+	if exists {
+		recorder = stream.recorder
+		stream.recorder = nil
 	}
 
 	delete(sm.Streams, id)
+	sm.mutex.Unlock()
+
+	if exists {
+		sm.events.publish(Event{Type: EventStreamRemoved, StreamID: id})
+	}
+
+	if dvr != nil {
+		dvr.close()
+	}
+
+	if recorder != nil {
+		recorder.Close()
+	}
+
+	// Stop outside the lock: the worker takes the lock while shutting down
+	if worker != nil {
+		worker.Stop()
+	}
+
+	if publisher != nil {
+		publisher.Stop()
+	}
+}
+
+// ReplaceStreamURL points a stream at a new source URL, restarting its worker if it was running
+func (sm *StreamManager) ReplaceStreamURL(id string, url string) error {
+	sm.mutex.Lock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		sm.mutex.Unlock()
+		return configs.ErrStreamNotFound
+	}
+
+	if stream.Source == SourceRTMP {
+		sm.mutex.Unlock()
+		return configs.ErrStreamPushSource
+	}
+
+	worker := sm.workers[id]
+	delete(sm.workers, id)
+
+	stream.URL = url
+	stream.RunLock = false
+	stream.Codecs = []av.CodecData{}
+	stream.FMP4Init = nil
+	stream.DASHInit = nil
+	stream.gopCache = nil
+	stream.HLSSegmentBuffer = make(map[int]*Segment)
+	stream.HLSPendingParts = nil
+	stream.HLSPartSequence = 0
+	stream.HLSSegmentNumber = 0
+	stream.HLSMaxSegmentDuration = 0
+	stream.DASHStart = time.Time{}
+	stream.DASHTime = 0
+	stream.HLSDiscontinuitySequence = 0
+	stream.hlsDiscontinuity = false
+
+	// Sequence numbers restart with the new source, so the time-shift history is dropped
+	dvr := stream.DVR
+	stream.DVR = nil
+
+	restart := worker != nil || !stream.OnDemand || stream.recorder != nil
+	recorder := stream.recorder
+	sm.mutex.Unlock()
+
+	if worker != nil {
+		worker.Stop()
+	}
+
+	// The new source may use different codecs, so recording starts a fresh file
+	if recorder != nil {
+		recorder.Reset()
+	}
+
+	if dvr != nil {
+		dvr.close()
+	}
+
+	if restart {
+		sm.StartWorker(id)
+	}
+
+	return nil
 }
 
-// RunIfNotRunning starts a stream if it's not already running
-func (sm *StreamManager) RunIfNotRunning(id string) bool {
+// StartWorker starts the RTSP worker for a stream unless one is already registered; pushed streams have none
+func (sm *StreamManager) StartWorker(id string) bool {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
 	stream, exists := sm.Streams[id]
+	if !exists || stream.Source == SourceRTMP {
+		return false
+	}
+
+	if _, running := sm.workers[id]; running {
+		return false
+	}
+
+	worker := NewRTSPWorker(sm, id, stream.sourceURLs(), stream.RTSP, stream.OnDemand)
+	sm.workers[id] = worker
+	stream.RunLock = true
+	stream.Retry = RetryState{}
+	stream.transition(StreamStateConnecting, nil)
+	worker.Start()
+
+	return true
+}
+
+// StopWorker stops the RTSP worker for a stream and waits for it to exit
+func (sm *StreamManager) StopWorker(id string) bool {
+	sm.mutex.Lock()
+	worker, exists := sm.workers[id]
+	delete(sm.workers, id)
+	sm.mutex.Unlock()
+
 	if !exists {
 		return false
 	}
 
-	if !stream.RunLock {
-		stream.RunLock = true
-		return true
+	worker.Stop()
+	return true
+}
+
+// StopAllWorkers stops every registered worker, used on process shutdown
+func (sm *StreamManager) StopAllWorkers() {
+	sm.mutex.Lock()
+	workers := make([]*RTSPWorker, 0, len(sm.workers))
+	for id, worker := range sm.workers {
+		workers = append(workers, worker)
+		delete(sm.workers, id)
 	}
-	return false
+	sm.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, worker := range workers {
+		wg.Add(1)
+		go func(w *RTSPWorker) {
+			defer wg.Done()
+			w.Stop()
+		}(worker)
+	}
+	wg.Wait()
 }
 
-// SetRunLock sets the run lock state for a stream
-func (sm *StreamManager) SetRunLock(id string, lock bool) {
+// IsWorkerRunning reports whether a worker is registered for a stream
+func (sm *StreamManager) IsWorkerRunning(id string) bool {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	_, running := sm.workers[id]
+	return running
+}
+
+// workerExited unregisters a worker that left its loop, moving the stream to the state it ended in
+func (sm *StreamManager) workerExited(worker *RTSPWorker, state string, err error) {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
-	if stream, exists := sm.Streams[id]; exists {
-		stream.RunLock = lock
+	// A replacement worker may already be registered under the same ID
+	if current, exists := sm.workers[worker.streamID]; exists && current == worker {
+		delete(sm.workers, worker.streamID)
+	}
+
+	if stream, exists := sm.Streams[worker.streamID]; exists {
+		if _, running := sm.workers[worker.streamID]; !running {
+			stream.RunLock = false
+			stream.transition(state, err)
+		}
 	}
 }
 
-// HasViewer checks if a stream has any viewers
+// HasViewer checks if a stream has any connected clients or active HLS sessions
 func (sm *StreamManager) HasViewer(id string) bool {
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
 
-	if stream, exists := sm.Streams[id]; exists && len(stream.Clients) > 0 {
-		return true
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return false
+	}
+
+	return len(stream.Clients) > 0 || activeHLSSessions(stream, time.Now()) > 0
+}
+
+// NeedsIngest reports whether a stream must keep its source connected: it has viewers or is being recorded
+func (sm *StreamManager) NeedsIngest(id string) bool {
+	sm.mutex.RLock()
+	recording := false
+	if stream, exists := sm.Streams[id]; exists {
+		recording = stream.recorder != nil
 	}
-	return false
+	sm.mutex.RUnlock()
+
+	return recording || sm.HasViewer(id)
 }
 
-// BroadcastPacket sends a packet to all viewers of a stream
+// maxGOPCachePackets bounds the cached GOP; longer GOPs are not cached and late joiners wait for the next keyframe
+const maxGOPCachePackets = 1024
+
+// BroadcastPacket sends a packet to all viewers of a stream and keeps the packets since the last keyframe
 func (sm *StreamManager) BroadcastPacket(id string, pkt av.Packet) {
-	sm.mutex.RLock()
-	defer sm.mutex.RUnlock()
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
 
 	stream, exists := sm.Streams[id]
 	if !exists {
 		return
 	}
 
+	// A new slice per GOP keeps snapshots handed to viewers untouched
+	if pkt.IsKeyFrame {
+		stream.gopCache = []av.Packet{pkt}
+	} else if stream.gopCache != nil {
+		if len(stream.gopCache) < maxGOPCachePackets {
+			stream.gopCache = append(stream.gopCache, pkt)
+		} else {
+			stream.gopCache = nil
+		}
+	}
+
 	for _, viewer := range stream.Clients {
 		if len(viewer.Channel) < cap(viewer.Channel) {
 			select {
@@ -174,10 +455,20 @@ func (sm *StreamManager) StreamExists(id string) bool {
 // UpdateCodecs updates codec information for a stream
 func (sm *StreamManager) UpdateCodecs(id string, codecs []av.CodecData) {
 	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
 
+	var recorder *Recorder
 	if stream, exists := sm.Streams[id]; exists {
 		stream.Codecs = codecs
+		stream.FMP4Init = nil
+		stream.DASHInit = nil
+		stream.gopCache = nil
+		recorder = stream.recorder
+	}
+	sm.mutex.Unlock()
+
+	// Recording files carry the codecs in their header, so a change starts a new file
+	if recorder != nil {
+		recorder.Reset()
 	}
 }
 
@@ -209,8 +500,8 @@ func (sm *StreamManager) GetCodecs(id string) ([]av.CodecData, error) {
 	return nil, configs.ErrStreamChannelCodecNotFound
 }
 
-// AddClient adds a new client to a stream
-func (sm *StreamManager) AddClient(id string) (string, chan av.Packet, error) {
+// AddClient adds a new client of an output type to a stream
+func (sm *StreamManager) AddClient(id string, kind string) (string, chan av.Packet, error) {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
@@ -221,11 +512,31 @@ func (sm *StreamManager) AddClient(id string) (string, chan av.Packet, error) {
 
 	clientID := generateUUID()
 	ch := make(chan av.Packet, 100)
-	stream.Clients[clientID] = Viewer{Channel: ch}
+	stream.Clients[clientID] = Viewer{Channel: ch, Kind: kind}
+	sm.events.publish(Event{Type: EventViewerJoined, StreamID: id, Viewer: kind, ViewerID: clientID})
 
 	return clientID, ch, nil
 }
 
+// AddClientFromKeyframe adds a viewer and returns the packets since the latest keyframe.
+// Both happen under one lock, so the cached packets continue seamlessly into the channel.
+func (sm *StreamManager) AddClientFromKeyframe(id string, kind string) (string, chan av.Packet, []av.Packet, error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return "", nil, nil, configs.ErrStreamNotFound
+	}
+
+	clientID := generateUUID()
+	ch := make(chan av.Packet, 100)
+	stream.Clients[clientID] = Viewer{Channel: ch, Kind: kind}
+	sm.events.publish(Event{Type: EventViewerJoined, StreamID: id, Viewer: kind, ViewerID: clientID})
+
+	return clientID, ch, stream.gopCache[:len(stream.gopCache):len(stream.gopCache)], nil
+}
+
 // RemoveClient removes a client from a stream
 func (sm *StreamManager) RemoveClient(streamID, clientID string) {
 	sm.mutex.Lock()
@@ -235,6 +546,7 @@ func (sm *StreamManager) RemoveClient(streamID, clientID string) {
 		if viewer, found := stream.Clients[clientID]; found {
 			close(viewer.Channel)
 			delete(stream.Clients, clientID)
+			sm.events.publish(Event{Type: EventViewerLeft, StreamID: streamID, Viewer: viewer.Kind, ViewerID: clientID})
 		}
 	}
 }
@@ -253,24 +565,62 @@ func (sm *StreamManager) ListStreams() []string {
 	return result
 }
 
-// AddHLSSegment adds a new HLS segment to a stream
+// AddHLSSegment muxes a new HLS segment once and adds it to a stream
 func (sm *StreamManager) AddHLSSegment(id string, packets []*av.Packet, duration time.Duration) error {
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
-
+	sm.mutex.RLock()
 	stream, exists := sm.Streams[id]
 	if !exists {
+		sm.mutex.RUnlock()
 		return configs.ErrStreamNotFound
 	}
+	codecs := stream.Codecs
+	sm.mutex.RUnlock()
 
-	stream.HLSSegmentNumber++
-	stream.HLSSegmentBuffer[stream.HLSSegmentNumber] = &Segment{
+	// Mux outside the lock so playlist and segment readers are not blocked
+	segment := &Segment{
 		Duration: duration,
+		Start:    time.Now().Add(-duration),
 		Data:     packets,
 	}
+	if data, err := muxTSSegment(codecs, packets); err == nil {
+		segment.TS = data
+		segment.ETag = segmentETag(data)
+	} else {
+		log.Printf("[%s] Error pre-muxing HLS segment: %v", id, err)
+	}
 
-	// Cleanup old segments (keep last 6)
-	const maxSegments = 6
+	sm.mutex.Lock()
+
+	stream, exists = sm.Streams[id]
+	if !exists {
+		sm.mutex.Unlock()
+		return configs.ErrStreamNotFound
+	}
+
+	// Partial segments cut since the previous keyframe belong to this segment
+	segment.Parts = stream.HLSPendingParts
+	stream.HLSPendingParts = nil
+
+	segment.Discontinuity = stream.hlsDiscontinuity
+	stream.hlsDiscontinuity = false
+
+	stream.HLSSegmentNumber++
+	stream.HLSSegmentBuffer[stream.HLSSegmentNumber] = segment
+
+	// DASH runs on its own continuous clock so a source reconnect never moves its timeline backwards
+	if stream.DASHStart.IsZero() {
+		stream.DASHStart = segment.Start
+	}
+	segment.DASHTime = stream.DASHTime
+	stream.DASHTime += duration
+	notifyHLSUpdate(stream)
+
+	if duration > stream.HLSMaxSegmentDuration {
+		stream.HLSMaxSegmentDuration = duration
+	}
+
+	// Cleanup old segments beyond the playlist window
+	maxSegments := hlsWindowSize(stream)
 	if len(stream.HLSSegmentBuffer) > maxSegments {
 		// Find oldest segment(s) to remove
 		var keys []int
@@ -281,15 +631,59 @@ func (sm *StreamManager) AddHLSSegment(id string, packets []*av.Packet, duration
 
 		// Remove all but the latest maxSegments
 		for i := 0; i < len(keys)-maxSegments; i++ {
+			if stream.HLSSegmentBuffer[keys[i]].Discontinuity {
+				stream.HLSDiscontinuitySequence++
+			}
 			delete(stream.HLSSegmentBuffer, keys[i])
 		}
 	}
 
+	// Keep a copy for time-shifted playback when the stream has a DVR window
+	if stream.DVR == nil && dvrWindow(stream) > 0 {
+		stream.DVR = newDVRStore(id, dvrWindow(stream))
+	}
+	dvr := stream.DVR
+	seq := stream.HLSSegmentNumber
+	sm.mutex.Unlock()
+
+	// The DVR may spill to disk, so it is fed outside the manager lock
+	if dvr != nil && segment.TS != nil {
+		dvr.add(seq, duration, segment.Start, segment.TS, segment.Discontinuity)
+	}
+
 	return nil
 }
 
-// GetHLSM3U8 generates an M3U8 playlist for a stream
-func (sm *StreamManager) GetHLSM3U8(id string) (string, int, error) {
+// MarkHLSDiscontinuity flags the next segment as not continuing from the previous one
+func (sm *StreamManager) MarkHLSDiscontinuity(id string) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if stream, exists := sm.Streams[id]; exists {
+		stream.hlsDiscontinuity = true
+	}
+}
+
+// GetHLSSegmentNumber returns the media sequence number of the latest completed segment
+func (sm *StreamManager) GetHLSSegmentNumber(id string) (int, error) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		return 0, configs.ErrStreamNotFound
+	}
+
+	return stream.HLSSegmentNumber, nil
+}
+
+// GetHLSM3U8 generates an MPEG-TS M3U8 playlist for a stream, tagging segment URIs with the viewer session
+func (sm *StreamManager) GetHLSM3U8(id string, session string) (string, int, error) {
+	return sm.GetHLSPlaylist(id, session, HLSFormatTS)
+}
+
+// GetHLSPlaylist generates an M3U8 playlist for a stream in the given segment format
+func (sm *StreamManager) GetHLSPlaylist(id string, session string, format string) (string, int, error) {
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
 
@@ -298,11 +692,43 @@ func (sm *StreamManager) GetHLSM3U8(id string) (string, int, error) {
 		return "", 0, configs.ErrStreamNotFound
 	}
 
+	// fMP4 playlists are refused outright once the codecs are known to be unsupported
+	if format == HLSFormatFMP4 || format == HLSFormatLL {
+		if err := fmp4Supported(stream.Codecs); len(stream.Codecs) > 0 && err != nil {
+			return "", 0, err
+		}
+	}
+
+	lowLatency := format == HLSFormatLL && hlsPartTarget() > 0
+
+	version := "4"
+	segmentFile := "file.ts"
+	if format == HLSFormatFMP4 || format == HLSFormatLL {
+		version = "7"
+		segmentFile = "file.m4s"
+	}
+	if lowLatency {
+		version = "9"
+	}
+
 	var playlist string
 	playlist += "#EXTM3U\r\n"
-	playlist += "#EXT-X-TARGETDURATION:4\r\n"
-	playlist += "#EXT-X-VERSION:4\r\n"
+	targetDuration := hlsPlaylistTargetDuration(stream)
+
+	playlist += "#EXT-X-TARGETDURATION:" + strconv.Itoa(targetDuration) + "\r\n"
+	playlist += "#EXT-X-VERSION:" + version + "\r\n"
+	if lowLatency {
+		partTarget := hlsPartTarget().Seconds()
+		playlist += "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=" + strconv.FormatFloat(3*partTarget, 'f', 3, 64) + "\r\n"
+		playlist += "#EXT-X-PART-INF:PART-TARGET=" + strconv.FormatFloat(partTarget, 'f', 3, 64) + "\r\n"
+	}
 	playlist += "#EXT-X-MEDIA-SEQUENCE:" + strconv.Itoa(stream.HLSSegmentNumber-len(stream.HLSSegmentBuffer)+1) + "\r\n"
+	if stream.HLSDiscontinuitySequence > 0 {
+		playlist += "#EXT-X-DISCONTINUITY-SEQUENCE:" + strconv.Itoa(stream.HLSDiscontinuitySequence) + "\r\n"
+	}
+	if format == HLSFormatFMP4 || format == HLSFormatLL {
+		playlist += "#EXT-X-MAP:URI=\"init.mp4" + sessionQuery(session) + "\"\r\n"
+	}
 
 	var keys []int
 	for k := range stream.HLSSegmentBuffer {
@@ -310,12 +736,38 @@ func (sm *StreamManager) GetHLSM3U8(id string) (string, int, error) {
 	}
 	sort.Ints(keys)
 
+	// Parts are only advertised for segments within three target durations of the live edge
+	partsFrom := len(keys)
+	if lowLatency {
+		var recent time.Duration
+		for partsFrom > 0 && recent < 3*time.Duration(targetDuration)*time.Second {
+			partsFrom--
+			recent += stream.HLSSegmentBuffer[keys[partsFrom]].Duration
+		}
+	}
+
 	segmentCount := 0
-	for _, i := range keys {
+	for n, i := range keys {
 		segmentCount++
+		if stream.HLSSegmentBuffer[i].Discontinuity {
+			playlist += "#EXT-X-DISCONTINUITY\r\n"
+		}
+		if n >= partsFrom {
+			playlist += renderHLSParts(stream.HLSSegmentBuffer[i].Parts, i, session)
+		}
 		duration := strconv.FormatFloat(stream.HLSSegmentBuffer[i].Duration.Seconds(), 'f', 1, 64)
 		playlist += "#EXTINF:" + duration + ",\r\n"
-		playlist += "segment/" + strconv.Itoa(i) + "/file.ts\r\n"
+		playlist += "segment/" + strconv.Itoa(i) + "/" + segmentFile + sessionQuery(session) + "\r\n"
+	}
+
+	// The segment in progress is only visible through its parts and a hint for the next one
+	if lowLatency {
+		next := stream.HLSSegmentNumber + 1
+		if stream.hlsDiscontinuity && len(stream.HLSPendingParts) > 0 {
+			playlist += "#EXT-X-DISCONTINUITY\r\n"
+		}
+		playlist += renderHLSParts(stream.HLSPendingParts, next, session)
+		playlist += "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"" + partURI(next, len(stream.HLSPendingParts), session) + "\"\r\n"
 	}
 
 	return playlist, segmentCount, nil
@@ -339,24 +791,116 @@ func (sm *StreamManager) GetHLSSegment(id string, seq int) ([]*av.Packet, error)
 	return segment.Data, nil
 }
 
+// GetHLSSegmentTS retrieves the pre-muxed MPEG-TS bytes and ETag of a segment
+func (sm *StreamManager) GetHLSSegmentTS(id string, seq int) ([]byte, string, error) {
+	sm.mutex.RLock()
+	stream, exists := sm.Streams[id]
+	if !exists {
+		sm.mutex.RUnlock()
+		return nil, "", configs.ErrStreamNotFound
+	}
+
+	segment, exists := stream.HLSSegmentBuffer[seq]
+	if !exists {
+		// Segments that left the live window may still be held for time-shifted playback
+		dvr := stream.DVR
+		sm.mutex.RUnlock()
+
+		if dvr == nil {
+			return nil, "", configs.ErrStreamNotHLSSegments
+		}
+
+		data, err := dvr.get(seq)
+		if err != nil {
+			return nil, "", err
+		}
+		return data, segmentETag(data), nil
+	}
+
+	if segment.TS != nil {
+		sm.mutex.RUnlock()
+		return segment.TS, segment.ETag, nil
+	}
+
+	// Pre-muxing failed earlier; render it now and cache the result
+	codecs := stream.Codecs
+	packets := segment.Data
+	sm.mutex.RUnlock()
+
+	data, err := muxTSSegment(codecs, packets)
+	if err != nil {
+		return nil, "", err
+	}
+
+	etag := segmentETag(data)
+
+	sm.mutex.Lock()
+	segment.TS = data
+	segment.ETag = etag
+	sm.mutex.Unlock()
+
+	return data, etag, nil
+}
+
 // FlushHLSSegments removes all HLS segments for a stream
 func (sm *StreamManager) FlushHLSSegments(id string) error {
 	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
 
 	stream, exists := sm.Streams[id]
 	if !exists {
+		sm.mutex.Unlock()
 		return configs.ErrStreamNotFound
 	}
 
 	stream.HLSSegmentBuffer = make(map[int]*Segment)
+	stream.HLSPendingParts = nil
+	stream.HLSPartSequence = 0
 	stream.HLSSegmentNumber = 0
+	stream.HLSMaxSegmentDuration = 0
+	stream.DASHStart = time.Time{}
+	stream.DASHTime = 0
+	stream.HLSDiscontinuitySequence = 0
+	stream.hlsDiscontinuity = false
+
+	dvr := stream.DVR
+	stream.DVR = nil
+	sm.mutex.Unlock()
+
+	if dvr != nil {
+		dvr.close()
+	}
 
 	return nil
 }
 
 // Utility functions
 
+// safePathComponent turns a stream ID into a single, traversal-free path element
+func safePathComponent(id string) string {
+	cleaned := []rune(id)
+	for i, r := range cleaned {
+		isSafe := r == '-' || r == '_' || r == '.' ||
+			(r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !isSafe {
+			cleaned[i] = '_'
+		}
+	}
+
+	result := string(cleaned)
+	if result == "" || result == "." || result == ".." {
+		return "_"
+	}
+	return result
+}
+
+// sessionQuery returns the query string that carries an HLS session token
+func sessionQuery(session string) string {
+	if session == "" {
+		return ""
+	}
+	return "?" + hlsSessionParam + "=" + url.QueryEscape(session)
+}
+
 // generateUUID generates a unique identifier
 func generateUUID() string {
 	b := make([]byte, 16)
@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"time"
+)
+
+// Stream lifecycle states
+const (
+	StreamStateIdle            = "idle"
+	StreamStateConnecting      = "connecting"
+	StreamStateWaitingKeyframe = "waiting-for-keyframe"
+	StreamStateLive            = "live"
+	StreamStateReconnecting    = "reconnecting"
+	StreamStateFailed          = "failed"
+	StreamStateStopped         = "stopped"
+)
+
+// maxStateTransitions bounds the transition history kept per stream
+const maxStateTransitions = 20
+
+// StateTransition is one entry in a stream's state history
+type StateTransition struct {
+	State string    `json:"state"`
+	At    time.Time `json:"at"`
+	Error string    `json:"error,omitempty"`
+}
+
+// transition moves a stream to a new state; the caller must hold the manager lock
+func (stream *StreamConfig) transition(state string, err error) {
+	if state == stream.State && err == nil {
+		return
+	}
+
+	now := time.Now()
+	entry := StateTransition{State: state, At: now}
+	if err != nil {
+		entry.Error = err.Error()
+		stream.LastError = entry.Error
+		stream.LastErrorAt = now
+	}
+
+	stream.State = state
+	stream.StateSince = now
+	stream.Status = state == StreamStateLive
+
+	if len(stream.Transitions) >= maxStateTransitions {
+		stream.Transitions = stream.Transitions[len(stream.Transitions)-maxStateTransitions+1:]
+	}
+	stream.Transitions = append(stream.Transitions, entry)
+}
+
+// setStreamState moves a stream to a new state, recording the error that caused it if any
+func (sm *StreamManager) setStreamState(id string, state string, err error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if stream, exists := sm.Streams[id]; exists {
+		stream.transition(state, err)
+	}
+}
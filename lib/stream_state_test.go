@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestStreamConfigTransition(t *testing.T) {
+	errDial := errors.New("dial tcp: connection refused")
+
+	// step is one call to transition
+	type step struct {
+		state string
+		err   error
+	}
+
+	// Alternate between two states to overflow the history
+	var flapping []step
+	var flappingWant []string
+	for i := 0; i < maxStateTransitions+5; i++ {
+		state := StreamStateConnecting
+		if i%2 == 1 {
+			state = StreamStateLive
+		}
+		flapping = append(flapping, step{state: state})
+		flappingWant = append(flappingWant, state)
+	}
+	flappingWant = flappingWant[len(flappingWant)-maxStateTransitions:]
+
+	tests := []struct {
+		name      string
+		steps     []step
+		history   []string
+		state     string
+		status    bool
+		lastError string
+	}{
+		{
+			name:    "normal start",
+			steps:   []step{{state: StreamStateIdle}, {state: StreamStateConnecting}, {state: StreamStateWaitingKeyframe}, {state: StreamStateLive}},
+			history: []string{StreamStateIdle, StreamStateConnecting, StreamStateWaitingKeyframe, StreamStateLive},
+			state:   StreamStateLive,
+			status:  true,
+		},
+		{
+			name:    "same state is not recorded twice",
+			steps:   []step{{state: StreamStateConnecting}, {state: StreamStateConnecting}},
+			history: []string{StreamStateConnecting},
+			state:   StreamStateConnecting,
+		},
+		{
+			name:      "same state with an error is recorded",
+			steps:     []step{{state: StreamStateReconnecting}, {state: StreamStateReconnecting, err: errDial}},
+			history:   []string{StreamStateReconnecting, StreamStateReconnecting},
+			state:     StreamStateReconnecting,
+			lastError: errDial.Error(),
+		},
+		{
+			name:      "last error survives recovery",
+			steps:     []step{{state: StreamStateLive}, {state: StreamStateReconnecting, err: errDial}, {state: StreamStateLive}},
+			history:   []string{StreamStateLive, StreamStateReconnecting, StreamStateLive},
+			state:     StreamStateLive,
+			status:    true,
+			lastError: errDial.Error(),
+		},
+		{
+			name:      "failed is not live",
+			steps:     []step{{state: StreamStateLive}, {state: StreamStateFailed, err: errDial}},
+			history:   []string{StreamStateLive, StreamStateFailed},
+			state:     StreamStateFailed,
+			lastError: errDial.Error(),
+		},
+		{
+			name:    "history keeps the newest entries",
+			steps:   flapping,
+			history: flappingWant,
+			state:   flappingWant[len(flappingWant)-1],
+			status:  flappingWant[len(flappingWant)-1] == StreamStateLive,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &StreamConfig{}
+			for _, s := range tt.steps {
+				stream.transition(s.state, s.err)
+			}
+
+			var history []string
+			for _, entry := range stream.Transitions {
+				history = append(history, entry.State)
+			}
+			if !slices.Equal(history, tt.history) {
+				t.Fatalf("history = %v, want %v", history, tt.history)
+			}
+			if stream.State != tt.state || stream.Status != tt.status || stream.LastError != tt.lastError {
+				t.Fatalf("state = %q, status = %v, last error = %q; want %q, %v, %q",
+					stream.State, stream.Status, stream.LastError, tt.state, tt.status, tt.lastError)
+			}
+
+			last := stream.Transitions[len(stream.Transitions)-1]
+			if !last.At.Equal(stream.StateSince) {
+				t.Fatalf("StateSince = %v, want the last transition time %v", stream.StateSince, last.At)
+			}
+			if tt.lastError != "" && stream.LastErrorAt.IsZero() {
+				t.Fatalf("LastErrorAt not set for %q", tt.lastError)
+			}
+		})
+	}
+}
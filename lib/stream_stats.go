@@ -0,0 +1,332 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/codec/h264parser"
+	"github.com/deepch/vdk/codec/h265parser"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// statsRateWindow is how long the ingest bitrate and frame rate are averaged over
+const statsRateWindow = 2 * time.Second
+
+// statsMinGap is the smallest timestamp jump counted as a gap; smaller jumps are normal frame spacing
+const statsMinGap = 500 * time.Millisecond
+
+// Viewer output types, as reported in stream statistics
+const (
+	ViewerWebRTC = "webrtc"
+	ViewerMSE    = "mse"
+	ViewerFLV    = "flv"
+	ViewerMPEGTS = "mpegts"
+	ViewerRTSP   = "rtsp"
+	ViewerHLS    = "hls"
+)
+
+// StreamStats is a point-in-time view of a stream's ingest and output
+type StreamStats struct {
+	State                   string         `json:"state"`
+	UptimeSeconds           float64        `json:"uptime_seconds"`
+	Reconnects              int            `json:"reconnects"`
+	BitrateKbps             float64        `json:"bitrate_kbps"`
+	FPS                     float64        `json:"fps"`
+	GOPLength               int            `json:"gop_length"`
+	KeyframeIntervalSeconds float64        `json:"keyframe_interval_seconds"`
+	Packets                 int64          `json:"packets"`
+	Bytes                   int64          `json:"bytes"`
+	LostPackets             int64          `json:"lost_packets"`
+	TimestampGaps           int64          `json:"timestamp_gaps"`
+	MaxGapSeconds           float64        `json:"max_gap_seconds"`
+	Video                   *VideoStats    `json:"video,omitempty"`
+	Segments                SegmentStats   `json:"segments"`
+	Viewers                 map[string]int `json:"viewers"`
+}
+
+// VideoStats describes the video track as parsed from its SPS
+type VideoStats struct {
+	Codec   string `json:"codec"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Profile string `json:"profile,omitempty"`
+	Level   string `json:"level,omitempty"`
+}
+
+// SegmentStats summarizes the HLS segments currently in the playlist window
+type SegmentStats struct {
+	Count              int     `json:"count"`
+	Produced           int     `json:"produced"`
+	MinDurationSeconds float64 `json:"min_duration_seconds"`
+	MaxDurationSeconds float64 `json:"max_duration_seconds"`
+	AvgDurationSeconds float64 `json:"avg_duration_seconds"`
+}
+
+// ingestStats accumulates a stream's packet statistics across its source sessions.
+// It has its own lock so the ingest pipeline can update it without taking the manager lock.
+type ingestStats struct {
+	mutex    sync.Mutex
+	sessions int
+	packets  int64
+	bytes    int64
+
+	// Rates over the last complete window
+	windowStart  time.Time
+	windowBytes  int64
+	windowFrames int
+	lastPacketAt time.Time
+	bitrate      float64
+	fps          float64
+
+	// GOP structure of the video track
+	gopFrames        int
+	gopLength        int
+	lastKeyframe     time.Duration
+	keyframeInterval time.Duration
+	seenKeyframe     bool
+
+	// Timestamp gaps on the track that drives segmenting
+	lastTS    time.Duration
+	lastDelta time.Duration
+	seenTS    bool
+	gaps      int64
+	maxGap    time.Duration
+
+	// RTP packets lost by the source, for sources that can tell
+	lostTotal   int64
+	lostSession int64
+}
+
+// startSession resets the per-connection state when a source (re)connects
+func (s *ingestStats) startSession() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions++
+	s.lostTotal += s.lostSession
+	s.lostSession = 0
+	s.windowStart = time.Now()
+	s.windowBytes = 0
+	s.windowFrames = 0
+	s.gopFrames = 0
+	s.seenKeyframe = false
+	s.seenTS = false
+	s.lastDelta = 0
+}
+
+// observe accounts for one ingested packet; timing is only tracked on video, or on audio for audio-only streams
+func (s *ingestStats) observe(packet *av.Packet, isVideo bool, audioOnly bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.packets++
+	s.bytes += int64(len(packet.Data))
+	s.windowBytes += int64(len(packet.Data))
+	s.lastPacketAt = now
+
+	if isVideo || audioOnly {
+		s.windowFrames++
+		s.observeTiming(packet.Time)
+	}
+
+	if isVideo {
+		if packet.IsKeyFrame {
+			if s.seenKeyframe {
+				s.gopLength = s.gopFrames
+				s.keyframeInterval = packet.Time - s.lastKeyframe
+			}
+			s.seenKeyframe = true
+			s.lastKeyframe = packet.Time
+			s.gopFrames = 0
+		}
+		s.gopFrames++
+	}
+
+	if elapsed := now.Sub(s.windowStart); elapsed >= statsRateWindow {
+		s.bitrate = float64(s.windowBytes*8) / elapsed.Seconds()
+		s.fps = float64(s.windowFrames) / elapsed.Seconds()
+		s.windowStart = now
+		s.windowBytes = 0
+		s.windowFrames = 0
+	}
+}
+
+// observeTiming counts timestamps that jump backwards or far beyond the usual frame spacing
+func (s *ingestStats) observeTiming(ts time.Duration) {
+	if s.seenTS {
+		delta := ts - s.lastTS
+		if delta < 0 || (delta > statsMinGap && delta > 4*s.lastDelta) {
+			s.gaps++
+			s.maxGap = max(s.maxGap, delta.Abs())
+		} else if delta > 0 {
+			s.lastDelta = delta
+		}
+	}
+	s.seenTS = true
+	s.lastTS = ts
+}
+
+// setSourceLoss records the packets the current source reports lost so far
+func (s *ingestStats) setSourceLoss(lost int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lostSession = lost
+}
+
+// fill copies the ingest counters into a stats view; rates drop to zero once packets stop arriving
+func (s *ingestStats) fill(stats *StreamStats) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats.Reconnects = max(s.sessions-1, 0)
+	stats.Packets = s.packets
+	stats.Bytes = s.bytes
+	stats.LostPackets = s.lostTotal + s.lostSession
+	stats.TimestampGaps = s.gaps
+	stats.MaxGapSeconds = s.maxGap.Seconds()
+	stats.GOPLength = s.gopLength
+	stats.KeyframeIntervalSeconds = s.keyframeInterval.Seconds()
+
+	if time.Since(s.lastPacketAt) < 2*statsRateWindow {
+		stats.BitrateKbps = s.bitrate / 1000
+		stats.FPS = s.fps
+	}
+}
+
+// ingestStats returns the statistics collector of a stream; a missing stream gets a detached one
+func (sm *StreamManager) ingestStats(id string) *ingestStats {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	if stream, exists := sm.Streams[id]; exists {
+		return stream.stats
+	}
+	return &ingestStats{}
+}
+
+// GetStreamStats returns the current runtime statistics of a stream
+func (sm *StreamManager) GetStreamStats(id string) (StreamStats, error) {
+	sm.mutex.RLock()
+
+	stream, exists := sm.Streams[id]
+	if !exists {
+		sm.mutex.RUnlock()
+		return StreamStats{}, configs.ErrStreamNotFound
+	}
+
+	now := time.Now()
+	stats := StreamStats{
+		State:    stream.State,
+		Video:    videoStats(stream.Codecs),
+		Segments: segmentStats(stream),
+		Viewers:  make(map[string]int),
+	}
+	if stream.State == StreamStateLive {
+		stats.UptimeSeconds = now.Sub(stream.StateSince).Seconds()
+	}
+
+	for _, viewer := range stream.Clients {
+		stats.Viewers[viewer.Kind]++
+	}
+	if sessions := activeHLSSessions(stream, now); sessions > 0 {
+		stats.Viewers[ViewerHLS] = sessions
+	}
+
+	collector := stream.stats
+	sm.mutex.RUnlock()
+
+	collector.fill(&stats)
+	return stats, nil
+}
+
+// segmentStats summarizes the buffered segments; caller must hold the mutex
+func segmentStats(stream *StreamConfig) SegmentStats {
+	stats := SegmentStats{
+		Count:    len(stream.HLSSegmentBuffer),
+		Produced: stream.HLSSegmentNumber,
+	}
+
+	var total time.Duration
+	for _, segment := range stream.HLSSegmentBuffer {
+		seconds := segment.Duration.Seconds()
+		if stats.MinDurationSeconds == 0 || seconds < stats.MinDurationSeconds {
+			stats.MinDurationSeconds = seconds
+		}
+		stats.MaxDurationSeconds = max(stats.MaxDurationSeconds, seconds)
+		total += segment.Duration
+	}
+	if stats.Count > 0 {
+		stats.AvgDurationSeconds = total.Seconds() / float64(stats.Count)
+	}
+
+	return stats
+}
+
+// videoStats describes the first video track, or returns nil for audio-only streams
+func videoStats(codecs []av.CodecData) *VideoStats {
+	for _, codec := range codecs {
+		switch codec := codec.(type) {
+		case h264parser.CodecData:
+			return &VideoStats{
+				Codec:   "h264",
+				Width:   codec.Width(),
+				Height:  codec.Height(),
+				Profile: h264ProfileName(codec.SPSInfo.ProfileIdc),
+				Level:   fmt.Sprintf("%.1f", float64(codec.SPSInfo.LevelIdc)/10),
+			}
+		case h265parser.CodecData:
+			stats := &VideoStats{
+				Codec:  "h265",
+				Width:  codec.Width(),
+				Height: codec.Height(),
+			}
+			// profile_tier_level follows the two byte NAL header and the parameter set ID byte
+			if sps := h264parser.RemoveH264orH265EmulationBytes(codec.SPS()); len(sps) > 14 {
+				stats.Profile = h265ProfileName(uint(sps[3] & 0x1f))
+				stats.Level = fmt.Sprintf("%.1f", float64(sps[14])/30)
+			}
+			return stats
+		}
+	}
+	return nil
+}
+
+// h264ProfileName names an H.264 profile_idc
+func h264ProfileName(profile uint) string {
+	switch profile {
+	case 66:
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4"
+	}
+	return fmt.Sprintf("%d", profile)
+}
+
+// h265ProfileName names an H.265 general_profile_idc
+func h265ProfileName(profile uint) string {
+	switch profile {
+	case 1:
+		return "Main"
+	case 2:
+		return "Main 10"
+	case 3:
+		return "Main Still Picture"
+	case 4:
+		return "Range Extensions"
+	}
+	return fmt.Sprintf("%d", profile)
+}
@@ -0,0 +1,263 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deepch/vdk/av"
+	"github.com/deepch/vdk/format/mp4"
+	"github.com/deepch/vdk/format/ts"
+	"github.com/gin-gonic/gin"
+	"org.donghyuns.com/rtsphls/configs"
+)
+
+// Recording is a finalized recording file on disk
+type Recording struct {
+	Name     string
+	Path     string
+	Format   string
+	Start    time.Time
+	Duration time.Duration
+}
+
+// parseRecordingName splits "<start>_<durationMs>.<format>" into its parts
+func parseRecordingName(name string) (Recording, error) {
+	ext := filepath.Ext(name)
+	format := strings.TrimPrefix(ext, ".")
+	if format != "ts" && format != "mp4" {
+		return Recording{}, configs.ErrRecordingNotFound
+	}
+
+	base := strings.TrimSuffix(name, ext)
+	startStr, durationStr, found := strings.Cut(base, "_")
+	if !found {
+		return Recording{}, configs.ErrRecordingNotFound
+	}
+
+	start, err := time.Parse(recordingTimeLayout, startStr)
+	if err != nil {
+		return Recording{}, configs.ErrRecordingNotFound
+	}
+
+	durationMs, err := strconv.ParseInt(durationStr, 10, 64)
+	if err != nil || durationMs < 0 {
+		return Recording{}, configs.ErrRecordingNotFound
+	}
+
+	return Recording{
+		Name:     base,
+		Format:   format,
+		Start:    start,
+		Duration: time.Duration(durationMs) * time.Millisecond,
+	}, nil
+}
+
+// ListRecordings returns a stream's finalized recordings overlapping [from, to], oldest first
+func ListRecordings(streamID string, from, to time.Time) []Recording {
+	root := filepath.Join(configs.GlobalConfig.RecordDir, safePathComponent(streamID))
+
+	var recordings []Recording
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		recording, err := parseRecordingName(info.Name())
+		if err != nil {
+			return nil
+		}
+
+		end := recording.Start.Add(recording.Duration)
+		if end.Before(from) || recording.Start.After(to) {
+			return nil
+		}
+
+		recording.Path = path
+		recordings = append(recordings, recording)
+		return nil
+	})
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Start.Before(recordings[j].Start)
+	})
+	return recordings
+}
+
+// findRecording locates a recording by the name used in VOD segment URIs
+func findRecording(streamID string, name string) (Recording, error) {
+	for _, format := range []string{"ts", "mp4"} {
+		recording, err := parseRecordingName(name + "." + format)
+		if err != nil {
+			return Recording{}, err
+		}
+
+		// The layout is derived from the parsed start time, so the name cannot escape the stream directory
+		recording.Path = filepath.Join(configs.GlobalConfig.RecordDir, safePathComponent(streamID),
+			recording.Start.Format("2006-01-02"), recording.Start.Format("15"), recording.Name+"."+format)
+		if _, err := os.Stat(recording.Path); err == nil {
+			return recording, nil
+		}
+	}
+
+	return Recording{}, configs.ErrRecordingNotFound
+}
+
+// readRecordingTS returns a recording as MPEG-TS bytes, remuxing MP4 recordings
+func readRecordingTS(recording Recording) ([]byte, error) {
+	if recording.Format == "ts" {
+		return os.ReadFile(recording.Path)
+	}
+
+	codecs, packets, err := readRecordingPackets(recording)
+	if err != nil {
+		return nil, err
+	}
+
+	return muxTSSegment(codecs, packets)
+}
+
+// readRecordingPackets demuxes all packets of a recording file
+func readRecordingPackets(recording Recording) ([]av.CodecData, []*av.Packet, error) {
+	file, err := os.Open(recording.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var demuxer av.Demuxer
+	if recording.Format == "mp4" {
+		demuxer = mp4.NewDemuxer(file)
+	} else {
+		demuxer = ts.NewDemuxer(file)
+	}
+
+	return readAllPackets(demuxer)
+}
+
+// readAllPackets drains a demuxer into memory
+func readAllPackets(demuxer av.Demuxer) ([]av.CodecData, []*av.Packet, error) {
+	codecs, err := demuxer.Streams()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var packets []*av.Packet
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		packets = append(packets, &pkt)
+	}
+
+	return codecs, packets, nil
+}
+
+// GetVODPlaylist builds an HLS VOD playlist over a stream's recordings in [from, to]
+func GetVODPlaylist(streamID string, from, to time.Time) (string, error) {
+	recordings := ListRecordings(streamID, from, to)
+	if len(recordings) == 0 {
+		return "", configs.ErrRecordingNotFound
+	}
+
+	targetDuration := 1
+	for _, recording := range recordings {
+		if seconds := int(math.Ceil(recording.Duration.Seconds())); seconds > targetDuration {
+			targetDuration = seconds
+		}
+	}
+
+	var playlist string
+	playlist += "#EXTM3U\r\n"
+	playlist += "#EXT-X-VERSION:4\r\n"
+	playlist += "#EXT-X-PLAYLIST-TYPE:VOD\r\n"
+	playlist += "#EXT-X-TARGETDURATION:" + strconv.Itoa(targetDuration) + "\r\n"
+	playlist += "#EXT-X-MEDIA-SEQUENCE:0\r\n"
+
+	for i, recording := range recordings {
+		// Every recording file restarts its timestamps
+		if i > 0 {
+			playlist += "#EXT-X-DISCONTINUITY\r\n"
+		}
+		duration := strconv.FormatFloat(recording.Duration.Seconds(), 'f', 3, 64)
+		playlist += "#EXT-X-PROGRAM-DATE-TIME:" + recording.Start.UTC().Format("2006-01-02T15:04:05.000Z") + "\r\n"
+		playlist += "#EXTINF:" + duration + ",\r\n"
+		playlist += "segment/" + recording.Name + "/file.ts\r\n"
+	}
+	playlist += "#EXT-X-ENDLIST\r\n"
+
+	return playlist, nil
+}
+
+// parseTimeRange reads the from/to query parameters, defaulting to to=now
+func parseTimeRange(c *gin.Context) (time.Time, time.Time, error) {
+	from, err := ParseTimestamp(c.Query("from"))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	to := time.Now()
+	if toStr := c.Query("to"); toStr != "" {
+		if to, err = ParseTimestamp(toStr); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, configs.ErrInvalidTimeRange
+	}
+
+	return from, to, nil
+}
+
+// PlayVOD handles recorded-footage playlist requests for ?from=..&to=..
+func PlayVOD(c *gin.Context) {
+	cctvId := c.Param("cctvId")
+
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		c.String(400, "Invalid from/to time range")
+		return
+	}
+
+	playlist, err := GetVODPlaylist(cctvId, from, to)
+	if err != nil {
+		c.String(404, "No recordings in time range")
+		return
+	}
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	c.Header("Cache-Control", "no-cache")
+	c.String(200, playlist)
+}
+
+// PlayVODTS handles recorded segment requests
+func PlayVODTS(c *gin.Context) {
+	cctvId := c.Param("cctvId")
+
+	recording, err := findRecording(cctvId, c.Param("name"))
+	if err != nil {
+		c.String(404, "Segment not found")
+		return
+	}
+
+	data, err := readRecordingTS(recording)
+	if err != nil {
+		log.Printf("Error reading recording %s for CCTV ID %s: %v", recording.Path, cctvId, err)
+		c.String(500, "Error reading recording")
+		return
+	}
+
+	serveSegment(c, data, segmentETag(data), "video/mp2t")
+}
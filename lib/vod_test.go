@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRecordingName(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		ok       bool
+		base     string
+		format   string
+		start    time.Time
+		duration time.Duration
+	}{
+		{
+			name:     "mpeg-ts",
+			file:     "20261016T101530Z_60000.ts",
+			ok:       true,
+			base:     "20261016T101530Z_60000",
+			format:   "ts",
+			start:    time.Date(2026, 10, 16, 10, 15, 30, 0, time.UTC),
+			duration: time.Minute,
+		},
+		{
+			name:     "mp4",
+			file:     "20261016T000000Z_1500.mp4",
+			ok:       true,
+			base:     "20261016T000000Z_1500",
+			format:   "mp4",
+			start:    time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC),
+			duration: 1500 * time.Millisecond,
+		},
+		{name: "in progress", file: "20261016T101530Z.ts.recording"},
+		{name: "unknown format", file: "20261016T101530Z_60000.mkv"},
+		{name: "missing duration", file: "20261016T101530Z.ts"},
+		{name: "bad start", file: "2026-10-16_60000.ts"},
+		{name: "bad duration", file: "20261016T101530Z_1m.ts"},
+		{name: "negative duration", file: "20261016T101530Z_-5.ts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recording, err := parseRecordingName(tt.file)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("parseRecordingName(%q) = %+v, want error", tt.file, recording)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRecordingName(%q) = %v", tt.file, err)
+			}
+			if recording.Name != tt.base || recording.Format != tt.format || !recording.Start.Equal(tt.start) || recording.Duration != tt.duration {
+				t.Fatalf("parseRecordingName(%q) = %+v", tt.file, recording)
+			}
+		})
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	from := time.Date(2026, 10, 16, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		query string
+		ok    bool
+		from  time.Time
+		to    time.Time
+		toNow bool
+	}{
+		{
+			name:  "rfc 3339",
+			query: "from=2026-10-16T10:00:00Z&to=2026-10-16T11:00:00Z",
+			ok:    true,
+			from:  from,
+			to:    from.Add(time.Hour),
+		},
+		{
+			name:  "unix seconds",
+			query: "from=1792144800&to=1792148400",
+			ok:    true,
+			from:  from,
+			to:    from.Add(time.Hour),
+		},
+		{
+			name:  "to defaults to now",
+			query: "from=2026-10-16T10:00:00Z",
+			ok:    true,
+			from:  from,
+			toNow: true,
+		},
+		{name: "missing from", query: "to=2026-10-16T11:00:00Z"},
+		{name: "bad to", query: "from=2026-10-16T10:00:00Z&to=yesterday"},
+		{name: "empty range", query: "from=2026-10-16T10:00:00Z&to=2026-10-16T10:00:00Z"},
+		{name: "reversed range", query: "from=2026-10-16T11:00:00Z&to=2026-10-16T10:00:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/vod?"+tt.query, nil)
+
+			before := time.Now()
+			gotFrom, gotTo, err := parseTimeRange(c)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("parseTimeRange(%q) = %v, %v, want error", tt.query, gotFrom, gotTo)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTimeRange(%q) = %v", tt.query, err)
+			}
+			if !gotFrom.Equal(tt.from) {
+				t.Fatalf("from = %v, want %v", gotFrom, tt.from)
+			}
+			if tt.toNow {
+				if gotTo.Before(before) || gotTo.After(time.Now()) {
+					t.Fatalf("to = %v, want now", gotTo)
+				}
+			} else if !gotTo.Equal(tt.to) {
+				t.Fatalf("to = %v, want %v", gotTo, tt.to)
+			}
+		})
+	}
+}
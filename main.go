@@ -28,6 +28,12 @@ func main() {
 	// Create stream manager instance
 	streamManager := lib.NewStreamManager()
 
+	// Prune recordings by age and disk usage in the background
+	retention := lib.StartRecordingRetention()
+
+	// Delete expired clip exports, including those left over from a previous run
+	clipRetention := streamManager.StartClipRetention()
+
 	// Configure HTTP server with router
 	ginRouter := router.Network()
 	router.SetupRoutes(ginRouter, streamManager)
@@ -38,6 +44,31 @@ func main() {
 		Handler: ginRouter,
 	}
 
+	// End event feeds on shutdown, they would otherwise hold their connections open
+	server.RegisterOnShutdown(streamManager.CloseEvents)
+
+	// Serve managed streams to RTSP clients when a listener port is configured
+	var rtspServer *lib.RTSPServer
+	if configs.GlobalConfig.RtspServerPort != "" {
+		var err error
+		if rtspServer, err = lib.StartRTSPServer(streamManager); err != nil {
+			log.Fatalf("Failed to start RTSP server: %v", err)
+		}
+		log.Printf("Starting RTSP server on port %s", configs.GlobalConfig.RtspServerPort)
+	}
+
+	// Accept RTMP publishers when an ingest port is configured
+	var rtmpServer *lib.RTMPServer
+	if configs.GlobalConfig.RtmpServerPort != "" {
+		rtmpServer = lib.NewRTMPServer(streamManager)
+		go func() {
+			log.Printf("Starting RTMP server on port %s", configs.GlobalConfig.RtmpServerPort)
+			if err := rtmpServer.ListenAndServe(); err != nil {
+				log.Fatalf("Failed to start RTMP server: %v", err)
+			}
+		}()
+	}
+
 	// Start server in goroutine
 	go func() {
 		log.Printf("Starting server on port %s", streamManager.Server.HTTPPort)
@@ -62,5 +93,20 @@ func main() {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	// Disconnect RTSP clients before their sources go away
+	if rtspServer != nil {
+		rtspServer.Stop()
+	}
+
+	// Disconnect RTMP publishers so their recordings are finalized
+	if rtmpServer != nil {
+		rtmpServer.Stop()
+	}
+
+	// Stop all RTSP workers so camera sessions are closed
+	streamManager.StopAllWorkers()
+	retention.Stop()
+	clipRetention.Stop()
+
 	log.Println("Server exited properly")
 }
@@ -1,17 +1,28 @@
 package router
 
 import (
+	"errors"
+
 	"github.com/gin-gonic/gin"
+	"org.donghyuns.com/rtsphls/configs"
 	"org.donghyuns.com/rtsphls/lib"
 )
 
 // SetupRoutes configures all routes for the application
 func SetupRoutes(router *gin.Engine, streamManager *lib.StreamManager) {
+	// Count requests for the metrics endpoint; must be registered before the routes
+	router.Use(streamManager.MetricsMiddleware())
+
 	// Health check endpoint
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{"status": "ok"})
 	})
 
+	// Prometheus metrics endpoint
+	router.GET("/metrics", func(c *gin.Context) {
+		lib.ServeMetrics(c, streamManager)
+	})
+
 	// HLS playback routes
 	router.GET("/play/hls/:cctvId/index.m3u8", func(c *gin.Context) {
 		lib.PlayHLS(c, streamManager)
@@ -21,19 +32,137 @@ func SetupRoutes(router *gin.Engine, streamManager *lib.StreamManager) {
 		lib.PlayHLSTS(c, streamManager)
 	})
 
+	// fMP4 (CMAF) HLS playback routes
+	router.GET("/play/hls/:cctvId/index.fmp4.m3u8", func(c *gin.Context) {
+		lib.PlayHLSFMP4(c, streamManager)
+	})
+
+	router.GET("/play/hls/:cctvId/init.mp4", func(c *gin.Context) {
+		lib.PlayHLSInit(c, streamManager)
+	})
+
+	router.GET("/play/hls/:cctvId/segment/:seq/file.m4s", func(c *gin.Context) {
+		lib.PlayHLSFMP4Segment(c, streamManager)
+	})
+
+	// Time-shift (DVR) playback route; segments are served by the MPEG-TS segment route
+	router.GET("/play/hls/:cctvId/dvr.m3u8", func(c *gin.Context) {
+		lib.PlayHLSDVR(c, streamManager)
+	})
+
+	// Low-Latency HLS playback routes
+	router.GET("/play/hls/:cctvId/index.ll.m3u8", func(c *gin.Context) {
+		lib.PlayHLSLL(c, streamManager)
+	})
+
+	router.GET("/play/hls/:cctvId/segment/:seq/part/:part/file.m4s", func(c *gin.Context) {
+		lib.PlayHLSPart(c, streamManager)
+	})
+
+	// MPEG-DASH playback routes; every track is its own adaptation set with its own init segment
+	router.GET("/play/dash/:cctvId/manifest.mpd", func(c *gin.Context) {
+		lib.PlayDASH(c, streamManager)
+	})
+
+	router.GET("/play/dash/:cctvId/track/:track/init.mp4", func(c *gin.Context) {
+		lib.PlayDASHInit(c, streamManager)
+	})
+
+	router.GET("/play/dash/:cctvId/track/:track/segment/:seq/file.m4s", func(c *gin.Context) {
+		lib.PlayDASHSegment(c, streamManager)
+	})
+
+	// WebSocket Media Source Extensions playback route
+	router.GET("/play/mse/:cctvId", func(c *gin.Context) {
+		lib.PlayMSE(c, streamManager)
+	})
+
+	// Progressive live stream routes for legacy players
+	router.GET("/play/flv/:cctvId", func(c *gin.Context) {
+		lib.PlayFLV(c, streamManager)
+	})
+
+	router.GET("/play/ts/:cctvId", func(c *gin.Context) {
+		lib.PlayTS(c, streamManager)
+	})
+
+	// WebRTC (WHEP) playback routes
+	router.POST("/play/webrtc/:cctvId", func(c *gin.Context) {
+		lib.PlayWebRTC(c, streamManager)
+	})
+
+	router.DELETE("/play/webrtc/:cctvId/:sessionId", func(c *gin.Context) {
+		lib.StopWebRTC(c, streamManager)
+	})
+
+	// Recorded footage (VOD) playback routes
+	router.GET("/play/vod/:cctvId/index.m3u8", func(c *gin.Context) {
+		lib.PlayVOD(c)
+	})
+
+	router.GET("/play/vod/:cctvId/segment/:name/file.ts", func(c *gin.Context) {
+		lib.PlayVODTS(c)
+	})
+
 	// Stream management API routes
 	api := router.Group("/api")
 	{
+		// Stream lifecycle events as Server-Sent Events or WebSocket messages
+		api.GET("/events", func(c *gin.Context) {
+			lib.StreamEvents(c, streamManager)
+		})
+
+		api.GET("/events/ws", func(c *gin.Context) {
+			lib.StreamEventsWS(c, streamManager)
+		})
+
 		api.GET("/streams", func(c *gin.Context) {
 			streams := streamManager.ListStreams()
 			c.JSON(200, gin.H{"status": "success", "streams": streams})
 		})
 
+		api.GET("/streams/:id", func(c *gin.Context) {
+			id := c.Param("id")
+			stream, err := streamManager.StreamSnapshot(id)
+			if err != nil {
+				c.JSON(404, gin.H{"status": "error", "message": "Stream not found"})
+				return
+			}
+
+			c.JSON(200, gin.H{"status": "success", "id": id, "stream": stream})
+		})
+
+		api.GET("/streams/:id/stats", func(c *gin.Context) {
+			id := c.Param("id")
+			stats, err := streamManager.GetStreamStats(id)
+			if err != nil {
+				c.JSON(404, gin.H{"status": "error", "message": "Stream not found"})
+				return
+			}
+
+			c.JSON(200, gin.H{"status": "success", "id": id, "stats": stats})
+		})
+
 		api.POST("/streams/:id", func(c *gin.Context) {
 			id := c.Param("id")
 			var req struct {
-				URL      string `json:"url" binding:"required"`
-				OnDemand bool   `json:"on_demand"`
+				URL               string   `json:"url"`
+				BackupURLs        []string `json:"backup_urls"`
+				Source            string   `json:"source" binding:"omitempty,oneof=rtsp rtmp"`
+				PublishKey        string   `json:"publish_key"`
+				OnDemand          bool     `json:"on_demand"`
+				HLSWindowSize     int      `json:"hls_window_size" binding:"min=0"`
+				HLSTargetDuration int      `json:"hls_target_duration" binding:"min=0"`
+				DVRWindow         int      `json:"dvr_window" binding:"min=0"`
+				Record            bool     `json:"record"`
+				RTSP              struct {
+					Transport          string `json:"transport" binding:"omitempty,oneof=tcp udp auto"`
+					DialTimeout        int    `json:"dial_timeout" binding:"min=0"`
+					ReadTimeout        int    `json:"read_timeout" binding:"min=0"`
+					DisableAudio       bool   `json:"disable_audio"`
+					UserAgent          string `json:"user_agent"`
+					InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+				} `json:"rtsp"`
 			}
 
 			if err := c.ShouldBindJSON(&req); err != nil {
@@ -41,15 +170,150 @@ func SetupRoutes(router *gin.Engine, streamManager *lib.StreamManager) {
 				return
 			}
 
+			// RTMP streams are pushed by a publisher, every other source needs a URL to pull from
+			pushed := req.Source == lib.SourceRTMP
+			if !pushed && req.URL == "" {
+				c.JSON(400, gin.H{"status": "error", "message": "url is required"})
+				return
+			}
+			if !pushed {
+				for _, url := range append([]string{req.URL}, req.BackupURLs...) {
+					if err := lib.CheckSourceURL(url); err != nil {
+						c.JSON(400, gin.H{"status": "error", "message": "Unsupported url: " + err.Error()})
+						return
+					}
+				}
+			}
+
 			if streamManager.StreamExists(id) {
 				c.JSON(409, gin.H{"status": "error", "message": "Stream ID already exists"})
 				return
 			}
 
-			streamManager.AddStream(id, req.URL, req.OnDemand)
+			streamManager.AddStream(id, req.URL, req.OnDemand && !pushed)
+			if pushed {
+				streamManager.SetRTMPSource(id, req.PublishKey)
+			}
+			if !pushed {
+				streamManager.SetBackupURLs(id, req.BackupURLs)
+			}
+			streamManager.SetRTSPOptions(id, lib.RTSPOptions(req.RTSP))
+			streamManager.SetHLSSettings(id, req.HLSWindowSize, req.HLSTargetDuration)
+			streamManager.SetDVRWindow(id, req.DVRWindow)
+			if req.Record {
+				streamManager.SetRecording(id, true)
+			}
+			if !req.OnDemand && !pushed {
+				streamManager.StartWorker(id)
+			}
 			c.JSON(201, gin.H{"status": "success", "id": id})
 		})
 
+		api.PUT("/streams/:id", func(c *gin.Context) {
+			id := c.Param("id")
+			var req struct {
+				URL string `json:"url" binding:"required"`
+			}
+
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"status": "error", "message": err.Error()})
+				return
+			}
+
+			if err := lib.CheckSourceURL(req.URL); err != nil {
+				c.JSON(400, gin.H{"status": "error", "message": "Unsupported url: " + err.Error()})
+				return
+			}
+
+			err := streamManager.ReplaceStreamURL(id, req.URL)
+			if errors.Is(err, configs.ErrStreamPushSource) {
+				c.JSON(409, gin.H{"status": "error", "message": "Stream is fed by an RTMP publisher"})
+				return
+			}
+			if err != nil {
+				c.JSON(404, gin.H{"status": "error", "message": "Stream not found"})
+				return
+			}
+
+			c.JSON(200, gin.H{"status": "success", "id": id})
+		})
+
+		api.PUT("/streams/:id/recording", func(c *gin.Context) {
+			id := c.Param("id")
+			var req struct {
+				Enabled bool `json:"enabled"`
+			}
+
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"status": "error", "message": err.Error()})
+				return
+			}
+
+			if err := streamManager.SetRecording(id, req.Enabled); err != nil {
+				c.JSON(404, gin.H{"status": "error", "message": "Stream not found"})
+				return
+			}
+
+			c.JSON(200, gin.H{"status": "success", "id": id, "recording": req.Enabled})
+		})
+
+		api.POST("/streams/:id/clips", func(c *gin.Context) {
+			id := c.Param("id")
+			var req struct {
+				From string `json:"from" binding:"required"`
+				To   string `json:"to" binding:"required"`
+			}
+
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"status": "error", "message": err.Error()})
+				return
+			}
+
+			from, fromErr := lib.ParseTimestamp(req.From)
+			to, toErr := lib.ParseTimestamp(req.To)
+			if fromErr != nil || toErr != nil {
+				c.JSON(400, gin.H{"status": "error", "message": "Invalid from/to timestamp"})
+				return
+			}
+
+			job, err := streamManager.ExportClip(id, from, to)
+			if errors.Is(err, configs.ErrInvalidTimeRange) {
+				c.JSON(400, gin.H{"status": "error", "message": err.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(404, gin.H{"status": "error", "message": "No recorded footage in time range"})
+				return
+			}
+
+			c.JSON(202, gin.H{"status": "success", "clip": job})
+		})
+
+		api.GET("/streams/:id/clips/:clipId", func(c *gin.Context) {
+			job, err := streamManager.GetClipJob(c.Param("clipId"))
+			if err != nil || job.StreamID != c.Param("id") {
+				c.JSON(404, gin.H{"status": "error", "message": "Clip not found"})
+				return
+			}
+
+			c.JSON(200, gin.H{"status": "success", "clip": job})
+		})
+
+		api.GET("/streams/:id/clips/:clipId/download", func(c *gin.Context) {
+			job, err := streamManager.GetClipJob(c.Param("clipId"))
+			if err != nil || job.StreamID != c.Param("id") {
+				c.JSON(404, gin.H{"status": "error", "message": "Clip not found"})
+				return
+			}
+
+			if job.Status != lib.ClipStatusDone {
+				c.JSON(409, gin.H{"status": "error", "message": "Clip is " + job.Status})
+				return
+			}
+
+			c.FileAttachment(job.Path, job.StreamID+"_"+job.From.UTC().Format("20060102T150405Z")+".mp4")
+		})
+
 		api.DELETE("/streams/:id", func(c *gin.Context) {
 			id := c.Param("id")
 			if !streamManager.StreamExists(id) {